@@ -0,0 +1,149 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+)
+
+// defaultAsyncQueueSize 没有设置 Options.AsyncQueueSize 时写入队列的长度
+const defaultAsyncQueueSize = 1024
+
+// asyncWrite 异步写入队列中的一次写入，key/value 和 batch 二选一
+type asyncWrite struct {
+	key        []byte
+	value      []byte
+	batch      map[string]*data.LogRecord // 批量写暂存的数据
+	syncWrites bool                       // 批量写是否需要持久化
+	done       chan error
+}
+
+// PutAsync 将 key/value 放入内存中的写入队列后立即返回，由后台写入协程写入到数据文件中
+// 写入完成之后返回的 channel 中会收到写入的结果，开启 SyncWrites 时在数据持久化之后才会收到，
+// 没有开启时和 Put 一样按照 BytesPerSync 持久化。队列满时会阻塞，直到后台写入协程取走数据
+// 放入队列的是 key/value 的拷贝，返回之后调用方可以复用 key 和 value
+func (db *DB) PutAsync(key []byte, value []byte) <-chan error {
+	if len(key) == 0 {
+		return asyncResult(ErrKeyIsEmpty)
+	}
+	return db.enqueueAsync(&asyncWrite{
+		key:        append([]byte(nil), key...),
+		value:      append([]byte(nil), value...),
+		syncWrites: db.options.SyncWrites,
+	})
+}
+
+// CommitAsync 将暂存的数据放入内存中的写入队列后立即返回，由后台写入协程以一个事务提交
+// 返回的 channel 中会收到提交的结果，按照 WriteBatchOptions.SyncWrites 决定是否等待持久化
+func (wb *WriteBatch) CommitAsync() <-chan error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	if len(wb.pendingWrites) == 0 {
+		return asyncResult(nil)
+	}
+	if uint(len(wb.pendingWrites)) > wb.options.MaxBatchSize {
+		return asyncResult(ErrExceedMaxBatchNum)
+	}
+	batch := wb.pendingWrites
+	wb.pendingWrites = make(map[string]*data.LogRecord)
+	return wb.db.enqueueAsync(&asyncWrite{batch: batch, syncWrites: wb.options.SyncWrites})
+}
+
+// asyncResult 返回已经有结果的 channel
+func asyncResult(err error) <-chan error {
+	done := make(chan error, 1)
+	done <- err
+	close(done)
+	return done
+}
+
+// enqueueAsync 将写入放入队列，数据库关闭之后不再接受新的写入
+func (db *DB) enqueueAsync(w *asyncWrite) <-chan error {
+	if db.options.ReadOnly {
+		return asyncResult(ErrReadOnly)
+	}
+	w.done = make(chan error, 1)
+	db.asyncMu.RLock()
+	defer db.asyncMu.RUnlock()
+	if db.asyncClosed {
+		return asyncResult(ErrDatabaseClosed)
+	}
+	// 第一次异步写入时才启动写入协程，不使用异步写入的实例没有额外的协程
+	db.asyncOnce.Do(func() {
+		size := db.options.AsyncQueueSize
+		if size <= 0 {
+			size = defaultAsyncQueueSize
+		}
+		db.asyncCh = make(chan *asyncWrite, size)
+		db.asyncWg.Add(1)
+		go db.runAsyncWriter()
+	})
+	db.asyncCh <- w
+	return w.done
+}
+
+// runAsyncWriter 后台写入协程，每次取出队列中已有的全部写入，写完之后一起等待持久化
+func (db *DB) runAsyncWriter() {
+	defer db.asyncWg.Done()
+	for {
+		select {
+		case w := <-db.asyncCh:
+			db.flushAsync(db.drainAsync(w))
+		case <-db.closeCh:
+			// 关闭之前写完队列中剩余的数据
+			for {
+				select {
+				case w := <-db.asyncCh:
+					db.flushAsync(db.drainAsync(w))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// drainAsync 取出队列中已有的写入，和 first 组成一轮
+func (db *DB) drainAsync(first *asyncWrite) []*asyncWrite {
+	writes := []*asyncWrite{first}
+	for len(writes) < cap(db.asyncCh) {
+		select {
+		case w := <-db.asyncCh:
+			writes = append(writes, w)
+		default:
+			return writes
+		}
+	}
+	return writes
+}
+
+// flushAsync 按照顺序写入一轮的数据，和 group commit 一样对每个活跃文件只等待一次持久化，持久化之后才更新内存索引
+func (db *DB) flushAsync(writes []*asyncWrite) {
+	requests := make([]*commitRequest, len(writes))
+	for i, w := range writes {
+		requests[i] = db.asyncRequest(w)
+	}
+	db.commitGroup(requests)
+	for i, w := range writes {
+		w.done <- requests[i].err
+		close(w.done)
+	}
+}
+
+// asyncRequest 将一条异步写入转换为 group commit 中的一次写入
+func (db *DB) asyncRequest(w *asyncWrite) *commitRequest {
+	if w.batch == nil {
+		slot := db.hash(w.key)
+		return &commitRequest{slots: []uint32{slot}, sync: w.syncWrites, write: func() (func(), error) {
+			return db.putLocked(slot, w.key, w.value, 0)
+		}}
+	}
+
+	keys := make([]string, 0, len(w.batch))
+	for key := range w.batch {
+		keys = append(keys, key)
+	}
+	slots := db.sortedSlots(keys)
+	return &commitRequest{slots: slots, sync: w.syncWrites, write: func() (func(), error) {
+		return db.commitRecords(w.batch, slots, w.syncWrites)
+	}}
+}
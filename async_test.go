@@ -0,0 +1,142 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_PutAsync(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-put-async")
+	opts.DirPath = dir
+	opts.AsyncQueueSize = 64
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = <-db.PutAsync(nil, []byte("value"))
+	assert.Equal(t, ErrKeyIsEmpty, err)
+
+	results := make([]<-chan error, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		results = append(results, db.PutAsync(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	for _, result := range results {
+		assert.Nil(t, <-result)
+	}
+	// 收到结果之后可以读取到写入的数据
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+
+	// 批量写
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, <-wb.CommitAsync())
+	assert.Nil(t, wb.Put([]byte("batch-1"), []byte("value-1")))
+	assert.Nil(t, wb.Put([]byte("batch-2"), []byte("value-2")))
+	assert.Nil(t, wb.Delete(utils.GetTestKey(0)))
+	result := wb.CommitAsync()
+	assert.Nil(t, <-result)
+	val, err := db.Get([]byte("batch-2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-2"), val)
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	wb = db.NewWriteBatch(WriteBatchOptions{MaxBatchSize: 1, SyncWrites: true})
+	assert.Nil(t, wb.Put([]byte("a"), []byte("a")))
+	assert.Nil(t, wb.Put([]byte("b"), []byte("b")))
+	assert.Equal(t, ErrExceedMaxBatchNum, <-wb.CommitAsync())
+
+	// 关闭时写完队列中剩余的数据，关闭之后不再接受写入
+	for i := 1000; i < 2000; i++ {
+		results = append(results, db.PutAsync(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Close())
+	for _, result := range results {
+		assert.Nil(t, <-result)
+	}
+	assert.Equal(t, ErrDatabaseClosed, <-db.PutAsync([]byte("key"), []byte("value")))
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 1; i < 2000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+func TestDB_PutAsyncSyncWrites(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-put-async-sync")
+	opts.DirPath = dir
+	opts.SyncWrites = true
+	opts.Slots = 1
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("first"), []byte("value")))
+	ioManager := &countingIOManager{IOManager: db.activeFiles[0].IoManager}
+	db.activeFiles[0].IoManager = ioManager
+
+	results := make([]<-chan error, 0, 200)
+	for i := 0; i < 200; i++ {
+		results = append(results, db.PutAsync(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	for _, result := range results {
+		assert.Nil(t, <-result)
+	}
+	// 同一轮的写入只需要一次 Sync，收到结果时数据已经持久化
+	assert.Less(t, ioManager.syncs.Load(), int64(200))
+	assert.Equal(t, db.activeFiles[0].WriteOff, db.syncers[0].synced)
+}
+
+func TestDB_PutAsyncReuseBuffer(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = t.TempDir()
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	// 返回之后立即复用 key 和 value 的缓冲区
+	key := make([]byte, 0, 64)
+	value := make([]byte, 0, 64)
+	results := make([]<-chan error, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		key = append(key[:0], utils.GetTestKey(i)...)
+		value = append(value[:0], utils.GetTestKey(i)...)
+		results = append(results, db.PutAsync(key, value))
+		copy(key, "overwritten")
+		copy(value, "overwritten")
+	}
+	for _, result := range results {
+		assert.Nil(t, <-result)
+	}
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+func TestDB_PutAsyncDefaultQueueSize(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = t.TempDir()
+	opts.AsyncQueueSize = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	// 没有异步写入时不启动写入协程
+	assert.Nil(t, db.asyncCh)
+	assert.Nil(t, <-db.PutAsync([]byte("key"), []byte("value")))
+	assert.Equal(t, defaultAsyncQueueSize, cap(db.asyncCh))
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,67 @@
+package bitcask_go
+
+import (
+	"log"
+	"time"
+)
+
+// runAutoMerger 后台定期检查无效数据量，满足条件时自动进行 merge，直到数据库关闭
+func (db *DB) runAutoMerger() {
+	defer db.bgWg.Done()
+
+	ticker := time.NewTicker(db.options.AutoMergeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case now := <-ticker.C:
+			// merge 完成时有快照打开，结果还没有加载
+			if _, err := db.applyMerge(); err != nil {
+				log.Printf("failed to apply merge: %v\n", err)
+			}
+			if !db.shouldAutoMerge(now) {
+				continue
+			}
+			err := db.merge(db.options.AutoMergeRatio)
+			if err == ErrMergeRatioUnreached || err == ErrMergeIsProgress {
+				continue
+			}
+			if err != nil {
+				log.Printf("failed to auto merge: %v\n", err)
+			}
+			db.autoMergeMu.Lock()
+			db.lastAutoMergeTime = time.Now()
+			db.lastAutoMergeErr = err
+			db.autoMergeMu.Unlock()
+		}
+	}
+}
+
+// shouldAutoMerge 判断当前是否满足自动 merge 的条件，无效数据占比由 merge 自己判断
+func (db *DB) shouldAutoMerge(now time.Time) bool {
+	if !inMergeWindow(now, db.options.AutoMergeWindowStart, db.options.AutoMergeWindowEnd) {
+		return false
+	}
+	// 还有没有加载的 merge 结果时不需要重复 merge，快照释放、备份完成之后由下一次检查加载
+	if db.hasPendingMerge() {
+		return false
+	}
+
+	reclaimSize := db.reclaimSize.Load()
+	return reclaimSize > 0 && reclaimSize >= db.options.AutoMergeMinReclaimSize
+}
+
+// inMergeWindow 判断 now 是否在 [start, end) 时间窗口内，start 大于 end 时窗口跨越零点
+func inMergeWindow(now time.Time, start, end time.Duration) bool {
+	if start == end {
+		return true
+	}
+	year, month, day := now.Date()
+	offset := now.Sub(time.Date(year, month, day, 0, 0, 0, 0, now.Location()))
+	if start < end {
+		return offset >= start && offset < end
+	}
+	return offset >= start || offset < end
+}
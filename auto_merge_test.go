@@ -0,0 +1,108 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_AutoMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024 * 1024
+	opts.AutoMergeInterval = 20 * time.Millisecond
+	opts.AutoMergeRatio = 0.3
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 8000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	assert.Eventually(t, func() bool {
+		return !db.Stat().LastAutoMergeTime.IsZero()
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, db.Stat().LastAutoMergeErr)
+
+	// merge 的结果立即生效，之后还会继续自动 merge
+	lastMergeTime := db.Stat().LastAutoMergeTime
+	for i := 8000; i < 9000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		return db.Stat().LastAutoMergeTime.After(lastMergeTime)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, db.Stat().LastAutoMergeErr)
+	assert.False(t, db.hasPendingMerge())
+	assert.Equal(t, 1000, len(db.ListKeys()))
+	for i := 9000; i < 10000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	for i := 9000; i < 10000; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
+
+func TestDB_AutoMerge_MinReclaimSize(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge-min")
+	opts.DirPath = dir
+	opts.AutoMergeInterval = 10 * time.Millisecond
+	opts.AutoMergeRatio = 0
+	opts.AutoMergeMinReclaimSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, db.Stat().LastAutoMergeTime.IsZero())
+}
+
+func TestInMergeWindow(t *testing.T) {
+	now := time.Date(2024, 1, 1, 3, 30, 0, 0, time.Local)
+	assert.True(t, inMergeWindow(now, 0, 0))
+	assert.True(t, inMergeWindow(now, 2*time.Hour, 4*time.Hour))
+	assert.False(t, inMergeWindow(now, 4*time.Hour, 6*time.Hour))
+	// 跨越零点的时间窗口
+	assert.True(t, inMergeWindow(now, 22*time.Hour, 4*time.Hour))
+	assert.False(t, inMergeWindow(now, 22*time.Hour, 2*time.Hour))
+}
+
+func TestOpen_InvalidAutoMergeOptions(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge-opts")
+	opts.DirPath = dir
+	opts.AutoMergeInterval = time.Second
+	opts.AutoMergeWindowEnd = 25 * time.Hour
+	_, err := Open(opts)
+	assert.NotNil(t, err)
+	_ = os.RemoveAll(dir)
+}
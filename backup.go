@@ -0,0 +1,304 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/index"
+	"bitcask-go/utils"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// backupManifestName 备份目录中清单文件的名称
+	backupManifestName = "backup-manifest"
+
+	// backupChecksumSize 清单中记录校验值的数据量，为每个文件备份范围内最后的这部分数据
+	backupChecksumSize = 4096
+)
+
+// Manifest 备份的清单，记录备份时刻的事务序列号和每个文件备份的大小
+// 增量备份通过 ParentId 指向上一次备份的清单，全量备份的 ParentId 为 0
+type Manifest struct {
+	Id         uint64          `json:"id"`
+	ParentId   uint64          `json:"parent_id"`
+	SeqNo      uint64          `json:"seq_no"`
+	NextFileId uint32          `json:"next_file_id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Files      []*ManifestFile `json:"files"`
+}
+
+// ManifestFile 备份时刻数据目录中的一个文件
+// 备份目录中保存的是文件 [Offset, Size) 范围内的数据，Offset 等于 Size 时说明文件没有变化，备份目录中没有这个文件
+// Inode 和 Checksum 用来判断下次备份时的同名文件是否还是这个文件，只是在末尾追加了数据
+type ManifestFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+	Inode    uint64 `json:"inode,omitempty"`
+	Checksum uint32 `json:"checksum,omitempty"`
+}
+
+// backupFile 需要备份的文件
+type backupFile struct {
+	name      string
+	size      int64
+	immutable bool   // 文件不会再被修改，可以直接创建硬链接
+	inode     uint64 // 文件的 inode，merge 替换文件之后会变化
+}
+
+// Backup 备份数据库到 dir 目录中，备份的是调用时刻的数据
+// 只在记录每个文件当前大小的时候短暂地阻塞写入，不再修改的文件创建硬链接，活跃文件只拷贝已经写入的部分
+// 最后写入清单文件，没有清单文件的备份是不完整的
+func (db *DB) Backup(dir string) error {
+	return db.backup(dir, nil)
+}
+
+// BackupIncremental 基于上一次备份的清单 since 进行增量备份，只拷贝之后新建的文件和文件新追加的数据
+// 恢复时需要从全量备份开始的完整的备份链，见 Restore
+func (db *DB) BackupIncremental(dir string, since Manifest) error {
+	return db.backup(dir, &since)
+}
+
+func (db *DB) backup(dir string, since *Manifest) error {
+	// 只读实例打开的文件可能还会被写入进程追加数据，不能创建硬链接
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	// 删除之前的清单，备份完成之前目录中的数据是不完整的
+	if err := os.Remove(filepath.Join(dir, backupManifestName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// checkpoint 中开始计数，备份完成之前 merge 和 blob 回收不删除文件
+	defer db.backups.Add(-1)
+	files, manifest, writeIndex, err := db.checkpoint()
+	if err != nil {
+		return err
+	}
+	// B+ 树索引不是追加写入的，每次都需要完整地备份
+	if writeIndex != nil {
+		if err := writeIndex(dir); err != nil {
+			return err
+		}
+		info, err := os.Stat(filepath.Join(dir, index.BPlusTreeIndexFileName))
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, &ManifestFile{Name: info.Name(), Size: info.Size()})
+	}
+
+	prevFiles := make(map[string]*ManifestFile)
+	if since != nil {
+		manifest.ParentId = since.Id
+		for _, file := range since.Files {
+			prevFiles[file.Name] = file
+		}
+	}
+	for _, file := range files {
+		src := filepath.Join(db.options.DirPath, file.name)
+		// 文件只是追加了数据时只拷贝新的部分，被 merge 替换或者被截断修改过时需要完整地备份
+		var offset int64 = 0
+		if prev, ok := prevFiles[file.name]; ok && sameBackupFile(prev, file, src) {
+			offset = prev.Size
+		}
+		checksum, err := utils.ChecksumRange(src, max(file.size-backupChecksumSize, 0), file.size)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, &ManifestFile{
+			Name:     file.name,
+			Size:     file.size,
+			Offset:   offset,
+			Inode:    file.inode,
+			Checksum: checksum,
+		})
+		if offset == file.size && file.size > 0 {
+			continue
+		}
+
+		dest := filepath.Join(dir, file.name)
+		switch {
+		case offset > 0:
+			err = utils.CopyFileRange(src, dest, offset, file.size)
+		case file.immutable:
+			err = utils.LinkOrCopyFile(src, dest, file.size)
+		default:
+			err = utils.CopyFile(src, dest, file.size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Name < manifest.Files[j].Name
+	})
+
+	// 写入事务序列号和下一个文件 id，B+ 树索引打开时需要事务序列号
+	if err := writeMetaFile(dir, data.SeqNoFileName, seqNoKey, strconv.FormatUint(manifest.SeqNo, 10)); err != nil {
+		return err
+	}
+	if err := writeMetaFile(dir, data.NextFileIdFileName, nextFileIdKey,
+		strconv.FormatUint(uint64(manifest.NextFileId), 10)); err != nil {
+		return err
+	}
+	return writeManifest(dir, manifest)
+}
+
+// checkpoint 锁住全部 slot，持久化活跃文件，记录每个文件当前的大小
+// B+ 树索引还会返回写入这个时刻索引的函数
+func (db *DB) checkpoint() ([]*backupFile, *Manifest, func(dirPath string) error, error) {
+	for slot := range db.mus {
+		db.mus[slot].RLock()
+	}
+	defer func() {
+		for i := len(db.mus) - 1; i >= 0; i-- {
+			db.mus[i].RUnlock()
+		}
+	}()
+	db.backups.Add(1)
+
+	var files []*backupFile
+	for _, file := range db.activeFiles {
+		if file == nil {
+			continue
+		}
+		if err := file.Sync(); err != nil {
+			return nil, nil, nil, err
+		}
+		files = append(files, &backupFile{
+			name: filepath.Base(data.GetDataFileName("", file.FileId)),
+			size: file.WriteOff,
+		})
+	}
+
+	db.filesMu.RLock()
+	for _, file := range db.olderFiles {
+		size, err := file.IoManager.Size()
+		if err != nil {
+			db.filesMu.RUnlock()
+			return nil, nil, nil, err
+		}
+		files = append(files, &backupFile{
+			name:      filepath.Base(data.GetDataFileName("", file.FileId)),
+			size:      size,
+			immutable: true,
+		})
+		// 数据文件的 hint 文件可能还在后台写入，没有写完的 hint 文件在打开时会被忽略
+		hintName := data.GetDataHintFileName(db.options.DirPath, file.FileId)
+		if info, err := os.Stat(hintName); err == nil {
+			files = append(files, &backupFile{name: filepath.Base(hintName), size: info.Size(), immutable: true})
+		}
+	}
+	// 活跃的 blob 文件还会追加数据，其他的 blob 文件只会被 BlobGC 删除
+	active := make(map[uint32]bool)
+	for _, file := range db.activeBlobFiles {
+		if file != nil {
+			active[file.FileId] = true
+		}
+	}
+	for _, file := range db.blobFiles {
+		if active[file.FileId] {
+			if err := file.Sync(); err != nil {
+				db.filesMu.RUnlock()
+				return nil, nil, nil, err
+			}
+		}
+		size, err := file.IoManager.Size()
+		if err != nil {
+			db.filesMu.RUnlock()
+			return nil, nil, nil, err
+		}
+		files = append(files, &backupFile{
+			name:      filepath.Base(data.GetBlobFileName("", file.FileId)),
+			size:      size,
+			immutable: !active[file.FileId],
+		})
+	}
+	db.filesMu.RUnlock()
+
+	// merge 生成的 hint 索引文件和完成标识在加载 merge 的结果时替换，备份期间不会加载
+	for _, name := range []string{data.HintFileName, data.MergeFinishedFileName} {
+		if info, err := os.Stat(filepath.Join(db.options.DirPath, name)); err == nil {
+			files = append(files, &backupFile{name: name, size: info.Size(), immutable: true})
+		}
+	}
+	// 记录每个文件的 inode，下次增量备份时判断同名的文件是否被替换过
+	for _, file := range files {
+		info, err := os.Stat(filepath.Join(db.options.DirPath, file.name))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		file.inode = utils.FileInode(info)
+	}
+	var writeIndex func(dirPath string) error
+	if bpt, ok := db.index.(*index.BPlusTree); ok {
+		fn, err := bpt.Checkpoint()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		writeIndex = fn
+	}
+
+	now := time.Now()
+	manifest := &Manifest{
+		Id:         uint64(now.UnixNano()),
+		SeqNo:      atomic.LoadUint64(&db.seqNo),
+		NextFileId: uint32(db.nextFileId.Load()),
+		CreatedAt:  now,
+	}
+	return files, manifest, writeIndex, nil
+}
+
+// sameBackupFile 判断 file 是否还是上次备份 prev 时的文件，并且上次备份的部分没有被修改过
+// merge 会复用文件名，只比较文件大小无法发现被替换或者截断之后又追加了数据的文件
+func sameBackupFile(prev *ManifestFile, file *backupFile, path string) bool {
+	if prev.Inode == 0 || prev.Inode != file.inode || prev.Size > file.size {
+		return false
+	}
+	checksum, err := utils.ChecksumRange(path, max(prev.Size-backupChecksumSize, 0), prev.Size)
+	return err == nil && checksum == prev.Checksum
+}
+
+// writeMetaFile 写入只保存一条记录的元数据文件，例如事务序列号文件
+func writeMetaFile(dirPath, fileName, key, value string) error {
+	path := filepath.Join(dirPath, fileName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte(key), Value: []byte(value)})
+	return os.WriteFile(path, encRecord, 0644)
+}
+
+// writeManifest 写入备份的清单文件，先写入临时文件再重命名，保证清单是完整的
+func writeManifest(dir string, manifest *Manifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpName := filepath.Join(dir, backupManifestName+".tmp")
+	if err := os.WriteFile(tmpName, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filepath.Join(dir, backupManifestName))
+}
+
+// ReadManifest 读取备份目录中的清单
+func ReadManifest(dir string) (*Manifest, error) {
+	content, err := os.ReadFile(filepath.Join(dir, backupManifestName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
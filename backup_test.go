@@ -0,0 +1,264 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Backup_Checkpoint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-checkpoint")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+
+	// 备份期间继续写入
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 3000; i < 6000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+		}
+	}()
+
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-checkpoint-out")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+	assert.Nil(t, db.Backup(backupDir))
+	wg.Wait()
+
+	manifest, err := ReadManifest(backupDir)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, manifest.Files)
+	for _, file := range manifest.Files {
+		info, err := os.Stat(filepath.Join(backupDir, file.Name))
+		assert.Nil(t, err)
+		if filepath.Ext(file.Name) == data.DataFileNameSuffix {
+			assert.Equal(t, file.Size, info.Size())
+		}
+	}
+
+	// 不再写入的数据文件是硬链接
+	srcInfo, err := os.Stat(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	destInfo, err := os.Stat(data.GetDataFileName(backupDir, 0))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(srcInfo, destInfo))
+
+	opts1 := opts
+	opts1.DirPath = backupDir
+	db2, err := Open(opts1)
+	assert.Nil(t, err)
+	keys := len(db2.ListKeys())
+	assert.GreaterOrEqual(t, keys, 3000)
+	assert.LessOrEqual(t, keys, 6000)
+	for i := 0; i < 3000; i++ {
+		val1, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		val2, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, val1, val2)
+	}
+	assert.Nil(t, db2.Close())
+}
+
+func TestDB_Backup_BPlusTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-bptree")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-bptree-out")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+	assert.Nil(t, db.Backup(backupDir))
+
+	// 备份之后的写入不影响备份的数据
+	for i := 1000; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+
+	opts1 := opts
+	opts1.DirPath = backupDir
+	db2, err := Open(opts1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	_, err = db2.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.Nil(t, db2.Close())
+}
+
+func TestDB_BackupIncremental(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-incremental")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	backupRoot, _ := os.MkdirTemp("", "bitcask-go-backup-incremental-out")
+	defer func() {
+		_ = os.RemoveAll(backupRoot)
+	}()
+	fullDir := filepath.Join(backupRoot, "full")
+	inc1Dir := filepath.Join(backupRoot, "inc1")
+	inc2Dir := filepath.Join(backupRoot, "inc2")
+
+	for i := 0; i < 4000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.Backup(fullDir))
+	full, err := ReadManifest(fullDir)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), full.ParentId)
+
+	// 第一次增量备份，没有变化的数据文件不需要拷贝
+	for i := 4000; i < 5000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.BackupIncremental(inc1Dir, *full))
+	inc1, err := ReadManifest(inc1Dir)
+	assert.Nil(t, err)
+	assert.Equal(t, full.Id, inc1.ParentId)
+	var unchanged int
+	for _, file := range inc1.Files {
+		if file.Offset == file.Size && file.Size > 0 {
+			_, err = os.Stat(filepath.Join(inc1Dir, file.Name))
+			assert.True(t, os.IsNotExist(err))
+			unchanged++
+		}
+	}
+	assert.Greater(t, unchanged, 0)
+
+	// merge 之后数据文件被重写，第二次增量备份
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 5000; i < 5500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.BackupIncremental(inc2Dir, *inc1))
+
+	check := func(upTo *Manifest, keys int) {
+		targetDir, _ := os.MkdirTemp("", "bitcask-go-restore")
+		defer func() {
+			_ = os.RemoveAll(targetDir)
+		}()
+		assert.Nil(t, Restore(backupRoot, targetDir, upTo))
+
+		opts1 := opts
+		opts1.DirPath = targetDir
+		db2, err := Open(opts1)
+		assert.Nil(t, err)
+		assert.Equal(t, keys, len(db2.ListKeys()))
+		_, err = db2.Get(utils.GetTestKey(1000))
+		assert.Nil(t, err)
+		assert.Nil(t, db2.Close())
+	}
+	check(full, 4000)
+	check(inc1, 4500)
+	check(nil, 5000)
+
+	// 目标目录不为空
+	assert.Equal(t, ErrRestoreDirNotEmpty, Restore(backupRoot, dir, nil))
+
+	// 缺少中间的增量备份
+	assert.Nil(t, os.RemoveAll(inc1Dir))
+	targetDir, _ := os.MkdirTemp("", "bitcask-go-restore")
+	defer func() {
+		_ = os.RemoveAll(targetDir)
+	}()
+	assert.Equal(t, ErrBackupChainBroken, Restore(backupRoot, targetDir, nil))
+}
+
+// 两次备份之间 merge 替换了同名的文件，增量备份需要完整地备份这些文件
+func TestDB_BackupIncremental_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-incremental-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	backupRoot, _ := os.MkdirTemp("", "bitcask-go-backup-incremental-merge-out")
+	defer func() {
+		_ = os.RemoveAll(backupRoot)
+	}()
+	fullDir := filepath.Join(backupRoot, "full")
+	incDir := filepath.Join(backupRoot, "inc")
+
+	values := make(map[string][]byte)
+	put := func(i int) {
+		value := utils.RandomValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+		values[string(utils.GetTestKey(i))] = value
+	}
+	for i := 0; i < 500; i++ {
+		put(i)
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Backup(fullDir))
+	full, err := ReadManifest(fullDir)
+	assert.Nil(t, err)
+
+	// merge 之后 hint 索引文件变大了，但内容完全不同
+	for i := 0; i < 3000; i++ {
+		put(i)
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.BackupIncremental(incDir, *full))
+	inc, err := ReadManifest(incDir)
+	assert.Nil(t, err)
+	for _, file := range inc.Files {
+		if file.Name == data.HintFileName {
+			assert.Equal(t, int64(0), file.Offset)
+		}
+	}
+
+	targetDir, _ := os.MkdirTemp("", "bitcask-go-restore-merge")
+	defer func() {
+		_ = os.RemoveAll(targetDir)
+	}()
+	assert.Nil(t, Restore(backupRoot, targetDir, nil))
+	opts1 := opts
+	opts1.DirPath = targetDir
+	db2, err := Open(opts1)
+	assert.Nil(t, err)
+	assert.Equal(t, len(values), len(db2.ListKeys()))
+	for key, value := range values {
+		val, err := db2.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	assert.Nil(t, db2.Close())
+}
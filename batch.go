@@ -20,7 +20,7 @@ type WriteBatch struct {
 	pendingWrites map[string]*data.LogRecord // 暂存用户写入的数据
 }
 
-// NewWriteBatch 初始化 WriteBatch
+// NewWriteBatch 初始化 WriteBatch，只读实例的 WriteBatch 写入时返回 ErrReadOnly
 func (db *DB) NewWriteBatch(opts WriteBatchOptions) *WriteBatch {
 	if db.options.IndexType == BPlusTree && !db.seqNoFileExists && !db.isInitial {
 		panic("cannot use write batch, seq no file not exists")
@@ -38,6 +38,9 @@ func (wb *WriteBatch) Put(key []byte, value []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if wb.db.options.ReadOnly {
+		return ErrReadOnly
+	}
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 
@@ -52,6 +55,9 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if wb.db.options.ReadOnly {
+		return ErrReadOnly
+	}
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 
@@ -72,6 +78,9 @@ func (wb *WriteBatch) Delete(key []byte) error {
 
 // Commit 提交事务 将暂存的数据写到数据文件，并更新内存索引
 func (wb *WriteBatch) Commit() error {
+	if wb.db.options.ReadOnly {
+		return ErrReadOnly
+	}
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 
@@ -85,9 +94,29 @@ func (wb *WriteBatch) Commit() error {
 		return ErrExceedMaxBatchNum
 	}
 
-	slotsIdMap := make(map[uint32]struct{})
+	keys := make([]string, 0, len(wb.pendingWrites))
 	for key := range wb.pendingWrites {
-		slot := wb.db.hash([]byte(key))
+		keys = append(keys, key)
+	}
+	slots := wb.db.sortedSlots(keys)
+
+	// 持有全部 slot 的写锁保证事务提交的串行化，需要持久化时和其他写入者合并 Sync
+	return wb.db.writeSlots(slots, false, wb.options.SyncWrites, func() (func(), error) {
+		apply, err := wb.db.commitRecords(wb.pendingWrites, slots, wb.options.SyncWrites)
+		if err != nil {
+			return nil, err
+		}
+		// 清空暂存的数据
+		wb.pendingWrites = make(map[string]*data.LogRecord)
+		return apply, nil
+	})
+}
+
+// sortedSlots 计算一组 key 所在的 slot，从小到大排序，保证加锁的顺序一致，避免死锁
+func (db *DB) sortedSlots(keys []string) []uint32 {
+	slotsIdMap := make(map[uint32]struct{})
+	for _, key := range keys {
+		slot := db.hash([]byte(key))
 		slotsIdMap[slot] = struct{}{}
 	}
 
@@ -99,89 +128,98 @@ func (wb *WriteBatch) Commit() error {
 	sort.Slice(slots, func(i, j int) bool {
 		return slots[i] < slots[j]
 	})
+	return slots
+}
 
-	// 加锁保证事务提交的串行化
-	for _, slot := range slots {
-		wb.db.mus[slot].Lock()
-	}
-	// 倒着释放锁
-	defer func() {
-		for i := len(slots) - 1; i >= 0; i-- {
-			wb.db.mus[slots[i]].Unlock()
-		}
-	}()
-
+// commitRecords 以一个事务写入一批数据，最后写入一条事务完成的记录，返回更新内存索引的函数
+// 调用前需要持有 slots 中所有 slot 的写锁，slots 需要包含所有 records 所在的 slot
+func (db *DB) commitRecords(records map[string]*data.LogRecord, slots []uint32, syncWrites bool) (func(), error) {
 	// 获取当前最新的事务序列号
-	seqNo := atomic.AddUint64(&wb.db.seqNo, 1)
+	seqNo := atomic.AddUint64(&db.seqNo, 1)
 
 	positions := make(map[string]*data.LogRecordPos)
 
 	// 开始去写数据
-	for _, record := range wb.pendingWrites {
-		slot := wb.db.hash(record.Key)
-		logRecordPos, err := wb.db.appendLogRecord(slot, &data.LogRecord{
+	for _, record := range records {
+		slot := db.hash(record.Key)
+		logRecord := &data.LogRecord{
 			Key:   logRecordKeyWithSeq(record.Key, seqNo),
 			Value: record.Value,
 			Type:  record.Type,
-		})
+		}
+		if err := db.encodeValue(slot, record.Key, logRecord); err != nil {
+			return nil, err
+		}
+		logRecordPos, err := db.appendLogRecord(slot, logRecord)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		positions[string(record.Key)] = logRecordPos
 	}
 
 	// 写一条标识事务完成的数据,并且记录Num
 	num := make([]byte, 8)
-	binary.BigEndian.PutUint64(num, uint64(len(wb.pendingWrites)))
+	binary.BigEndian.PutUint64(num, uint64(len(records)))
 
 	finishedRecord := &data.LogRecord{
-		Key:   txnFinKey,
+		Key:   logRecordKeyWithSeq(txnFinKey, seqNo),
 		Value: num,
 		Type:  data.LogRecordTxnFinished,
 	}
 
 	//找到最大fileId,写入事务完成的记录
-	var maxFileId uint32 = 0
-	var slotToWrite uint32
+	slotToWrite := slots[0]
 	for _, slot := range slots {
-		if wb.db.activeFiles[slot].FileId > maxFileId {
-			maxFileId = wb.db.activeFiles[slot].FileId
+		if db.activeFiles[slot].FileId > db.activeFiles[slotToWrite].FileId {
 			slotToWrite = slot
 		}
 	}
 
-	if _, err := wb.db.appendLogRecord(slotToWrite, finishedRecord); err != nil {
-		return err
+	if _, err := db.appendLogRecord(slotToWrite, finishedRecord); err != nil {
+		return nil, err
 	} //添加一条记录标识事务完成
 
-	// 根据配置去进行持久化
-	if wb.options.SyncWrites {
+	// value 写入了 blob 文件时，需要在记录之前持久化
+	if syncWrites {
 		for _, slot := range slots {
-			if err := wb.db.activeFiles[slot].Sync(); err != nil {
-				return err
+			if blobFile := db.activeBlobFiles[slot]; blobFile != nil {
+				if err := blobFile.Sync(); err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
 
 	// 更新对应的内存索引(更新前保证数据写入日志文件成功)
-	for _, record := range wb.pendingWrites {
-		pos := positions[string(record.Key)]
-		var oldPos *data.LogRecordPos
-		if record.Type == data.LogRecordNormal {
-			oldPos = wb.db.index.Put(record.Key, pos)
-		}
-		if record.Type == data.LogRecordDeleted {
-			oldPos, _ = wb.db.index.Delete(record.Key)
-		}
-		if oldPos != nil {
-			wb.db.reclaimSize += int64(oldPos.Size)
-		}
-	}
-
-	// 清空暂存的数据
-	wb.pendingWrites = make(map[string]*data.LogRecord)
+	return func() {
+		entries := make([]*WatchEntry, 0, len(records))
+		for _, record := range records {
+			pos := positions[string(record.Key)]
+			var oldPos *data.LogRecordPos
+			if record.Type == data.LogRecordNormal {
+				oldPos = db.index.Put(record.Key, pos)
+			}
+			if record.Type == data.LogRecordDeleted {
+				oldPos, _ = db.index.Delete(record.Key)
+			}
+			if oldPos != nil {
+				db.reclaimSize.Add(int64(oldPos.Size))
+			}
+			if record.Type == data.LogRecordNormal {
+				db.trackLive(pos, oldPos)
+			} else {
+				db.trackLive(nil, oldPos)
+			}
+			db.retainVersion(record.Key, oldPos, seqNo)
 
-	return nil
+			entry := &WatchEntry{Key: record.Key, Value: record.Value, Type: WatchPut}
+			if record.Type == data.LogRecordDeleted {
+				entry = &WatchEntry{Key: record.Key, Type: WatchDelete}
+			}
+			entries = append(entries, entry)
+		}
+		db.publish(seqNo, entries)
+	}, nil
 }
 
 // key + Seq Number 编码
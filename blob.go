@@ -0,0 +1,387 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loadBlobFiles 打开数据目录中还没有打开的 blob 文件，并更新下一个 blob 文件的 id
+// 打开数据库之后调用时需要持有 filesMu 的写锁
+func (db *DB) loadBlobFiles() error {
+	dirEntries, err := os.ReadDir(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirEntries {
+		if !strings.HasSuffix(entry.Name(), data.BlobFileNameSuffix) {
+			continue
+		}
+		fid, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), data.BlobFileNameSuffix))
+		if err != nil {
+			return ErrDataDirectoryCorrupted
+		}
+		if int64(fid) >= db.nextBlobFileId.Load() {
+			db.nextBlobFileId.Store(int64(fid) + 1)
+		}
+		if _, ok := db.blobFiles[uint32(fid)]; ok {
+			continue
+		}
+		blobFile, err := db.openBlobFile(uint32(fid))
+		if err != nil {
+			return err
+		}
+		db.blobFiles[uint32(fid)] = blobFile
+	}
+	return nil
+}
+
+// openBlobFile 打开 blob 文件，开启加密时设置加解密使用的 cipher
+func (db *DB) openBlobFile(fileId uint32) (*data.DataFile, error) {
+	blobFile, err := data.OpenBlobFile(db.options.DirPath, fileId)
+	if err != nil {
+		return nil, err
+	}
+	blobFile.Cipher = db.cipher
+	return blobFile, nil
+}
+
+// encodeValue 写入之前处理记录的 value：先按照配置压缩，长度达到 ValueThreshold 的 value 再写入 blob 文件，
+// 记录中只保存 blob 指针，调用前需要持有 slot 的写锁
+func (db *DB) encodeValue(slot uint32, key []byte, logRecord *data.LogRecord) error {
+	separate := db.options.ValueThreshold > 0 && len(logRecord.Value) >= db.options.ValueThreshold
+	if err := db.compressRecord(logRecord); err != nil {
+		return err
+	}
+	if !separate {
+		return nil
+	}
+	return db.writeBlob(slot, key, logRecord)
+}
+
+// writeBlob 将记录的 value 写入到 slot 的活跃 blob 文件中，并把记录的 value 替换为 blob 指针
+// 调用前需要持有 slot 的写锁
+func (db *DB) writeBlob(slot uint32, key []byte, logRecord *data.LogRecord) error {
+	if db.activeBlobFiles[slot] == nil {
+		if err := db.setActiveBlobFile(slot); err != nil {
+			return err
+		}
+	}
+
+	// blob 文件中保存真实的 key，回收时据此判断 value 是否还有效
+	blobRecord := &data.LogRecord{
+		Key:        key,
+		Value:      logRecord.Value,
+		Compressed: logRecord.Compressed,
+	}
+	encRecord, size, err := db.activeBlobFiles[slot].EncodeLogRecord(blobRecord)
+	if err != nil {
+		return err
+	}
+	if db.activeBlobFiles[slot].WriteOff+size > db.options.DataFileSize {
+		if err := db.activeBlobFiles[slot].Sync(); err != nil {
+			return err
+		}
+		if err := db.setActiveBlobFile(slot); err != nil {
+			return err
+		}
+		// 加密的记录和写入的位置绑定，需要重新编码
+		if encRecord, size, err = db.activeBlobFiles[slot].EncodeLogRecord(blobRecord); err != nil {
+			return err
+		}
+	}
+
+	blobFile := db.activeBlobFiles[slot]
+	writeOff := blobFile.WriteOff
+	if err := blobFile.Write(encRecord); err != nil {
+		return err
+	}
+	// 记录持久化之前 value 必须先持久化
+	if db.options.SyncWrites {
+		if err := blobFile.Sync(); err != nil {
+			return err
+		}
+	}
+
+	logRecord.Value = data.EncodeLogRecordPos(&data.LogRecordPos{Fid: blobFile.FileId, Offset: writeOff, Size: uint32(size)})
+	logRecord.Compressed = false
+	logRecord.Blob = true
+	return nil
+}
+
+// setActiveBlobFile 为 slot 创建新的活跃 blob 文件，调用前需要持有 slot 的写锁
+func (db *DB) setActiveBlobFile(slot uint32) error {
+	fileId := uint32(db.nextBlobFileId.Add(1) - 1)
+	blobFile, err := db.openBlobFile(fileId)
+	if err != nil {
+		return err
+	}
+	db.filesMu.Lock()
+	db.blobFiles[fileId] = blobFile
+	db.filesMu.Unlock()
+	db.activeBlobFiles[slot] = blobFile
+	return nil
+}
+
+// readBlob 根据 blob 指针读取 value
+func (db *DB) readBlob(encPos []byte) ([]byte, error) {
+	blobPos := data.DecodeLogRecordPos(encPos)
+	db.filesMu.RLock()
+	blobFile := db.blobFiles[blobPos.Fid]
+	db.filesMu.RUnlock()
+	if blobFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+	buf := data.GetRecordBuffer(int(blobPos.Size))
+	defer data.PutRecordBuffer(buf)
+	blobRecord, err := blobFile.ReadLogRecordAt(blobPos.Offset, blobPos.Size, *buf)
+	if err != nil {
+		return nil, err
+	}
+	if !blobRecord.Compressed {
+		return append([]byte(nil), blobRecord.Value...), nil
+	}
+	return db.decompressValue(blobRecord)
+}
+
+// recordValue 取出记录中用户写入的 value，value 保存在 blob 文件中时从 blob 文件读取，压缩过的 value 会解压
+func (db *DB) recordValue(logRecord *data.LogRecord) ([]byte, error) {
+	if logRecord.Blob {
+		return db.readBlob(logRecord.Value)
+	}
+	return db.decompressValue(logRecord)
+}
+
+// setBlobPos value 保存在 blob 文件中时，在位置信息中记录 blob 文件 id 和大小
+func setBlobPos(pos *data.LogRecordPos, logRecord *data.LogRecord) {
+	if !logRecord.Blob {
+		return
+	}
+	blobPos := data.DecodeLogRecordPos(logRecord.Value)
+	pos.BlobFid, pos.BlobSize = blobPos.Fid, blobPos.Size
+}
+
+// BlobStats 返回每个 blob 文件的有效和无效数据量，按照文件 id 从小到大排序
+func (db *DB) BlobStats() ([]*FileStat, error) {
+	for slot := range db.mus {
+		db.mus[slot].RLock()
+	}
+	defer func() {
+		for i := len(db.mus) - 1; i >= 0; i-- {
+			db.mus[i].RUnlock()
+		}
+	}()
+	return db.blobStats()
+}
+
+// blobStats 统计每个 blob 文件的有效和无效数据量，调用时需要持有全部 slot 的锁
+func (db *DB) blobStats() ([]*FileStat, error) {
+	sizes := make(map[uint32]int64)
+	db.filesMu.RLock()
+	for fid, file := range db.blobFiles {
+		size, err := file.IoManager.Size()
+		if err != nil {
+			db.filesMu.RUnlock()
+			return nil, err
+		}
+		sizes[fid] = size
+	}
+	db.filesMu.RUnlock()
+
+	db.statMu.Lock()
+	defer db.statMu.Unlock()
+	stats := make([]*FileStat, 0, len(sizes))
+	for fid, size := range sizes {
+		live := db.blobLive[fid]
+		stats = append(stats, &FileStat{
+			FileId:    fid,
+			Size:      size,
+			LiveBytes: live,
+			DeadBytes: size - live,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].FileId < stats[j].FileId
+	})
+	return stats, nil
+}
+
+// BlobGC 回收 blob 文件中的无效数据
+// 无效数据占比达到 Options.BlobGCDeadRatio 的 blob 文件中仍然有效的 value 会被移动到活跃的 blob 文件中，
+// 并重新写入一条序列号不变的记录指向新的位置，之后删除原来的 blob 文件。
+// 有快照或者只读实例打开时，还可能读取原来的 blob 文件，不会删除，下次回收时再删除。
+// 被回收的 value 不能再通过 WatchFrom 重放
+func (db *DB) BlobGC() error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if !db.blobGCMu.TryLock() {
+		return ErrBlobGCIsProgress
+	}
+	defer db.blobGCMu.Unlock()
+
+	files, err := db.blobGCFiles()
+	if err != nil {
+		return err
+	}
+	for _, blobFile := range files {
+		if err := db.relocateBlobFile(blobFile); err != nil {
+			return err
+		}
+	}
+	return db.removeBlobFiles(files)
+}
+
+// blobGCFiles 找出需要回收的 blob 文件，活跃的 blob 文件还在写入，不参与回收
+func (db *DB) blobGCFiles() ([]*data.DataFile, error) {
+	for slot := range db.mus {
+		db.mus[slot].RLock()
+	}
+	defer func() {
+		for i := len(db.mus) - 1; i >= 0; i-- {
+			db.mus[i].RUnlock()
+		}
+	}()
+
+	stats, err := db.blobStats()
+	if err != nil {
+		return nil, err
+	}
+	active := make(map[uint32]bool)
+	for _, file := range db.activeBlobFiles {
+		if file != nil {
+			active[file.FileId] = true
+		}
+	}
+	var files []*data.DataFile
+	db.filesMu.RLock()
+	defer db.filesMu.RUnlock()
+	for _, stat := range stats {
+		if !active[stat.FileId] && stat.DeadRatio() >= float64(db.options.BlobGCDeadRatio) {
+			files = append(files, db.blobFiles[stat.FileId])
+		}
+	}
+	return files, nil
+}
+
+// relocateBlobFile 将 blob 文件中仍然有效的 value 移动到活跃的 blob 文件中，每条 value 只锁住对应的 slot
+func (db *DB) relocateBlobFile(blobFile *data.DataFile) error {
+	var offset int64 = 0
+	for {
+		blobRecord, size, err := blobFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		slot := db.hash(blobRecord.Key)
+		db.mus[slot].Lock()
+		err = db.relocateBlob(slot, blobFile.FileId, offset, blobRecord)
+		db.mus[slot].Unlock()
+		if err != nil {
+			return err
+		}
+		offset += size
+	}
+}
+
+// relocateBlob 内存索引还指向 blob 文件 fid 中 offset 位置的 value 时，将 value 移动到活跃的 blob 文件中
+// 调用前需要持有 slot 的写锁
+func (db *DB) relocateBlob(slot uint32, fid uint32, offset int64, blobRecord *data.LogRecord) error {
+	key := blobRecord.Key
+	pos := db.index.Get(key)
+	if pos == nil || pos.BlobSize == 0 || pos.BlobFid != fid || pos.IsExpired(time.Now().UnixNano()) {
+		return nil
+	}
+	dataFile := db.dataFileOf(slot, pos.Fid)
+	if dataFile == nil {
+		return ErrDataFileNotFound
+	}
+	logRecord, _, err := dataFile.ReadLogRecord(pos.Offset)
+	if err != nil {
+		return err
+	}
+	if !logRecord.Blob || data.DecodeLogRecordPos(logRecord.Value).Offset != offset {
+		return nil
+	}
+
+	// 序列号不变，这不是一次新的写入，不需要保留旧版本，也不需要通知订阅者
+	relocated := &data.LogRecord{
+		Key:        logRecord.Key,
+		Value:      blobRecord.Value,
+		Type:       data.LogRecordRelocated,
+		Expire:     logRecord.Expire,
+		Compressed: blobRecord.Compressed,
+	}
+	if err := db.writeBlob(slot, key, relocated); err != nil {
+		return err
+	}
+	newPos, err := db.appendLogRecord(slot, relocated)
+	if err != nil {
+		return err
+	}
+	oldPos := db.index.Put(key, newPos)
+	if oldPos != nil {
+		db.reclaimSize.Add(int64(oldPos.Size))
+	}
+	db.trackLive(newPos, oldPos)
+	return nil
+}
+
+// removeBlobFiles 持久化移动之后的数据，删除已经回收的 blob 文件，有快照打开、备份正在进行或者有只读实例打开时不删除
+func (db *DB) removeBlobFiles(files []*data.DataFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+	for slot := range db.mus {
+		db.mus[slot].Lock()
+	}
+	defer func() {
+		for i := len(db.mus) - 1; i >= 0; i-- {
+			db.mus[i].Unlock()
+		}
+	}()
+
+	db.snapMu.Lock()
+	hasSnapshot := len(db.snapshots) > 0
+	db.snapMu.Unlock()
+	if hasSnapshot || db.backups.Load() > 0 {
+		return nil
+	}
+	// 只读实例还可能读取回收的 blob 文件
+	unlockReaders, ok, err := lockReaders(db.options.DirPath)
+	if err != nil || !ok {
+		return err
+	}
+	defer unlockReaders()
+
+	for slot := range db.activeFiles {
+		for _, file := range []*data.DataFile{db.activeFiles[slot], db.activeBlobFiles[slot]} {
+			if file == nil {
+				continue
+			}
+			if err := file.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+
+	db.filesMu.Lock()
+	defer db.filesMu.Unlock()
+	for _, blobFile := range files {
+		delete(db.blobFiles, blobFile.FileId)
+		_ = blobFile.Close()
+		if err := os.Remove(data.GetBlobFileName(db.options.DirPath, blobFile.FileId)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		db.statMu.Lock()
+		delete(db.blobLive, blobFile.FileId)
+		db.statMu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Blob(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-blob")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.ValueThreshold = 128
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 500; i++ {
+		value := bytes.Repeat(utils.GetTestKey(i), 100)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+		expected[string(utils.GetTestKey(i))] = value
+	}
+	assert.Nil(t, db.Put([]byte("small"), []byte("small-value")))
+	expected["small"] = []byte("small-value")
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("batch"), bytes.Repeat([]byte("b"), 1024)))
+	assert.Nil(t, wb.Commit())
+	expected["batch"] = bytes.Repeat([]byte("b"), 1024)
+
+	// 只有大的 value 写入了 blob 文件
+	assert.True(t, db.index.Get(utils.GetTestKey(0)).BlobSize > 0)
+	assert.True(t, db.index.Get([]byte("batch")).BlobSize > 0)
+	assert.Equal(t, uint32(0), db.index.Get([]byte("small")).BlobSize)
+	blobs, _ := filepath.Glob(filepath.Join(dir, "*"+data.BlobFileNameSuffix))
+	assert.Greater(t, len(blobs), 4)
+
+	check := func(db *DB) {
+		for key, value := range expected {
+			val, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+		count := 0
+		err := db.Fold(func(key []byte, value []byte) bool {
+			assert.Equal(t, expected[string(key)], value)
+			count++
+			return true
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, len(expected), count)
+		iter := db.NewIterator(DefaultIteratorOptions)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			val, err := iter.Value()
+			assert.Nil(t, err)
+			assert.Equal(t, expected[string(iter.Key())], val)
+		}
+	}
+	check(db)
+
+	ch, err := db.WatchFrom(context.Background(), utils.GetTestKey(1), 0)
+	assert.Nil(t, err)
+	event := <-ch
+	assert.Equal(t, expected[string(utils.GetTestKey(1))], event.Entries[0].Value)
+
+	// 覆盖和删除大部分的数据之后，旧的 blob 文件中主要是无效数据
+	snap := db.NewSnapshot()
+	for i := 0; i < 400; i++ {
+		if i%2 == 0 {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			delete(expected, string(utils.GetTestKey(i)))
+			continue
+		}
+		value := bytes.Repeat([]byte{byte(i)}, 200)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+		expected[string(utils.GetTestKey(i))] = value
+	}
+	stats, err := db.BlobStats()
+	assert.Nil(t, err)
+	var liveSize int64
+	for _, key := range db.ListKeys() {
+		liveSize += int64(db.index.Get(key).BlobSize)
+	}
+	var totalLive int64
+	for _, stat := range stats {
+		assert.Equal(t, stat.Size, stat.LiveBytes+stat.DeadBytes)
+		totalLive += stat.LiveBytes
+	}
+	assert.Equal(t, liveSize, totalLive)
+
+	// 有快照打开时不删除 blob 文件，快照依然可以读取旧的 value
+	assert.Nil(t, db.BlobGC())
+	blobsAfter, _ := filepath.Glob(filepath.Join(dir, "*"+data.BlobFileNameSuffix))
+	assert.Greater(t, len(blobsAfter), len(blobs))
+	val, err := snap.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat(utils.GetTestKey(2), 100), val)
+	snap.Release()
+	check(db)
+
+	// 有只读实例打开时同样不删除 blob 文件
+	roOpts := opts
+	roOpts.ReadOnly = true
+	ro, err := Open(roOpts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.BlobGC())
+	blobsWithReader, _ := filepath.Glob(filepath.Join(dir, "*"+data.BlobFileNameSuffix))
+	assert.Equal(t, len(blobsAfter), len(blobsWithReader))
+	assert.Nil(t, ro.Close())
+
+	// 快照和只读实例关闭之后，回收过的 blob 文件在下一次回收时删除
+	assert.Nil(t, db.BlobGC())
+	blobsAfter, _ = filepath.Glob(filepath.Join(dir, "*"+data.BlobFileNameSuffix))
+	assert.Less(t, len(blobsAfter), len(blobs))
+	check(db)
+
+	// 重启之后使用移动之后的位置
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+
+	// merge 之后 blob 指针原样保留
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+}
+
+func TestDB_BlobOptions(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = t.TempDir()
+
+	opts.ValueThreshold = -1
+	_, err := Open(opts)
+	assert.NotNil(t, err)
+
+	opts.ValueThreshold = 0
+	opts.BlobGCDeadRatio = 1.5
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+
+	// 没有开启时不会生成 blob 文件
+	opts.BlobGCDeadRatio = 0.5
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("key"), bytes.Repeat([]byte("v"), 4096)))
+	assert.Nil(t, db.BlobGC())
+	blobs, _ := filepath.Glob(filepath.Join(opts.DirPath, "*"+data.BlobFileNameSuffix))
+	assert.Equal(t, 0, len(blobs))
+	assert.Nil(t, db.Close())
+}
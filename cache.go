@@ -0,0 +1,112 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// valueCacheShards value 缓存的分片数量，每个分片单独加锁
+	valueCacheShards = 16
+
+	// valueCacheEntryOverhead 每个缓存项除了 value 之外额外占用的内存估计，字节为单位
+	valueCacheEntryOverhead = 64
+)
+
+// valueCacheKey 记录在数据文件中的位置，key 被覆盖或者删除之后索引指向新的位置，旧的缓存项不会再被命中
+type valueCacheKey struct {
+	fid    uint32
+	offset int64
+}
+
+type valueCacheEntry struct {
+	key   valueCacheKey
+	value []byte
+}
+
+// valueCache 按照记录的位置缓存读取到的 value，分片的 LRU，总大小不超过 Options.ValueCacheSize
+type valueCache struct {
+	shards [valueCacheShards]*valueCacheShard
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type valueCacheShard struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	items    map[valueCacheKey]*list.Element
+	lru      *list.List // 最近访问的在前面
+}
+
+func newValueCache(capacity int64) *valueCache {
+	c := &valueCache{}
+	for i := range c.shards {
+		c.shards[i] = &valueCacheShard{
+			capacity: capacity / valueCacheShards,
+			items:    make(map[valueCacheKey]*list.Element),
+			lru:      list.New(),
+		}
+	}
+	return c
+}
+
+func (c *valueCache) shard(key valueCacheKey) *valueCacheShard {
+	h := key.fid*31 + (uint32(key.offset) ^ uint32(key.offset>>32))
+	return c.shards[h%valueCacheShards]
+}
+
+// get 返回缓存的 value 的拷贝，调用方可以修改返回的数据
+func (c *valueCache) get(pos *data.LogRecordPos) ([]byte, bool) {
+	key := valueCacheKey{fid: pos.Fid, offset: pos.Offset}
+	s := c.shard(key)
+	s.mu.Lock()
+	elem, ok := s.items[key]
+	if !ok {
+		s.mu.Unlock()
+		c.misses.Add(1)
+		return nil, false
+	}
+	s.lru.MoveToFront(elem)
+	value := append([]byte(nil), elem.Value.(*valueCacheEntry).value...)
+	s.mu.Unlock()
+	c.hits.Add(1)
+	return value, true
+}
+
+// put 缓存 value 的拷贝，超过分片的容量时淘汰最久没有访问的缓存项
+func (c *valueCache) put(pos *data.LogRecordPos, value []byte) {
+	key := valueCacheKey{fid: pos.Fid, offset: pos.Offset}
+	s := c.shard(key)
+	cost := int64(len(value)) + valueCacheEntryOverhead
+	if cost > s.capacity {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[key]; ok {
+		return
+	}
+	entry := &valueCacheEntry{key: key, value: append([]byte(nil), value...)}
+	s.items[key] = s.lru.PushFront(entry)
+	s.size += cost
+	for s.size > s.capacity {
+		oldest := s.lru.Back()
+		evicted := s.lru.Remove(oldest).(*valueCacheEntry)
+		delete(s.items, evicted.key)
+		s.size -= int64(len(evicted.value)) + valueCacheEntryOverhead
+	}
+}
+
+// purge 清空缓存，数据文件被替换之后同样的位置可能是不同的记录
+func (c *valueCache) purge() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.items = make(map[valueCacheKey]*list.Element)
+		s.lru.Init()
+		s.size = 0
+		s.mu.Unlock()
+	}
+}
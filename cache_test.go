@@ -0,0 +1,80 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_ValueCache(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-value-cache")
+	opts.DirPath = dir
+	opts.ValueCacheSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("hot"), []byte("value-1")))
+	for i := 0; i < 10; i++ {
+		val, err := db.Get([]byte("hot"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value-1"), val)
+	}
+	stat := db.Stat()
+	assert.Equal(t, uint64(1), stat.CacheMisses)
+	assert.Equal(t, uint64(9), stat.CacheHits)
+
+	// 修改返回的数据不影响缓存
+	val, _ := db.Get([]byte("hot"))
+	val[0] = 'x'
+	val, _ = db.Get([]byte("hot"))
+	assert.Equal(t, []byte("value-1"), val)
+
+	// 覆盖之后索引指向新的位置，不会读到旧的缓存
+	assert.Nil(t, db.Put([]byte("hot"), []byte("value-2")))
+	val, err = db.Get([]byte("hot"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-2"), val)
+	assert.Nil(t, db.Delete([]byte("hot")))
+	_, err = db.Get([]byte("hot"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 缓存的大小不超过上限
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), bytes.Repeat([]byte("v"), 512)))
+	}
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte("v"), 512), val)
+	}
+	var size int64
+	for _, shard := range db.cache.shards {
+		assert.LessOrEqual(t, shard.size, shard.capacity)
+		size += shard.size
+	}
+	assert.LessOrEqual(t, size, opts.ValueCacheSize)
+	assert.Greater(t, size, int64(0))
+}
+
+func TestDB_ValueCacheOptions(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = t.TempDir()
+	opts.ValueCacheSize = -1
+	_, err := Open(opts)
+	assert.NotNil(t, err)
+
+	// 没有开启时不统计
+	opts.ValueCacheSize = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+	_, err = db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), db.Stat().CacheHits+db.Stat().CacheMisses)
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,89 @@
+package bitcask_go
+
+import (
+	"bytes"
+	"time"
+)
+
+// PutIfAbsent key 不存在(或已经过期)时才写入，返回是否写入成功
+func (db *DB) PutIfAbsent(key []byte, value []byte) (bool, error) {
+	return db.compareAndWrite(key, func(exists bool, _ []byte) bool {
+		return !exists
+	}, func(slot uint32, _ int64) (func(), error) {
+		return db.putLocked(slot, key, value, 0)
+	})
+}
+
+// PutIfExists key 存在时才写入，返回是否写入成功，key 原来的过期时间保持不变
+func (db *DB) PutIfExists(key []byte, value []byte) (bool, error) {
+	return db.compareAndWrite(key, func(exists bool, _ []byte) bool {
+		return exists
+	}, func(slot uint32, expire int64) (func(), error) {
+		return db.putLocked(slot, key, value, expire)
+	})
+}
+
+// CompareAndSwap key 当前的值等于 expected 时才写入 value，返回是否写入成功，key 原来的过期时间保持不变
+// expected 为 nil 表示期望 key 不存在，期望 key 存在且值为空时需要传入长度为 0 的非 nil 切片，例如 []byte{}
+func (db *DB) CompareAndSwap(key []byte, expected []byte, value []byte) (bool, error) {
+	return db.compareAndWrite(key, func(exists bool, current []byte) bool {
+		if expected == nil {
+			return !exists
+		}
+		return exists && bytes.Equal(current, expected)
+	}, func(slot uint32, expire int64) (func(), error) {
+		return db.putLocked(slot, key, value, expire)
+	})
+}
+
+// CompareAndDelete key 当前的值等于 expected 时才删除，返回是否删除成功
+func (db *DB) CompareAndDelete(key []byte, expected []byte) (bool, error) {
+	return db.compareAndWrite(key, func(exists bool, current []byte) bool {
+		return exists && bytes.Equal(current, expected)
+	}, func(slot uint32, _ int64) (func(), error) {
+		return db.deleteLocked(slot, key)
+	})
+}
+
+// compareAndWrite 持有 key 所在 slot 的写锁，检查 key 当前的状态，满足条件才执行写入
+// write 的参数 expire 为 key 当前的过期时间，key 不存在时为 0
+func (db *DB) compareAndWrite(key []byte, cond func(exists bool, current []byte) bool,
+	write func(slot uint32, expire int64) (func(), error)) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrKeyIsEmpty
+	}
+	if db.options.ReadOnly {
+		return false, ErrReadOnly
+	}
+
+	slot := db.hash(key)
+	var written bool
+	err := db.writeSlot(slot, true, func() (func(), error) {
+		// 取出当前的值，过期的 key 视为不存在
+		var exists bool
+		var current []byte
+		var expire int64
+		logRecordPos := db.index.Get(key)
+		if logRecordPos != nil && !logRecordPos.IsExpired(time.Now().UnixNano()) {
+			value, err := db.getValueByPosition(slot, logRecordPos)
+			if err != nil {
+				return nil, err
+			}
+			exists, current, expire = true, value, logRecordPos.Expire
+		}
+
+		if !cond(exists, current) {
+			return nil, nil
+		}
+		apply, err := write(slot, expire)
+		if err != nil {
+			return nil, err
+		}
+		written = true
+		return apply, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return written, nil
+}
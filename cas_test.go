@@ -0,0 +1,162 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_PutIfAbsent(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-put-if-absent")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	ok, err := db.PutIfAbsent(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = db.PutIfAbsent(utils.GetTestKey(1), []byte("v2"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+
+	// 过期的 key 视为不存在
+	err = db.PutWithTTL(utils.GetTestKey(2), []byte("v1"), time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(5 * time.Millisecond)
+	ok, err = db.PutIfAbsent(utils.GetTestKey(2), []byte("v2"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	_, err = db.PutIfAbsent(nil, []byte("v"))
+	assert.Equal(t, ErrKeyIsEmpty, err)
+
+	// 并发写入只有一个成功
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var success int
+	values := make([][]byte, 10)
+	for i := range values {
+		values[i] = utils.RandomValue(10)
+	}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(value []byte) {
+			defer wg.Done()
+			ok, err := db.PutIfAbsent(utils.GetTestKey(3), value)
+			assert.Nil(t, err)
+			if ok {
+				mu.Lock()
+				success++
+				mu.Unlock()
+			}
+		}(values[i])
+	}
+	wg.Wait()
+	assert.Equal(t, 1, success)
+}
+
+func TestDB_PutIfExists(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-put-if-exists")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	ok, err := db.PutIfExists(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	ok, err = db.PutIfExists(utils.GetTestKey(1), []byte("v2"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+
+	// 保留原来的过期时间
+	err = db.PutWithTTL(utils.GetTestKey(2), []byte("v1"), time.Hour)
+	assert.Nil(t, err)
+	ok, err = db.PutIfExists(utils.GetTestKey(2), []byte("v2"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ttl, err := db.TTL(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Greater(t, ttl, 59*time.Minute)
+}
+
+func TestDB_CompareAndSwap(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-cas")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// expected 为 nil 表示期望 key 不存在
+	ok, err := db.CompareAndSwap(utils.GetTestKey(1), nil, []byte("v1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = db.CompareAndSwap(utils.GetTestKey(1), []byte("v0"), []byte("v2"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.CompareAndSwap(utils.GetTestKey(1), []byte("v1"), []byte("v2"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+
+	ok, err = db.CompareAndDelete(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.CompareAndDelete(utils.GetTestKey(1), []byte("v2"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	ok, err = db.CompareAndDelete(utils.GetTestKey(1), []byte("v2"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// 保留原来的过期时间
+	err = db.PutWithTTL(utils.GetTestKey(2), []byte("v1"), time.Hour)
+	assert.Nil(t, err)
+	ok, err = db.CompareAndSwap(utils.GetTestKey(2), []byte("v1"), []byte("v2"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ttl, err := db.TTL(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Greater(t, ttl, 59*time.Minute)
+
+	// 值为空的 key 使用非 nil 的空切片比较
+	err = db.Put(utils.GetTestKey(3), []byte{})
+	assert.Nil(t, err)
+	ok, err = db.CompareAndSwap(utils.GetTestKey(3), nil, []byte("v1"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.CompareAndSwap(utils.GetTestKey(3), []byte{}, []byte("v1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	val, err = db.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	bitcask "bitcask-go"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// bitcask-check 离线检查数据目录，以 JSON 格式输出检查结果
+// 没有发现问题时退出码为 0，发现问题时为 1，无法完成检查时为 2
+func main() {
+	dirPath := flag.String("dir", "", "data directory to check")
+	keyFile := flag.String("key-file", "", "file containing the encryption keys of an encrypted data directory")
+	keyEnv := flag.String("key-env", "", "environment variable containing the encryption keys of an encrypted data directory")
+	flag.Parse()
+	if *dirPath == "" && flag.NArg() > 0 {
+		*dirPath = flag.Arg(0)
+	}
+	if *dirPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: bitcask-check [-key-file <file> | -key-env <name>] -dir <data directory>")
+		os.Exit(2)
+	}
+
+	// 加密的数据目录需要提供密钥，格式见 bitcask.ParseEncryptionKeys
+	var keys bitcask.KeyProvider
+	var err error
+	switch {
+	case *keyFile != "" && *keyEnv != "":
+		fmt.Fprintln(os.Stderr, "only one of -key-file and -key-env can be specified")
+		os.Exit(2)
+	case *keyFile != "":
+		keys, err = bitcask.NewFileKeyProvider(*keyFile)
+	case *keyEnv != "":
+		keys, err = bitcask.NewEnvKeyProvider(*keyEnv)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load encryption keys: %v\n", err)
+		os.Exit(2)
+	}
+
+	report, err := bitcask.VerifyWithKeys(*dirPath, keys)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to verify %s: %v\n", *dirPath, err)
+		os.Exit(2)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode report: %v\n", err)
+		os.Exit(2)
+	}
+	if !report.OK {
+		os.Exit(1)
+	}
+}
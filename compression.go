@@ -0,0 +1,133 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+)
+
+// Compressor 压缩 value 的算法
+// 压缩之后的 value 以算法的 Id 开头，读取时根据 Id 选择解压的算法，同一个数据目录中可以混合使用不同的算法
+type Compressor interface {
+	// Id 算法的标识，会写入到每一条压缩的记录中，不能为 0，也不能和内置的算法冲突
+	Id() byte
+
+	// Compress 压缩数据
+	Compress(src []byte) ([]byte, error)
+
+	// Decompress 解压数据
+	Decompress(src []byte) ([]byte, error)
+}
+
+var (
+	// FlateCompression 使用 DEFLATE 算法压缩
+	FlateCompression Compressor = flateCompressor{}
+
+	// GzipCompression 使用 gzip 格式压缩
+	GzipCompression Compressor = gzipCompressor{}
+)
+
+// builtinCompressors 内置的压缩算法，不管配置项如何都可以读取
+var builtinCompressors = map[byte]Compressor{
+	FlateCompression.Id(): FlateCompression,
+	GzipCompression.Id():  GzipCompression,
+}
+
+type flateCompressor struct{}
+
+func (flateCompressor) Id() byte {
+	return 1
+}
+
+func (flateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCompressor) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer func() {
+		_ = r.Close()
+	}()
+	return io.ReadAll(r)
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Id() byte {
+	return 2
+}
+
+func (gzipCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	return io.ReadAll(r)
+}
+
+// compressRecord 按照配置压缩记录的 value，小于阈值或者压缩之后没有变小的 value 原样保存
+func (db *DB) compressRecord(logRecord *data.LogRecord) error {
+	compressor := db.options.Compression
+	if compressor == nil || logRecord.Compressed || len(logRecord.Value) < db.options.CompressionThreshold {
+		return nil
+	}
+	compressed, err := compressor.Compress(logRecord.Value)
+	if err != nil {
+		return err
+	}
+	if len(compressed)+1 >= len(logRecord.Value) {
+		return nil
+	}
+	value := make([]byte, 0, len(compressed)+1)
+	value = append(value, compressor.Id())
+	logRecord.Value = append(value, compressed...)
+	logRecord.Compressed = true
+	return nil
+}
+
+// decompressValue 取出记录中原始的 value，没有压缩的记录直接返回
+func (db *DB) decompressValue(logRecord *data.LogRecord) ([]byte, error) {
+	if !logRecord.Compressed {
+		return logRecord.Value, nil
+	}
+	if len(logRecord.Value) == 0 {
+		return nil, ErrUnknownCompression
+	}
+	id := logRecord.Value[0]
+	compressor, ok := builtinCompressors[id]
+	if !ok {
+		if db.options.Compression == nil || db.options.Compression.Id() != id {
+			return nil, ErrUnknownCompression
+		}
+		compressor = db.options.Compression
+	}
+	return compressor.Decompress(logRecord.Value[1:])
+}
@@ -0,0 +1,149 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Compression(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-compression")
+	opts.DirPath = dir
+	opts.CompressionThreshold = 64
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	bigValue := bytes.Repeat([]byte(`{"name":"bitcask-go","tags":["kv","log"]}`), 100)
+	// 没有开启压缩时写入的数据
+	assert.Nil(t, db.Put([]byte("plain"), bigValue))
+	assert.Nil(t, db.Close())
+
+	// 开启压缩之后，旧的数据依然可以读取
+	opts.Compression = FlateCompression
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	val, err := db.Get([]byte("plain"))
+	assert.Nil(t, err)
+	assert.Equal(t, bigValue, val)
+
+	statBefore := db.Stat()
+	assert.Nil(t, db.Put([]byte("flate"), bigValue))
+	assert.Nil(t, db.Put([]byte("small"), []byte("small-value")))
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("batch"), bigValue))
+	assert.Nil(t, wb.Commit())
+	// 压缩之后写入的数据量远小于原始的 value
+	assert.Less(t, db.Stat().DiskSize-statBefore.DiskSize, int64(len(bigValue)))
+
+	swapped, err := db.CompareAndSwap([]byte("flate"), bigValue, bigValue[:len(bigValue)/2])
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+	assert.Nil(t, db.Close())
+
+	// 换成另一种算法，之前压缩的数据依然可以读取
+	opts.Compression = GzipCompression
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("gzip"), bigValue))
+
+	ch, err := db.WatchFrom(context.Background(), []byte("gzip"), 0)
+	assert.Nil(t, err)
+	event := <-ch
+	assert.Equal(t, bigValue, event.Entries[0].Value)
+
+	check := func(db *DB) {
+		expected := map[string][]byte{
+			"plain": bigValue,
+			"flate": bigValue[:len(bigValue)/2],
+			"small": []byte("small-value"),
+			"batch": bigValue,
+			"gzip":  bigValue,
+		}
+		for key, value := range expected {
+			val, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+		err := db.Fold(func(key []byte, value []byte) bool {
+			assert.Equal(t, expected[string(key)], value)
+			return true
+		})
+		assert.Nil(t, err)
+	}
+	check(db)
+
+	// merge 之后压缩的数据原样保留
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), bigValue))
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	opts.Compression = nil
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+}
+
+func TestDB_CompressionOptions(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-compression-options")
+	opts.DirPath = dir
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	opts.CompressionThreshold = -1
+	_, err := Open(opts)
+	assert.NotNil(t, err)
+
+	opts.CompressionThreshold = 0
+	opts.Compression = &testCompressor{id: GzipCompression.Id()}
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+
+	opts.Compression = &testCompressor{id: 0}
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+
+	// 自定义的算法
+	opts.Compression = &testCompressor{id: 100}
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("key"), []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")))
+	val, err := db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), val)
+	assert.Nil(t, db.Close())
+
+	// 找不到写入时使用的算法
+	opts.Compression = nil
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("key"))
+	assert.Equal(t, ErrUnknownCompression, err)
+	assert.Nil(t, db.Close())
+}
+
+// testCompressor 只保存第一个字节和长度，用于测试自定义的算法
+type testCompressor struct {
+	id byte
+}
+
+func (c *testCompressor) Id() byte {
+	return c.id
+}
+
+func (c *testCompressor) Compress(src []byte) ([]byte, error) {
+	return []byte{src[0], byte(len(src))}, nil
+}
+
+func (c *testCompressor) Decompress(src []byte) ([]byte, error) {
+	return bytes.Repeat(src[:1], int(src[1])), nil
+}
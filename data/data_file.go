@@ -2,31 +2,72 @@ package data
 
 import (
 	"bitcask-go/fio"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"path/filepath"
+	"sync"
 )
 
 var (
 	ErrInvalidCRC = errors.New("invalid crc value, log record maybe corrupted")
+	ErrNoCipher   = errors.New("the log record is encrypted but no cipher is provided")
 )
 
 const (
 	DataFileNameSuffix    = ".data"
+	DataHintFileSuffix    = ".hint"
+	BlobFileNameSuffix    = ".blob"
 	HintFileName          = "hint-index"
 	MergeFinishedFileName = "merge-finished"
 	SeqNoFileName         = "seq-no"
 	NextFileIdFileName    = "next-file-id"
 )
 
+// maxPooledRecordBuffer 超过该长度的缓冲区用完之后不放回缓冲池，避免大 value 长期占用内存
+const maxPooledRecordBuffer = 1 << 20
+
+var recordBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 4096)
+		return &buf
+	},
+}
+
+// GetRecordBuffer 从缓冲池中取出长度为 size 的缓冲区，用完之后调用 PutRecordBuffer 放回
+func GetRecordBuffer(size int) *[]byte {
+	buf := recordBufferPool.Get().(*[]byte)
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	*buf = (*buf)[:size]
+	return buf
+}
+
+// PutRecordBuffer 将缓冲区放回缓冲池，放回之后不能再使用其中的数据
+func PutRecordBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledRecordBuffer {
+		return
+	}
+	recordBufferPool.Put(buf)
+}
+
+// Cipher 加密记录中的 key 和 value，具体的算法和密钥由上层提供
+// additionalData 不加密，但是和密文一起认证，解密时传入的 additionalData 必须和加密时相同
+type Cipher interface {
+	Encrypt(plaintext, additionalData []byte) ([]byte, error)
+	Decrypt(ciphertext, additionalData []byte) ([]byte, error)
+}
+
 // DataFile 数据文件
 // 这一层是无锁的，需要在上层加锁
 type DataFile struct {
 	FileId    uint32        // 文件id
 	WriteOff  int64         // 文件写到了哪个位置
 	IoManager fio.IOManager //io 读写管理
+	Cipher    Cipher        // 不为空时写入的记录会加密，读取时解密
 }
 
 // OpenDataFile 打开新的数据文件
@@ -60,10 +101,32 @@ func OpenNextFileIdFile(dirPath string) (*DataFile, error) {
 	return newDataFile(fileName, 0, fio.StandardFIO)
 }
 
+// OpenDataHintFile 打开数据文件对应的 hint 文件
+func OpenDataHintFile(dirPath string, fileId uint32) (*DataFile, error) {
+	fileName := GetDataHintFileName(dirPath, fileId)
+	return newDataFile(fileName, fileId, fio.StandardFIO)
+}
+
 func GetDataFileName(dirPath string, fileId uint32) string {
 	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataFileNameSuffix)
 }
 
+// OpenBlobFile 打开保存大 value 的 blob 文件，blob 文件中的每条记录的 key 是真实的 key，value 是用户写入的 value
+func OpenBlobFile(dirPath string, fileId uint32) (*DataFile, error) {
+	fileName := GetBlobFileName(dirPath, fileId)
+	return newDataFile(fileName, fileId, fio.StandardFIO)
+}
+
+// GetBlobFileName 获取 blob 文件名称
+func GetBlobFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+BlobFileNameSuffix)
+}
+
+// GetDataHintFileName 获取数据文件对应的 hint 文件名称
+func GetDataHintFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataHintFileSuffix)
+}
+
 func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
 	ioManager, err := fio.NewIOManager(fileName, ioType)
 	if err != nil {
@@ -109,7 +172,11 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	var recordSize = headerSize + keySize + valueSize
 
 	logRecord := &LogRecord{
-		Type: header.recordType,
+		Type:       header.recordType,
+		Expire:     header.expire,
+		Compressed: header.compressed,
+		Encrypted:  header.encrypted,
+		Blob:       header.blob,
 	}
 
 	// 开始读取用户实际存储的 key/value 数据
@@ -124,15 +191,64 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 		logRecord.Value = keyBuf[keySize:]
 	}
 
-	// 校验数据的有效性
+	// 校验数据的有效性，校验失败时也返回记录的长度，上层可以据此判断是否是文件末尾写了一半的记录
 	crc := getLogRecordCRC(logRecord, headerBuf[crc32.Size:headerSize])
 	if crc != header.crc {
-		return nil, 0, ErrInvalidCRC
+		return nil, recordSize, ErrInvalidCRC
 	}
 
+	// 加密的记录校验通过之后再解密
+	if logRecord.Encrypted {
+		if logRecord, err = DecryptLogRecord(logRecord, df.Cipher, df.FileId, offset); err != nil {
+			return nil, recordSize, err
+		}
+	}
 	return logRecord, recordSize, nil
 }
 
+// ReadLogRecordAt 根据索引中保存的记录长度，一次读取整条记录到 buf 中，校验之后原地解码
+// 返回的记录的 Key 和 Value 引用 buf 中的数据(加密的记录解密之后除外)，buf 的长度不能小于 size
+// 读取到的数据和 size 对不上时说明数据损坏，返回 ErrInvalidCRC
+func (df *DataFile) ReadLogRecordAt(offset int64, size uint32, buf []byte) (*LogRecord, error) {
+	buf = buf[:size]
+	if _, err := df.IoManager.Read(buf, offset); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	logRecord, recordSize, err := DecodeLogRecord(buf)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrInvalidCRC
+		}
+		return nil, err
+	}
+	if recordSize != int64(size) {
+		return nil, ErrInvalidCRC
+	}
+
+	if logRecord.Encrypted {
+		return DecryptLogRecord(logRecord, df.Cipher, df.FileId, offset)
+	}
+	return logRecord, nil
+}
+
+// EncodeLogRecord 对 LogRecord 进行编码，设置了 Cipher 时先加密
+// 加密的记录和写入的位置绑定，编码之后需要直接追加到当前文件的 WriteOff 处，写入其他文件或者其他位置时无法解密
+func (df *DataFile) EncodeLogRecord(logRecord *LogRecord) ([]byte, int64, error) {
+	if df.Cipher != nil {
+		encrypted, err := EncryptLogRecord(logRecord, df.Cipher, df.FileId, df.WriteOff)
+		if err != nil {
+			return nil, 0, err
+		}
+		logRecord = encrypted
+	}
+	encRecord, size := EncodeLogRecord(logRecord)
+	return encRecord, size, nil
+}
+
 func (df *DataFile) Write(buf []byte) error {
 	n, err := df.IoManager.Write(buf)
 	if err != nil {
@@ -148,10 +264,49 @@ func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 		Key:   key,
 		Value: EncodeLogRecordPos(pos),
 	}
-	encRecord, _ := EncodeLogRecord(record)
+	encRecord, _, err := df.EncodeLogRecord(record)
+	if err != nil {
+		return err
+	}
 	return df.Write(encRecord)
 }
 
+// WriteDataHintRecord 写入数据文件中一条记录的索引信息到数据文件的 hint 文件中
+// 记录的 key 和类型原样保存，value 中先保存位置信息，之后是需要保留的原始 value
+func (df *DataFile) WriteDataHintRecord(record *LogRecord, pos *LogRecordPos) error {
+	encPos := EncodeLogRecordPos(pos)
+	value := make([]byte, binary.MaxVarintLen32, binary.MaxVarintLen32+len(encPos)+len(record.Value))
+	n := binary.PutUvarint(value, uint64(len(encPos)))
+	value = append(value[:n], encPos...)
+	value = append(value, record.Value...)
+	hintRecord := &LogRecord{
+		Key:   record.Key,
+		Value: value,
+		Type:  record.Type,
+	}
+	encRecord, _, err := df.EncodeLogRecord(hintRecord)
+	if err != nil {
+		return err
+	}
+	return df.Write(encRecord)
+}
+
+// DecodeDataHintRecord 解码数据文件的 hint 文件中的记录，得到原始记录(只包含需要保留的 value)和位置信息
+func DecodeDataHintRecord(hintRecord *LogRecord) (*LogRecord, *LogRecordPos) {
+	posSize, n := binary.Uvarint(hintRecord.Value)
+	if n <= 0 || uint64(len(hintRecord.Value)-n) < posSize {
+		return nil, nil
+	}
+	pos := DecodeLogRecordPos(hintRecord.Value[n : n+int(posSize)])
+	record := &LogRecord{
+		Key:    hintRecord.Key,
+		Value:  hintRecord.Value[n+int(posSize):],
+		Type:   hintRecord.Type,
+		Expire: pos.Expire,
+	}
+	return record, pos
+}
+
 func (df *DataFile) Sync() error {
 	return df.IoManager.Sync()
 }
@@ -2,6 +2,8 @@ package data
 
 import (
 	"bitcask-go/fio"
+	"bytes"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"testing"
@@ -108,3 +110,148 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	assert.Equal(t, rec3, readRec3)
 	assert.Equal(t, size3, readSize3)
 }
+
+func TestDataFile_WriteDataHintRecord(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-data-hint")
+	defer os.RemoveAll(dir)
+	hintFile, err := OpenDataHintFile(dir, 3)
+	assert.Nil(t, err)
+	defer hintFile.Close()
+
+	rec1 := &LogRecord{Key: []byte("name"), Type: LogRecordTxnFinished, Expire: 100}
+	pos1 := &LogRecordPos{Fid: 3, Offset: 0, Size: 20, Expire: 100}
+	err = hintFile.WriteDataHintRecord(rec1, pos1)
+	assert.Nil(t, err)
+
+	rec2 := &LogRecord{Key: []byte("a"), Value: []byte("z"), Type: LogRecordRangeDeleted}
+	pos2 := &LogRecordPos{Fid: 3, Offset: 20, Size: 10}
+	err = hintFile.WriteDataHintRecord(rec2, pos2)
+	assert.Nil(t, err)
+
+	hintRecord, size, err := hintFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	record, pos := DecodeDataHintRecord(hintRecord)
+	assert.Equal(t, []byte("name"), record.Key)
+	assert.Equal(t, 0, len(record.Value))
+	assert.Equal(t, LogRecordTxnFinished, record.Type)
+	assert.Equal(t, int64(100), record.Expire)
+	assert.Equal(t, pos1, pos)
+
+	hintRecord, _, err = hintFile.ReadLogRecord(size)
+	assert.Nil(t, err)
+	record, pos = DecodeDataHintRecord(hintRecord)
+	assert.Equal(t, []byte("a"), record.Key)
+	assert.Equal(t, []byte("z"), record.Value)
+	assert.Equal(t, LogRecordRangeDeleted, record.Type)
+	assert.Equal(t, pos2, pos)
+}
+
+// xorCipher 简单的异或加密，密文之后附上附加数据用于校验，只用于测试
+type xorCipher struct{}
+
+func (xorCipher) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	out := make([]byte, len(plaintext), len(plaintext)+len(additionalData))
+	for i, b := range plaintext {
+		out[i] = b ^ 0x5a
+	}
+	return append(out, additionalData...), nil
+}
+
+func (xorCipher) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	n := len(ciphertext) - len(additionalData)
+	if n < 0 || !bytes.Equal(ciphertext[n:], additionalData) {
+		return nil, errors.New("additional data mismatch")
+	}
+	out := make([]byte, n)
+	for i, b := range ciphertext[:n] {
+		out[i] = b ^ 0x5a
+	}
+	return out, nil
+}
+
+func TestDataFile_Encrypted(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-data-encrypted")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	dataFile.Cipher = xorCipher{}
+
+	rec := &LogRecord{Key: []byte("name"), Value: []byte("bitcask-go"), Type: LogRecordTxnFinished, Expire: 1700000000000000000}
+	enc, size, err := dataFile.EncodeLogRecord(rec)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(enc), "bitcask-go")
+	assert.Nil(t, dataFile.Write(enc))
+
+	readRec, readSize, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, size, readSize)
+	assert.Equal(t, rec, readRec)
+
+	// 没有 cipher 时无法读取加密的记录
+	dataFile.Cipher = nil
+	_, _, err = dataFile.ReadLogRecord(0)
+	assert.Equal(t, ErrNoCipher, err)
+
+	decoded, _, err := DecodeLogRecord(enc)
+	assert.Nil(t, err)
+	assert.True(t, decoded.Encrypted)
+	decrypted, err := DecryptLogRecord(decoded, xorCipher{}, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, rec, decrypted)
+
+	// 文件 id、位置和 header 都参与认证
+	_, err = DecryptLogRecord(decoded, xorCipher{}, 1, 0)
+	assert.NotNil(t, err)
+	_, err = DecryptLogRecord(decoded, xorCipher{}, 0, int64(len(enc)))
+	assert.NotNil(t, err)
+	decoded.Expire++
+	_, err = DecryptLogRecord(decoded, xorCipher{}, 0, 0)
+	assert.NotNil(t, err)
+}
+
+func TestDataFile_ReadLogRecordAt(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-data-read-at")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	rec1 := &LogRecord{Key: []byte("name"), Value: []byte("bitcask-go"), Type: LogRecordNormal, Expire: 100}
+	enc1, size1 := EncodeLogRecord(rec1)
+	assert.Nil(t, dataFile.Write(enc1))
+	rec2 := &LogRecord{Key: []byte("a"), Value: []byte("b"), Type: LogRecordNormal}
+	enc2, size2 := EncodeLogRecord(rec2)
+	assert.Nil(t, dataFile.Write(enc2))
+
+	buf := GetRecordBuffer(int(size2))
+	defer PutRecordBuffer(buf)
+	readRec, err := dataFile.ReadLogRecordAt(size1, uint32(size2), *buf)
+	assert.Nil(t, err)
+	assert.Equal(t, rec2.Key, readRec.Key)
+	assert.Equal(t, rec2.Value, readRec.Value)
+
+	buf2 := GetRecordBuffer(int(size1))
+	defer PutRecordBuffer(buf2)
+	readRec, err = dataFile.ReadLogRecordAt(0, uint32(size1), *buf2)
+	assert.Nil(t, err)
+	assert.Equal(t, rec1.Key, readRec.Key)
+	assert.Equal(t, rec1.Value, readRec.Value)
+	assert.Equal(t, rec1.Expire, readRec.Expire)
+
+	// 长度和记录对不上
+	_, err = dataFile.ReadLogRecordAt(0, uint32(size1-1), *buf2)
+	assert.Equal(t, ErrInvalidCRC, err)
+	_, err = dataFile.ReadLogRecordAt(0, uint32(size1+size2), *GetRecordBuffer(int(size1 + size2)))
+	assert.Equal(t, ErrInvalidCRC, err)
+	// 超出文件末尾
+	_, err = dataFile.ReadLogRecordAt(size1, uint32(size2+1), *GetRecordBuffer(int(size2 + 1)))
+	assert.NotNil(t, err)
+
+	// 数据损坏时校验失败
+	enc1[len(enc1)-1] ^= 0xff
+	assert.Nil(t, dataFile.Write(enc1))
+	_, err = dataFile.ReadLogRecordAt(size1+size2, uint32(size1), *buf2)
+	assert.Equal(t, ErrInvalidCRC, err)
+}
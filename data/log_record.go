@@ -3,32 +3,59 @@ package data
 import (
 	"encoding/binary"
 	"hash/crc32"
+	"io"
 )
 
 type LogRecordType = byte
 
 const (
-	LogRecordNormal      LogRecordType = iota //常规写入
-	LogRecordDeleted                          //删除
-	LogRecordTxnFinished                      //事务结束(如果是单语句,也用这个,因为单独语句也是事务)
+	LogRecordNormal       LogRecordType = iota //常规写入
+	LogRecordDeleted                           //删除
+	LogRecordTxnFinished                       //事务结束(如果是单语句,也用这个,因为单独语句也是事务)
+	LogRecordRangeDeleted                      //范围删除，key 为起始 key，value 为结束 key(不包含)
+	LogRecordHintFinished                      //数据文件的 hint 文件结束标记，只会出现在 hint 文件中，value 为对应数据文件的大小
+	LogRecordRelocated                         //blob 回收时 value 被移动到新的 blob 文件之后重新写入的记录，序列号和原来的记录相同
 )
 
-// crc type keySize valueSize
-// 4 + 1 + 5 + 5 = 15
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+// type 字节的高位用作标志位，低位才是真正的 LogRecordType
+const (
+	logRecordTypeMask       byte = 0x0f
+	logRecordFlagExpire     byte = 0x80 // header 中携带了过期时间
+	logRecordFlagCompressed byte = 0x40 // value 经过了压缩
+	logRecordFlagEncrypted  byte = 0x20 // key 和 value 经过了加密
+	logRecordFlagBlob       byte = 0x10 // value 保存在 blob 文件中，记录中的 value 是 blob 指针
+)
+
+// crc type expire keySize valueSize
+// 4 + 1 + 10 + 5 + 5 = 25
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + binary.MaxVarintLen64 + 5
 
 // LogRecord 写入到数据文件的记录
 // 之所以叫日志，是因为数据文件中的数据是追加写入的，类似日志的格式
 type LogRecord struct {
-	Key   []byte
-	Value []byte
-	Type  LogRecordType
+	Key    []byte
+	Value  []byte
+	Type   LogRecordType
+	Expire int64 // 过期时间(UnixNano)，0 表示永不过期
+
+	// value 是否经过了压缩，压缩的格式由上层决定，这一层只负责保存标志位
+	Compressed bool
+
+	// key 和 value 是否经过了加密，加密之后的数据保存在 Key 中，Value 为空
+	Encrypted bool
+
+	// value 是否保存在 blob 文件中，为 true 时 Value 是编码之后的 blob 指针，见 EncodeLogRecordPos
+	Blob bool
 }
 
 // LogRecord 的头部信息
 type logRecordHeader struct {
 	crc        uint32        //crc校验值
 	recordType LogRecordType //标识 LogRecord 的类型
+	expire     int64         // 过期时间
+	compressed bool          // value 是否经过了压缩
+	encrypted  bool          // key 和 value 是否经过了加密
+	blob       bool          // value 是否保存在 blob 文件中
 	keySize    uint32        // key的长度
 	valueSize  uint32        //value的长度
 }
@@ -38,6 +65,17 @@ type LogRecordPos struct {
 	Fid    uint32 //文件 id 表示将数据存储的哪个文件当中
 	Offset int64  //偏移，表示将数据存储到了数据文件中的哪个位置
 	Size   uint32 // 标识数据在磁盘上的大小
+	Expire int64  // 过期时间(UnixNano)，0 表示永不过期
+
+	// value 保存在 blob 文件中时，value 所在的 blob 文件 id 和在 blob 文件中的大小，用于统计 blob 文件中的有效数据，
+	// BlobSize 为 0 表示 value 没有保存在 blob 文件中
+	BlobFid  uint32
+	BlobSize uint32
+}
+
+// IsExpired 判断数据在 now 时刻是否已经过期
+func (pos *LogRecordPos) IsExpired(now int64) bool {
+	return pos.Expire > 0 && pos.Expire <= now
 }
 
 // TransactionRecord 暂存的事务相关的数据
@@ -47,18 +85,24 @@ type TransactionRecord struct {
 }
 
 // EncodeLogRecord 对 LogRecord 进行编码，返回字节数组及长度
-// +-----------+------------+-------------+--------------+-----------+---------------+
-// / crc 校验值 /  type 类型  /  key size   /  value size  /    key    /     value     /
-// +-----------+------------+-------------+--------------+-----------+---------------+
+// +-----------+------------+---------------+-------------+--------------+-----------+---------------+
+// / crc 校验值 /  type 类型  /  expire(可选)  /  key size   /  value size  /    key    /     value     /
+// +-----------+------------+---------------+-------------+--------------+-----------+---------------+
 //
-//	4字节 		 1字节	     变长（最大5）	 变长（最大5）       变长			变长
+//	4字节 		 1字节	     变长（最大10）     变长（最大5）	 变长（最大5）       变长			变长
+//
+// 只有设置了过期时间的记录才会写入 expire，并在 type 字节中置上标志位，旧的数据文件依然可以正常读取
+// value 经过压缩、key 和 value 经过加密、value 保存在 blob 文件中的记录同样在 type 字节中置上标志位
 func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	// 初始化一个 header 部分的字节数组
 	header := make([]byte, maxLogRecordHeaderSize)
 
 	// 第五个字节存储 Type
-	header[4] = logRecord.Type
+	header[4] = encodeLogRecordType(logRecord)
 	var index = 5
+	if logRecord.Expire > 0 {
+		index += binary.PutVarint(header[index:], logRecord.Expire)
+	}
 	// 5 字节之后。存储的是 key 和 value 的长度信息
 	// 使用变长类型，节省空间
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
@@ -80,13 +124,39 @@ func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	return encBytes, int64(size)
 }
 
+// encodeLogRecordType 记录的类型和标志位，保存在 header 的第五个字节
+func encodeLogRecordType(logRecord *LogRecord) byte {
+	typ := logRecord.Type
+	if logRecord.Compressed {
+		typ |= logRecordFlagCompressed
+	}
+	if logRecord.Encrypted {
+		typ |= logRecordFlagEncrypted
+	}
+	if logRecord.Blob {
+		typ |= logRecordFlagBlob
+	}
+	if logRecord.Expire > 0 {
+		typ |= logRecordFlagExpire
+	}
+	return typ
+}
+
 // EncodeLogRecordPos 对位置信息进行编码
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
-	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)
+	buf := make([]byte, binary.MaxVarintLen32*4+binary.MaxVarintLen64*2)
 	var index = 0
 	index += binary.PutVarint(buf[index:], int64(pos.Fid))
 	index += binary.PutVarint(buf[index:], pos.Offset)
 	index += binary.PutVarint(buf[index:], int64(pos.Size))
+	// 过期时间和 blob 信息都是可选的，有 blob 信息时过期时间为 0 也要写入
+	if pos.Expire > 0 || pos.BlobSize > 0 {
+		index += binary.PutVarint(buf[index:], pos.Expire)
+	}
+	if pos.BlobSize > 0 {
+		index += binary.PutVarint(buf[index:], int64(pos.BlobFid))
+		index += binary.PutVarint(buf[index:], int64(pos.BlobSize))
+	}
 	return buf[:index]
 }
 
@@ -97,12 +167,146 @@ func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	index += n
 	offset, n := binary.Varint(buf[index:])
 	index += n
-	size, _ := binary.Varint(buf[index:])
-	return &LogRecordPos{
+	size, n := binary.Varint(buf[index:])
+	index += n
+	// 过期时间和 blob 信息是可选的，兼容旧格式的位置信息
+	pos := &LogRecordPos{
 		Fid:    uint32(fileId),
 		Offset: offset,
 		Size:   uint32(size),
 	}
+	if index < len(buf) {
+		pos.Expire, n = binary.Varint(buf[index:])
+		index += n
+	}
+	if index < len(buf) {
+		blobFid, n := binary.Varint(buf[index:])
+		index += n
+		blobSize, _ := binary.Varint(buf[index:])
+		pos.BlobFid, pos.BlobSize = uint32(blobFid), uint32(blobSize)
+	}
+	return pos
+}
+
+// DecodeLogRecord 从字节数组的开头解码一条完整的记录，返回记录及其长度，Key 和 Value 引用 buf 中的数据
+// 和 ReadLogRecord 不同，这里会检查 header 是否合法，可以用于在损坏的数据中寻找下一条有效的记录
+// 数据不足一条记录时返回 io.ErrUnexpectedEOF，header 不合法或者校验失败时返回 ErrInvalidCRC
+func DecodeLogRecord(buf []byte) (*LogRecord, int64, error) {
+	if len(buf) <= crc32.Size+1 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	typ := buf[4]
+	flags := logRecordFlagExpire | logRecordFlagCompressed | logRecordFlagEncrypted | logRecordFlagBlob
+	if typ&^(logRecordTypeMask|flags) != 0 || typ&logRecordTypeMask > LogRecordRelocated {
+		return nil, 0, ErrInvalidCRC
+	}
+
+	var index = 5
+	var expire int64
+	if typ&logRecordFlagExpire != 0 {
+		v, n := binary.Varint(buf[index:])
+		if n == 0 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		if n < 0 || v <= 0 {
+			return nil, 0, ErrInvalidCRC
+		}
+		index += n
+		expire = v
+	}
+	var sizes [2]int64
+	for i := range sizes {
+		v, n := binary.Varint(buf[index:])
+		if n == 0 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		if n < 0 || v < 0 || v > int64(len(buf)) {
+			return nil, 0, ErrInvalidCRC
+		}
+		index += n
+		sizes[i] = v
+	}
+	keySize, valueSize := sizes[0], sizes[1]
+	size := int64(index) + keySize + valueSize
+	if size > int64(len(buf)) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(buf[4:size]) != binary.LittleEndian.Uint32(buf[:4]) {
+		return nil, 0, ErrInvalidCRC
+	}
+
+	keyEnd := int64(index) + keySize
+	return &LogRecord{
+		Key:        buf[index:keyEnd],
+		Value:      buf[keyEnd:size],
+		Type:       typ & logRecordTypeMask,
+		Expire:     expire,
+		Compressed: typ&logRecordFlagCompressed != 0,
+		Encrypted:  typ&logRecordFlagEncrypted != 0,
+		Blob:       typ&logRecordFlagBlob != 0,
+	}, size, nil
+}
+
+// EncryptLogRecord 加密记录的 key 和 value，返回加密之后的记录，类型、过期时间等 header 中的信息不加密
+// 记录写入的文件 id 和位置以及 header 中的信息作为附加数据一起认证，见 logRecordAdditionalData
+func EncryptLogRecord(logRecord *LogRecord, cipher Cipher, fileId uint32, offset int64) (*LogRecord, error) {
+	encrypted := &LogRecord{
+		Type:       logRecord.Type,
+		Expire:     logRecord.Expire,
+		Compressed: logRecord.Compressed,
+		Encrypted:  true,
+		Blob:       logRecord.Blob,
+	}
+	plaintext := make([]byte, 0, binary.MaxVarintLen32+len(logRecord.Key)+len(logRecord.Value))
+	plaintext = binary.AppendUvarint(plaintext, uint64(len(logRecord.Key)))
+	plaintext = append(plaintext, logRecord.Key...)
+	plaintext = append(plaintext, logRecord.Value...)
+	ciphertext, err := cipher.Encrypt(plaintext, logRecordAdditionalData(encrypted, fileId, offset))
+	if err != nil {
+		return nil, err
+	}
+	encrypted.Key = ciphertext
+	return encrypted, nil
+}
+
+// DecryptLogRecord 解密文件 fileId 中位于 offset 的记录的 key 和 value，没有加密的记录直接返回
+func DecryptLogRecord(logRecord *LogRecord, cipher Cipher, fileId uint32, offset int64) (*LogRecord, error) {
+	if !logRecord.Encrypted {
+		return logRecord, nil
+	}
+	if cipher == nil {
+		return nil, ErrNoCipher
+	}
+	plaintext, err := cipher.Decrypt(logRecord.Key, logRecordAdditionalData(logRecord, fileId, offset))
+	if err != nil {
+		return nil, err
+	}
+	keySize, n := binary.Uvarint(plaintext)
+	if n <= 0 || uint64(len(plaintext)-n) < keySize {
+		return nil, ErrInvalidCRC
+	}
+	keyEnd := n + int(keySize)
+	return &LogRecord{
+		Key:        plaintext[n:keyEnd],
+		Value:      plaintext[keyEnd:],
+		Type:       logRecord.Type,
+		Expire:     logRecord.Expire,
+		Compressed: logRecord.Compressed,
+		Blob:       logRecord.Blob,
+	}, nil
+}
+
+// logRecordAdditionalData 加密记录时一起认证的附加数据：记录所在的文件 id 和位置，header 中的类型、标志位和过期时间
+// 这些信息被篡改，或者整条记录被挪到其他文件、其他位置时，即使重新计算了 crc 也无法解密
+func logRecordAdditionalData(logRecord *LogRecord, fileId uint32, offset int64) []byte {
+	buf := make([]byte, 13, 13+binary.MaxVarintLen64)
+	binary.BigEndian.PutUint32(buf[:4], fileId)
+	binary.BigEndian.PutUint64(buf[4:12], uint64(offset))
+	buf[12] = encodeLogRecordType(logRecord)
+	if logRecord.Expire > 0 {
+		buf = binary.AppendVarint(buf, logRecord.Expire)
+	}
+	return buf
 }
 
 // 对字节数组中的 Header 信息进行解码
@@ -113,10 +317,19 @@ func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
 
 	header := &logRecordHeader{
 		crc:        binary.LittleEndian.Uint32(buf[:4]),
-		recordType: buf[4],
+		recordType: buf[4] & logRecordTypeMask,
+		compressed: buf[4]&logRecordFlagCompressed != 0,
+		encrypted:  buf[4]&logRecordFlagEncrypted != 0,
+		blob:       buf[4]&logRecordFlagBlob != 0,
 	}
 
 	var index = 5
+	// 取出过期时间
+	if buf[4]&logRecordFlagExpire != 0 {
+		expire, n := binary.Varint(buf[index:])
+		index += n
+		header.expire = expire
+	}
 	// 取出实际的 key size
 	keySize, n := binary.Varint(buf[index:])
 	index += n
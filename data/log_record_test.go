@@ -3,6 +3,7 @@ package data
 import (
 	"github.com/stretchr/testify/assert"
 	"hash/crc32"
+	"io"
 	"testing"
 )
 
@@ -93,3 +94,95 @@ func TestGetLogRecordCRC(t *testing.T) {
 	crc3 := getLogRecordCRC(rec3, headerBuf3[crc32.Size:])
 	assert.Equal(t, uint32(290887979), crc3)
 }
+
+func TestEncodeLogRecord_Expire(t *testing.T) {
+	rec := &LogRecord{
+		Key:    []byte("name"),
+		Value:  []byte("bitcask-go"),
+		Type:   LogRecordNormal,
+		Expire: 1700000000000000000,
+	}
+	res, n := EncodeLogRecord(rec)
+	assert.NotNil(t, res)
+
+	h, size := decodeLogRecordHeader(res)
+	assert.NotNil(t, h)
+	assert.Equal(t, LogRecordNormal, h.recordType)
+	assert.Equal(t, rec.Expire, h.expire)
+	assert.Equal(t, n, size+int64(h.keySize)+int64(h.valueSize))
+
+	crc := getLogRecordCRC(rec, res[crc32.Size:size])
+	assert.Equal(t, h.crc, crc)
+}
+
+func TestEncodeLogRecord_Compressed(t *testing.T) {
+	rec := &LogRecord{
+		Key:        []byte("name"),
+		Value:      []byte("compressed-value"),
+		Type:       LogRecordTxnFinished,
+		Expire:     1700000000000000000,
+		Compressed: true,
+	}
+	res, n := EncodeLogRecord(rec)
+
+	h, size := decodeLogRecordHeader(res)
+	assert.NotNil(t, h)
+	assert.Equal(t, LogRecordTxnFinished, h.recordType)
+	assert.True(t, h.compressed)
+	assert.Equal(t, rec.Expire, h.expire)
+	assert.Equal(t, n, size+int64(h.keySize)+int64(h.valueSize))
+
+	decoded, decodedSize, err := DecodeLogRecord(res)
+	assert.Nil(t, err)
+	assert.Equal(t, n, decodedSize)
+	assert.Equal(t, rec, decoded)
+
+	// 没有压缩的记录不会置上标志位
+	rec.Compressed = false
+	res, _ = EncodeLogRecord(rec)
+	h, _ = decodeLogRecordHeader(res)
+	assert.False(t, h.compressed)
+}
+
+func TestEncodeLogRecordPos_Expire(t *testing.T) {
+	pos := &LogRecordPos{Fid: 1, Offset: 100, Size: 20, Expire: 1700000000000000000}
+	assert.Equal(t, pos, DecodeLogRecordPos(EncodeLogRecordPos(pos)))
+
+	// 没有过期时间的旧格式
+	pos2 := &LogRecordPos{Fid: 1, Offset: 100, Size: 20}
+	assert.Equal(t, pos2, DecodeLogRecordPos(EncodeLogRecordPos(pos2)))
+}
+
+func TestDecodeLogRecord(t *testing.T) {
+	rec1 := &LogRecord{Key: []byte("name"), Value: []byte("bitcask-go"), Type: LogRecordNormal}
+	rec2 := &LogRecord{Key: []byte("age"), Type: LogRecordTxnFinished, Expire: 1700000000000000000}
+	enc1, n1 := EncodeLogRecord(rec1)
+	enc2, n2 := EncodeLogRecord(rec2)
+	buf := append(append([]byte(nil), enc1...), enc2...)
+
+	res, size, err := DecodeLogRecord(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, n1, size)
+	assert.Equal(t, rec1, res)
+
+	res, size, err = DecodeLogRecord(buf[n1:])
+	assert.Nil(t, err)
+	assert.Equal(t, n2, size)
+	assert.Equal(t, rec2.Key, res.Key)
+	assert.Equal(t, rec2.Expire, res.Expire)
+	assert.Equal(t, rec2.Type, res.Type)
+
+	// 数据不足一条记录
+	_, _, err = DecodeLogRecord(enc1[:n1-1])
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// 从记录中间开始解码
+	_, _, err = DecodeLogRecord(buf[1:])
+	assert.Equal(t, ErrInvalidCRC, err)
+
+	// 数据被修改
+	corrupted := append([]byte(nil), enc1...)
+	corrupted[n1-1] ^= 0xff
+	_, _, err = DecodeLogRecord(corrupted)
+	assert.Equal(t, ErrInvalidCRC, err)
+}
@@ -9,7 +9,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"sort"
@@ -17,16 +17,21 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/gofrs/flock"
 )
 
 const (
-	seqNoKey      = "seq.no"
-	fileLockName  = "flock"
-	nextFileIdKey = "nextFile-id"
+	seqNoKey       = "seq.no"
+	fileLockName   = "flock"
+	readerLockName = "flock-readers"
+	nextFileIdKey  = "nextFile-id"
 )
 
+// NoExpiration TTL 返回该值表示 key 永不过期
+const NoExpiration time.Duration = -1
+
 // DB bitcask 存储引擎实例
 type DB struct {
 	options Options
@@ -37,14 +42,57 @@ type DB struct {
 	isMerging       bool          // 是否正在 merge
 	seqNoFileExists bool          // 存储事务序列号的文件是否存在
 	isInitial       bool          // 是否第一次初始化数据目录
-	fileLock        *flock.Flock  // 文件锁保证多进程之间的互斥
-	bytesWrite      uint          // 累计写了多少个字节
-	reclaimSize     int64         // 标识有多少数据是无效的
+	fileLock        *flock.Flock  // 文件锁保证多进程之间的互斥，只读实例为 nil
+	readerLock      *os.File      // 只读实例持有的读者锁文件，关闭时释放共享锁，写入实例为 nil
+	bytesWrite      atomic.Uint64 // 累计写了多少个字节，不同 slot 会并发写入
+	reclaimSize     atomic.Int64  // 标识有多少数据是无效的，不同 slot 会并发更新
 
 	nextFileId  atomic.Int64              //下一个活跃数据文件Id编号
 	mus         []*sync.RWMutex           //锁，每个文件对应一个锁
 	activeFiles []*data.DataFile          // 活跃文件，activeFiles[i]为第i个数据文件
+	syncers     []*fileSyncer             // 每个 slot 的活跃文件合并 Sync 使用的 syncer
+	commits     *commitQueue              // 开启 SyncWrites 时等待 group commit 的写入
 	olderFiles  map[uint32]*data.DataFile // 旧的数据文件，key 为文件 id，value 为数据文件
+	filesMu     sync.RWMutex              // 不同 slot 会并发地切换活跃文件，保护 olderFiles
+
+	snapMu      sync.Mutex               // 保护 snapshots 和 versions
+	snapshots   map[*Snapshot]struct{}   // 当前打开的快照
+	versions    map[string][]*keyVersion // 快照打开期间被覆盖的旧版本数据
+	watchMu     sync.Mutex               // 保护 watchers
+	watchers    map[*watcher]struct{}    // 变更订阅者
+	sweepCursor []byte                   // 过期清理下一轮开始的 key
+	closeCh     chan struct{}            // 关闭数据库时通知后台任务退出
+	closeOnce   sync.Once                // 保证 closeCh 只被关闭一次
+	bgWg        sync.WaitGroup           // 等待后台任务退出
+
+	statMu    sync.Mutex       // 保护 liveBytes
+	liveBytes map[uint32]int64 // 每个数据文件中有效数据的字节数，key 为文件 id
+
+	autoMergeMu       sync.Mutex // 保护最近一次自动 merge 的结果
+	lastAutoMergeTime time.Time  // 最近一次自动 merge 结束的时间
+	lastAutoMergeErr  error      // 最近一次自动 merge 的结果
+
+	scannedOffsets map[uint32]int64       // 每个数据文件加载索引时读到的位置
+	replayer       *indexReplayer         // 只读实例加载索引的状态，Refresh 时继续使用
+	fileInfos      map[uint32]os.FileInfo // 只读实例打开的数据文件，用来判断文件是否被替换
+
+	cipher data.Cipher // 加密数据使用的 cipher，没有开启加密时为 nil
+
+	nextBlobFileId  atomic.Int64              // 下一个 blob 文件的 id
+	activeBlobFiles []*data.DataFile          // 每个 slot 正在写入的 blob 文件，没有写入过时为 nil
+	blobFiles       map[uint32]*data.DataFile // 全部的 blob 文件，包括活跃的 blob 文件，由 filesMu 保护
+	blobLive        map[uint32]int64          // 每个 blob 文件中有效数据的字节数，由 statMu 保护
+	blobGCMu        sync.Mutex                // 保证同时只有一个 blob 回收在进行
+
+	backups atomic.Int32 // 正在进行的备份数量，备份期间 merge 和 blob 回收不删除文件
+
+	asyncCh     chan *asyncWrite // 异步写入的队列，第一次异步写入时创建
+	asyncOnce   sync.Once        // 保证异步写入协程只启动一次
+	asyncWg     sync.WaitGroup   // 等待异步写入协程写完队列中的数据
+	asyncMu     sync.RWMutex     // 保护 asyncClosed，关闭之后不能再放入队列
+	asyncClosed bool             // 是否已经停止接受异步写入
+
+	cache *valueCache // 读取时使用的 value 缓存，没有开启时为 nil
 }
 
 // Stat 存储引擎统计信息
@@ -53,6 +101,12 @@ type Stat struct {
 	DataFileNum     uint  // 数据文件的数量
 	ReclaimableSize int64 // 可以进行 merge 回收的数据量 字节为单位
 	DiskSize        int64 // 所占用磁盘空间的大小
+
+	LastAutoMergeTime time.Time // 最近一次自动 merge 结束的时间，零值表示还没有进行过
+	LastAutoMergeErr  error     // 最近一次自动 merge 的结果，为 nil 表示成功
+
+	CacheHits   uint64 // value 缓存命中的次数
+	CacheMisses uint64 // value 缓存没有命中的次数
 }
 
 // Open 打开 bitcask 存储引擎实例
@@ -62,6 +116,10 @@ func Open(options Options) (*DB, error) {
 		return nil, err
 	}
 
+	if options.ReadOnly {
+		return openReadOnly(options)
+	}
+
 	var isInitial bool
 	// 判断数据目录是否存在，不存在需要创建
 	if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
@@ -84,7 +142,23 @@ func Open(options Options) (*DB, error) {
 		//不可以加锁，则返回错误
 		return nil, ErrDatabaseIsUsing
 	}
+	// 只读实例对读者锁文件加共享锁，写入实例删除文件之前通过它判断是否有只读实例
+	if err := createReaderLockFile(options.DirPath); err != nil {
+		_ = fileLock.Unlock()
+		return nil, err
+	}
+
+	db, err := open(options, fileLock, isInitial)
+	if err != nil {
+		// 打开失败时释放文件锁，修复数据之后可以重新打开
+		_ = fileLock.Unlock()
+		return nil, err
+	}
+	return db, nil
+}
 
+// open 加载数据目录中的数据，调用前需要持有数据目录的文件锁
+func open(options Options, fileLock *flock.Flock, isInitial bool) (_ *DB, err error) {
 	// 空的文件目录
 	entries, err := os.ReadDir(options.DirPath)
 	if err != nil {
@@ -95,24 +169,62 @@ func Open(options Options) (*DB, error) {
 		isInitial = true
 	}
 
+	cipher, err := newCipher(options)
+	if err != nil {
+		return nil, err
+	}
+
 	// 初始化 DB 实例结构体
 	db := &DB{
 		options:     options,
 		mus:         make([]*sync.RWMutex, options.Slots),
 		activeFiles: make([]*data.DataFile, options.Slots),
+		syncers:     make([]*fileSyncer, options.Slots),
+		commits:     newCommitQueue(),
 		olderFiles:  make(map[uint32]*data.DataFile),
 		index:       index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites),
 		isInitial:   isInitial,
 		fileLock:    fileLock,
 		nextFileId:  atomic.Int64{},
+		closeCh:     make(chan struct{}),
+		snapshots:   make(map[*Snapshot]struct{}),
+		versions:    make(map[string][]*keyVersion),
+		watchers:    make(map[*watcher]struct{}),
+		liveBytes:   make(map[uint32]int64),
+
+		scannedOffsets: make(map[uint32]int64),
+		fileInfos:      make(map[uint32]os.FileInfo),
+		cipher:         cipher,
+
+		activeBlobFiles: make([]*data.DataFile, options.Slots),
+		blobFiles:       make(map[uint32]*data.DataFile),
+		blobLive:        make(map[uint32]int64),
+	}
+	if options.ValueCacheSize > 0 {
+		db.cache = newValueCache(options.ValueCacheSize)
 	}
 	for i := range db.mus {
 		db.mus[i] = new(sync.RWMutex)
 	}
+	defer func() {
+		if err != nil {
+			// 停止加载期间启动的后台任务，关闭已经打开的文件
+			db.stopBackgroundTasks()
+			for _, file := range db.olderFiles {
+				_ = file.Close()
+			}
+			for _, file := range db.blobFiles {
+				_ = file.Close()
+			}
+			_ = db.index.Close()
+		}
+	}()
 
-	// 加载 merge 数据目录，替换掉本目录下的旧数据文件
-	if err := db.loadMergeFiles(); err != nil {
-		return nil, err
+	// 加载 merge 数据目录，替换掉本目录下的旧数据文件，只读实例不修改文件，由写入进程在下次打开时处理
+	if !options.ReadOnly {
+		if err := db.loadMergeFiles(); err != nil {
+			return nil, err
+		}
 	}
 
 	// 读取数据文件，加载到db中,更新fileIds，全部作为旧数据文件
@@ -132,27 +244,59 @@ func Open(options Options) (*DB, error) {
 		}
 	}
 
-	// 取出当前事务序列号
+	// 取出当前事务序列号，B+ 树索引持久化在磁盘上，需要遍历索引统计每个文件的有效数据量
 	if options.IndexType == BPlusTree {
 		if err := db.loadSeqNo(); err != nil {
 			return nil, err
 		}
+		db.loadLiveBytes()
+	}
+
+	// 加载 blob 文件，只读实例需要在读取数据文件之后加载，保证索引指向的 blob 文件都已经存在
+	if err := db.loadBlobFiles(); err != nil {
+		return nil, err
 	}
 
 	if err := db.loadNextFileId(); err != nil {
 		return nil, err
 	}
+	if options.ReadOnly {
+		return db, nil
+	}
+
+	// 启动后台过期清理任务
+	if options.ExpireSweepInterval > 0 {
+		db.bgWg.Add(1)
+		go db.runExpireSweeper()
+	}
+
+	// 启动后台自动 merge 任务
+	if options.AutoMergeInterval > 0 {
+		db.bgWg.Add(1)
+		go db.runAutoMerger()
+	}
 	return db, nil
 }
 
 // Close 关闭数据库
 func (db *DB) Close() error {
 	defer func() {
+		// 只读实例没有加锁
+		if db.fileLock == nil {
+			return
+		}
 		if err := db.fileLock.Unlock(); err != nil {
 			panic(fmt.Sprintf("failed to unlock the directory, %v", err))
 		}
 	}()
 
+	// 先停止后台任务，后台任务中可能还会写入数据
+	db.stopBackgroundTasks()
+
+	if db.options.ReadOnly {
+		return db.closeReadOnly()
+	}
+
 	//锁全部
 	for slot := range db.mus {
 		db.mus[slot].RLock()
@@ -169,7 +313,10 @@ func (db *DB) Close() error {
 		return err
 	}
 
-	// 保存当前事务序列号
+	// 保存当前事务序列号，先删除旧文件，保证文件中只有最新的一条记录
+	if err := os.Remove(filepath.Join(db.options.DirPath, data.SeqNoFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	seqNoFile, err := data.OpenSeqNoFIle(db.options.DirPath)
 	if err != nil {
 		return err
@@ -187,6 +334,9 @@ func (db *DB) Close() error {
 	}
 
 	// 保存 nextFileId
+	if err := os.Remove(filepath.Join(db.options.DirPath, data.NextFileIdFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	nextFileIdFile, err := data.OpenNextFileIdFile(db.options.DirPath)
 	if err != nil {
 		return err
@@ -216,6 +366,12 @@ func (db *DB) Close() error {
 	for _, file := range db.olderFiles {
 		_ = file.Close()
 	}
+
+	// 关闭 blob 文件
+	for _, file := range db.blobFiles {
+		_ = file.Sync()
+		_ = file.Close()
+	}
 	return nil
 }
 
@@ -240,6 +396,14 @@ func (db *DB) SyncAll() error {
 			return err
 		}
 	}
+	for _, blobFile := range db.activeBlobFiles {
+		if blobFile == nil {
+			continue
+		}
+		if err := blobFile.Sync(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -251,7 +415,7 @@ func (db *DB) Stat() *Stat {
 
 	defer func() {
 		for i := len(db.mus) - 1; i >= 0; i-- {
-			db.mus[i].Unlock()
+			db.mus[i].RUnlock()
 		}
 	}()
 
@@ -263,27 +427,34 @@ func (db *DB) Stat() *Stat {
 	if err != nil {
 		panic(fmt.Sprintf("failed to get dir size: %v", err))
 	}
-	return &Stat{
-		KeyNum:          uint(db.index.Size()),
-		DataFileNum:     dataFiles,
-		ReclaimableSize: db.reclaimSize,
-		DiskSize:        dirSize, // todo
-	}
+	db.autoMergeMu.Lock()
+	defer db.autoMergeMu.Unlock()
+	stat := &Stat{
+		KeyNum:            uint(db.index.Size()),
+		DataFileNum:       dataFiles,
+		ReclaimableSize:   db.reclaimSize.Load(),
+		DiskSize:          dirSize, // todo
+		LastAutoMergeTime: db.lastAutoMergeTime,
+		LastAutoMergeErr:  db.lastAutoMergeErr,
+	}
+	if db.cache != nil {
+		stat.CacheHits = db.cache.hits.Load()
+		stat.CacheMisses = db.cache.misses.Load()
+	}
+	return stat
 }
 
-// Backup 备份数据库，将数据文件拷贝到新的目录中
-func (db *DB) Backup(dir string) error {
-	//锁全部
-	for slot := range db.mus {
-		db.mus[slot].RLock()
-	}
-
-	defer func() {
-		for i := len(db.mus) - 1; i >= 0; i-- {
-			db.mus[i].RUnlock()
-		}
-	}()
-	return utils.CopyDir(db.options.DirPath, dir, []string{fileLockName})
+// stopBackgroundTasks 通知所有后台任务退出，并等待其结束
+func (db *DB) stopBackgroundTasks() {
+	db.closeOnce.Do(func() {
+		// 不再接受异步写入，队列中剩余的数据由异步写入协程在退出之前写完
+		db.asyncMu.Lock()
+		db.asyncClosed = true
+		db.asyncMu.Unlock()
+		close(db.closeCh)
+	})
+	db.bgWg.Wait()
+	db.asyncWg.Wait()
 }
 
 func (db *DB) hash(key []byte) uint32 {
@@ -292,36 +463,73 @@ func (db *DB) hash(key []byte) uint32 {
 
 // Put 写入 key/value 数据，key 不能为空
 func (db *DB) Put(key []byte, value []byte) error {
+	return db.put(key, value, 0)
+}
+
+// PutWithTTL 写入 key/value 数据，并在 ttl 之后过期，ttl 为 0 表示永不过期
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl < 0 {
+		return ErrInvalidTTL
+	}
+	var expire int64
+	if ttl > 0 {
+		expire = time.Now().Add(ttl).UnixNano()
+	}
+	return db.put(key, value, expire)
+}
+
+// put 写入 key/value 数据，expire 为过期的时间点(UnixNano)
+func (db *DB) put(key []byte, value []byte, expire int64) error {
 	// 判断 key 是否有效
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	// hash
+	slot := db.hash(key)
 
+	// 加锁之后再分配序列号，保证序列号的顺序和写入内存索引的顺序一致
+	return db.writeSlot(slot, false, func() (func(), error) {
+		return db.putLocked(slot, key, value, expire)
+	})
+}
+
+// putLocked 写入 key/value 数据，返回更新内存索引的函数，调用前需要持有 slot 的写锁
+func (db *DB) putLocked(slot uint32, key []byte, value []byte, expire int64) (func(), error) {
 	// 序列号全局+1
-	atomic.AddUint64(&db.seqNo, 1)
+	seqNo := atomic.AddUint64(&db.seqNo, 1)
 
 	// 构造 LogRecord 结构体
 	logRecord := &data.LogRecord{
-		Key:   logRecordKeyWithSeq(key, db.seqNo),
-		Value: value,
-		Type:  data.LogRecordTxnFinished, //注意,这个是finished,防止再写入一条数据
+		Key:    logRecordKeyWithSeq(key, seqNo),
+		Value:  value,
+		Type:   data.LogRecordTxnFinished, //注意,这个是finished,防止再写入一条数据
+		Expire: expire,
+	}
+	if err := db.encodeValue(slot, key, logRecord); err != nil {
+		return nil, err
 	}
-
-	// hash
-	slot := db.hash(key)
 
 	// 追加写入到当前活跃文件中
-	pos, err := db.appendLogRecordWithLock(slot, logRecord)
+	pos, err := db.appendLogRecord(slot, logRecord)
 	if err != nil {
-		return err
-	}
-
-	// 更新内存索引
-	if oldPos := db.index.Put(key, pos); oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
+		return nil, err
 	}
 
-	return nil
+	return func() {
+		// 更新内存索引
+		oldPos := db.index.Put(key, pos)
+		if oldPos != nil {
+			db.reclaimSize.Add(int64(oldPos.Size))
+		}
+		db.trackLive(pos, oldPos)
+		// 有快照时保留旧版本
+		db.retainVersion(key, oldPos, seqNo)
+		db.publish(seqNo, []*WatchEntry{{Key: key, Value: value, Type: WatchPut}})
+	}, nil
 }
 
 // Delete 根据 key 删除对应的数据
@@ -330,39 +538,51 @@ func (db *DB) Delete(key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
-
-	// 检查 key 是否存在，如果不存在直接返回
-	if pos := db.index.Get(key); pos == nil {
-		return nil
+	if db.options.ReadOnly {
+		return ErrReadOnly
 	}
+
+	// hash
+	slot := db.hash(key)
+
+	return db.writeSlot(slot, true, func() (func(), error) {
+		// 检查 key 是否存在，如果不存在直接返回
+		if pos := db.index.Get(key); pos == nil {
+			return nil, nil
+		}
+		return db.deleteLocked(slot, key)
+	})
+}
+
+// deleteLocked 写入删除记录，返回从内存索引中删除 key 的函数，调用前需要持有 slot 的写锁
+func (db *DB) deleteLocked(slot uint32, key []byte) (func(), error) {
 	// 序列号全局+1
-	atomic.AddUint64(&db.seqNo, 1)
+	seqNo := atomic.AddUint64(&db.seqNo, 1)
 
 	// 构造 logRecord 信息，标识其是被删除的
 	logRecord := &data.LogRecord{
-		Key:  logRecordKeyWithSeq(key, db.seqNo),
+		Key:  logRecordKeyWithSeq(key, seqNo),
 		Type: data.LogRecordDeleted,
 	}
-	// hash
-	slot := db.hash(key)
 
 	// 写入到数据文件中
-	pos, err := db.appendLogRecordWithLock(slot, logRecord)
+	pos, err := db.appendLogRecord(slot, logRecord)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	db.reclaimSize += int64(pos.Size)
+	db.reclaimSize.Add(int64(pos.Size))
 
-	// 从内存索引中中删除对应的 key
-	oldPos, ok := db.index.Delete(key)
-	if !ok {
-		return ErrIndexUpdateFailed
-	}
-	if oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
-	}
-	return nil
+	return func() {
+		// 从内存索引中中删除对应的 key，写入之前检查过 key 存在，持有锁期间不会被删除
+		oldPos, _ := db.index.Delete(key)
+		if oldPos != nil {
+			db.reclaimSize.Add(int64(oldPos.Size))
+		}
+		db.trackLive(nil, oldPos)
+		db.retainVersion(key, oldPos, seqNo)
+		db.publish(seqNo, []*WatchEntry{{Key: key, Type: WatchDelete}})
+	}, nil
 }
 
 // Get 根据 key 读取数据
@@ -379,8 +599,8 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 
 	// 从内存的数据结构中取出 key 对应的索引信息
 	logRecordPos := db.index.Get(key)
-	// 如果 key 不在内存索引中，说明 key 不存在
-	if logRecordPos == nil {
+	// 如果 key 不在内存索引中或者已经过期，说明 key 不存在
+	if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
 		return nil, ErrKeyNotFound
 	}
 
@@ -388,15 +608,65 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	return db.getValueByPosition(slot, logRecordPos)
 }
 
+// TTL 获取 key 剩余的存活时间，永不过期的 key 返回 NoExpiration
+func (db *DB) TTL(key []byte) (time.Duration, error) {
+	if len(key) == 0 {
+		return 0, ErrKeyIsEmpty
+	}
+
+	now := time.Now().UnixNano()
+	logRecordPos := db.index.Get(key)
+	if logRecordPos == nil || logRecordPos.IsExpired(now) {
+		return 0, ErrKeyNotFound
+	}
+	if logRecordPos.Expire == 0 {
+		return NoExpiration, nil
+	}
+	return time.Duration(logRecordPos.Expire - now), nil
+}
+
+// Persist 移除 key 的过期时间，使其永不过期
+func (db *DB) Persist(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	slot := db.hash(key)
+	return db.writeSlot(slot, true, func() (func(), error) {
+		logRecordPos := db.index.Get(key)
+		if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
+			return nil, ErrKeyNotFound
+		}
+		// 本身就没有设置过期时间
+		if logRecordPos.Expire == 0 {
+			return nil, nil
+		}
+
+		value, err := db.getValueByPosition(slot, logRecordPos)
+		if err != nil {
+			return nil, err
+		}
+
+		// 重新写入一条不带过期时间的记录
+		return db.putLocked(slot, key, value, 0)
+	})
+}
+
 // ListKeys 获取数据库中的所有的 key(只操作内存索引，不需要加锁)
 func (db *DB) ListKeys() [][]byte {
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
-	keys := make([][]byte, db.index.Size())
-	var idx int
+	keys := make([][]byte, 0, db.index.Size())
+	now := time.Now().UnixNano()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		keys[idx] = iterator.Key()
-		idx += 1
+		// 跳过已经过期的 key
+		if iterator.Value().IsExpired(now) {
+			continue
+		}
+		keys = append(keys, iterator.Key())
 	}
 	return keys
 }
@@ -416,7 +686,12 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
+	now := time.Now().UnixNano()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		// 跳过已经过期的 key
+		if iterator.Value().IsExpired(now) {
+			continue
+		}
 		key := iterator.Key()
 		slot := db.hash(key)
 		value, err := db.getValueByPosition(slot, iterator.Value())
@@ -433,21 +708,23 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 // getValueByPosition 根据索引信息读取数据
 // 必须在上层加锁
 func (db *DB) getValueByPosition(slot uint32, logRecordPos *data.LogRecordPos) ([]byte, error) {
+	if db.cache != nil {
+		if value, ok := db.cache.get(logRecordPos); ok {
+			return value, nil
+		}
+	}
 
 	// 根据文件 id 找到对应的数据文件
-	var dataFile *data.DataFile
-	if db.activeFiles[slot] != nil && db.activeFiles[slot].FileId == logRecordPos.Fid {
-		dataFile = db.activeFiles[slot]
-	} else {
-		dataFile = db.olderFiles[logRecordPos.Fid]
-	}
+	dataFile := db.dataFileOf(slot, logRecordPos.Fid)
 	// 数据文件为空
 	if dataFile == nil {
 		return nil, ErrDataFileNotFound
 	}
 
-	// 根据偏移量读取对应的数据
-	logRecord, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
+	// 根据索引中的偏移量和长度一次读取整条记录
+	buf := data.GetRecordBuffer(int(logRecordPos.Size))
+	defer data.PutRecordBuffer(buf)
+	logRecord, err := dataFile.ReadLogRecordAt(logRecordPos.Offset, logRecordPos.Size, *buf)
 	if err != nil {
 		return nil, err
 	}
@@ -456,7 +733,28 @@ func (db *DB) getValueByPosition(slot uint32, logRecordPos *data.LogRecordPos) (
 		return nil, ErrKeyNotFound
 	}
 
-	return logRecord.Value, nil
+	value, err := db.recordValue(logRecord)
+	if err != nil {
+		return nil, err
+	}
+	// 没有压缩的 value 引用的是缓冲区中的数据，放回缓冲池之前需要拷贝
+	if !logRecord.Blob && !logRecord.Compressed {
+		value = append([]byte(nil), value...)
+	}
+	if db.cache != nil {
+		db.cache.put(logRecordPos, value)
+	}
+	return value, nil
+}
+
+// dataFileOf 根据文件 id 找到对应的数据文件，不存在时返回 nil，必须在上层加锁
+func (db *DB) dataFileOf(slot uint32, fid uint32) *data.DataFile {
+	if db.activeFiles[slot] != nil && db.activeFiles[slot].FileId == fid {
+		return db.activeFiles[slot]
+	}
+	db.filesMu.RLock()
+	defer db.filesMu.RUnlock()
+	return db.olderFiles[fid]
 }
 
 // 追加数据到活跃文件中（上层不许加锁）
@@ -478,8 +776,11 @@ func (db *DB) appendLogRecord(slot uint32, logRecord *data.LogRecord) (*data.Log
 
 	activeFile := db.activeFiles[slot]
 
-	// 写入数据编码
-	encRecord, size := data.EncodeLogRecord(logRecord)
+	// 写入数据编码，开启加密时先加密
+	encRecord, size, err := activeFile.EncodeLogRecord(logRecord)
+	if err != nil {
+		return nil, err
+	}
 	// 如果写入的数据已经达到了活跃文件的阈值，则关闭活跃文件，并打开新的文件
 	if activeFile.WriteOff+size > db.options.DataFileSize {
 		// 先将当前活跃文件进行持久化，保证已有的数据持久到磁盘当中
@@ -487,13 +788,22 @@ func (db *DB) appendLogRecord(slot uint32, logRecord *data.LogRecord) (*data.Log
 			return nil, err
 		}
 
+		db.syncers[slot].markSynced(activeFile.WriteOff)
+
 		// 将当前活跃文件转换为旧的数据文件
+		db.filesMu.Lock()
 		db.olderFiles[activeFile.FileId] = activeFile
+		db.filesMu.Unlock()
+		db.writeHintInBackground(activeFile)
 
-		// 打开新的数据文件
+		// 打开新的数据文件，加密的记录和写入的位置绑定，需要重新编码
 		if err := db.setActiveDataFile(slot); err != nil {
 			return nil, err
 		}
+		activeFile = db.activeFiles[slot]
+		if encRecord, size, err = activeFile.EncodeLogRecord(logRecord); err != nil {
+			return nil, err
+		}
 	}
 
 	writeOff := activeFile.WriteOff
@@ -501,21 +811,15 @@ func (db *DB) appendLogRecord(slot uint32, logRecord *data.LogRecord) (*data.Log
 		return nil, err
 	}
 
-	db.bytesWrite += uint(size)
-	// 根据用户配置决定是否持久化
-	// 如果当前写入的字节数到达了用户的设置值
-	var needSync = db.options.SyncWrites
-	if !needSync && db.options.BytesPerSync > 0 && db.bytesWrite >= db.options.BytesPerSync {
-		needSync = true
-	}
-
-	if needSync {
+	bytesWrite := db.bytesWrite.Add(uint64(size))
+	// 如果当前写入的字节数到达了用户的设置值则持久化
+	// 开启 SyncWrites 时由 group commit 的 leader 合并持久化，见 writeSlots
+	if !db.options.SyncWrites && db.options.BytesPerSync > 0 && bytesWrite >= uint64(db.options.BytesPerSync) {
 		if err := activeFile.Sync(); err != nil {
 			return nil, err
 		}
-		if db.bytesWrite > 0 {
-			db.bytesWrite = 0
-		}
+		db.syncers[slot].markSynced(activeFile.WriteOff)
+		db.bytesWrite.Store(0)
 	}
 
 	// 构造内存索引信息
@@ -523,26 +827,39 @@ func (db *DB) appendLogRecord(slot uint32, logRecord *data.LogRecord) (*data.Log
 		Fid:    activeFile.FileId,
 		Offset: writeOff,
 		Size:   uint32(size),
+		Expire: logRecord.Expire,
 	}
+	setBlobPos(pos, logRecord)
 	return pos, nil
 }
 
 // setActiveDataFile 为指定 slot 创建并设置新的活跃文件
 // 注意：调用此方法前必须已经持有 db.mus[slot] 锁
 func (db *DB) setActiveDataFile(slot uint32) error {
-	newFileId := uint32(db.nextFileId.Load())
+	// 不同 slot 可能同时切换活跃文件，需要原子地分配文件 id
+	newFileId := uint32(db.nextFileId.Add(1) - 1)
 	// 打开新的数据文件，注意这里目录和 IO 模块根据你的具体实现可能有所不同
-	dataFile, err := data.OpenDataFile(db.options.DirPath, newFileId, fio.StandardFIO)
+	dataFile, err := db.openDataFile(db.options.DirPath, newFileId, fio.StandardFIO)
 	if err != nil {
 		return err
 	}
 
 	// 更新活跃文件数组中的对应 slot
 	db.activeFiles[slot] = dataFile
-	db.nextFileId.Add(1)
+	db.syncers[slot] = newFileSyncer(dataFile)
 	return nil
 }
 
+// openDataFile 打开数据文件，开启加密时设置加解密使用的 cipher
+func (db *DB) openDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*data.DataFile, error) {
+	dataFile, err := data.OpenDataFile(dirPath, fileId, ioType)
+	if err != nil {
+		return nil, err
+	}
+	dataFile.Cipher = db.cipher
+	return dataFile, nil
+}
+
 // 从磁盘加载数据文件
 func (db *DB) loadDataFile() error {
 	dirEntries, err := os.ReadDir(db.options.DirPath)
@@ -568,14 +885,25 @@ func (db *DB) loadDataFile() error {
 	// 对文件 id 进行排序，从小大大依次加载
 	sort.Ints(fileIds)
 	db.fileIds = fileIds
+	if len(fileIds) > 0 {
+		db.nextFileId.Store(int64(fileIds[len(fileIds)-1] + 1))
+	}
 
 	// 遍历每个文件的id，打开对应的数据文件
 	for _, fid := range fileIds {
+		// 只读实例打开的文件可能还会被写入进程追加数据，不能使用内存映射
 		ioType := fio.StandardFIO
-		if db.options.MMapAtStartup {
+		if db.options.MMapAtStartup && !db.options.ReadOnly {
 			ioType = fio.MemoryMap //内存映射，提高读取速度
 		}
-		dataFile, err := data.OpenDataFile(db.options.DirPath, uint32(fid), ioType)
+		if db.options.ReadOnly {
+			info, err := os.Stat(data.GetDataFileName(db.options.DirPath, uint32(fid)))
+			if err != nil {
+				return err
+			}
+			db.fileInfos[uint32(fid)] = info
+		}
+		dataFile, err := db.openDataFile(db.options.DirPath, uint32(fid), ioType)
 		if err != nil {
 			return err
 		}
@@ -584,8 +912,6 @@ func (db *DB) loadDataFile() error {
 	return nil
 }
 
-// 从数据文件中加载索引
-// 遍历旧文件中的索引记录，并更新到内存索引中
 // 从数据文件中加载索引
 // 遍历旧文件中的索引记录，并更新到内存索引中
 func (db *DB) loadIndexFromDataFile() error {
@@ -598,7 +924,7 @@ func (db *DB) loadIndexFromDataFile() error {
 	hasMerge, nonMergeFileId := false, uint32(0)
 	mergeFinFileName := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
 	if _, err := os.Stat(mergeFinFileName); err == nil {
-		fid, err := db.getNonMergeFileId(db.options.DirPath)
+		_, fid, err := db.getMergeFileIds(db.options.DirPath)
 		if err != nil {
 			return err
 		}
@@ -606,113 +932,210 @@ func (db *DB) loadIndexFromDataFile() error {
 		nonMergeFileId = fid //最后一个文件id的下一个Id
 	}
 
-	// 更新内存索引，使用真实key来更新
-	updateIndex := func(realKey []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
-		var oldPos *data.LogRecordPos
-		if typ == data.LogRecordDeleted {
-			oldPos, _ = db.index.Delete(realKey)
-			// 被删除的数据本身也是无效的，也要统计
-			db.reclaimSize += int64(pos.Size)
-		} else {
-			oldPos = db.index.Put(realKey, pos)
+	replayer := newIndexReplayer(db)
+
+	// 如果比最近未参与 merge 的文件 id 更小，说明已经从 hint 文件中加载索引了
+	var dataFiles []*data.DataFile
+	for _, fid := range db.fileIds {
+		if hasMerge && uint32(fid) < nonMergeFileId {
+			size, err := db.olderFiles[uint32(fid)].IoManager.Size()
+			if err != nil {
+				return err
+			}
+			db.scannedOffsets[uint32(fid)] = size
+			continue
 		}
-		if oldPos != nil {
-			db.reclaimSize += int64(oldPos.Size)
+		dataFiles = append(dataFiles, db.olderFiles[uint32(fid)])
+	}
+
+	// 只读实例读到的文件末尾可能是写入进程正在写入的记录，不能视为数据损坏
+	var newest map[uint32]bool
+	if db.options.RecoveryMode != RecoveryStrict && !db.options.ReadOnly {
+		newest = db.newestFilesOfSlots(dataFiles)
+	}
+
+	// 多个协程并发读取数据文件，再按照文件 id 从小到大依次处理读到的记录，保证和顺序加载的结果一致
+	// 同时读取的文件数量不超过 RecoveryWorkers，避免占用过多内存
+	results := make([]chan *fileScanResult, len(dataFiles))
+	for i := range results {
+		results[i] = make(chan *fileScanResult, 1)
+	}
+	sem := make(chan struct{}, max(db.options.RecoveryWorkers, 1))
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i, dataFile := range dataFiles {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(i int, dataFile *data.DataFile) {
+				tolerateTail := db.options.ReadOnly || newest[dataFile.FileId]
+				results[i] <- db.scanDataFile(dataFile, 0, tolerateTail)
+			}(i, dataFile)
+		}
+	}()
+
+	for i, dataFile := range dataFiles {
+		result := <-results[i]
+		if result.err != nil {
+			return result.err
+		}
+		// 截断文件末尾写了一半的记录，只读实例不修改文件，写了一半的记录可能是写入进程正在写入的
+		if result.truncateAt >= 0 && !db.options.ReadOnly {
+			log.Printf("truncate the corrupted tail of data file %d at offset %d\n", dataFile.FileId, result.truncateAt)
+			newFile, err := db.truncateDataFile(dataFile, result.truncateAt)
+			if err != nil {
+				return err
+			}
+			dataFile = newFile
+		}
+		for _, entry := range result.entries {
+			replayer.handleRecord(entry.record, entry.pos)
+		}
+		<-sem
+		db.scannedOffsets[dataFile.FileId] = result.end
+
+		// hint 文件不存在或者无效，在后台重新生成 hint 文件
+		if !result.fromHint {
+			db.writeHintInBackground(dataFile)
 		}
 	}
 
+	// 更新全局事务序号
+	db.seqNo = replayer.seqNo
+	if db.options.ReadOnly {
+		db.replayer = replayer
+	}
+	return nil
+}
+
+// indexReplayer 按照数据文件中记录的顺序重放记录，更新内存索引
+// 只读实例会保留重放的状态，Refresh 时从上次读到的位置继续重放
+type indexReplayer struct {
+	db  *DB
+	now int64
+
 	// 暂存事务数据
-	transactionsRecords := make(map[uint64][]*data.TransactionRecord)
-	var currentSeqNo uint64 = nonTransactionSeqNo
+	transactionsRecords map[uint64][]*data.TransactionRecord
 
 	// 记录所有 key 对应的事务序列号，防止低事务序号更新高事务序号的数据
-	keySeqMap := make(map[string]uint64)
+	keySeqMap map[string]uint64
 
-	// 遍历索引文件id，处理文件中的记录
-	for _, fid := range db.fileIds {
-		var fileID = uint32(fid)
-		// 如果比最近未参与 merge 的文件 id 更小，说明已经从 hint 文件中加载索引了
-		if hasMerge && fileID < nonMergeFileId {
-			continue
-		}
-		dataFile := db.olderFiles[fileID]
+	// 已经读到的范围删除记录，不同 slot 的数据文件是交错的，后读到的数据可能早于范围删除
+	rangeTombstones tombstoneIndex
 
-		var offset int64 = 0
-		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
+	// blob 回收时移动过 value 的 key 对应的事务序列号，之后读到的同一事务的原始记录不能覆盖移动之后的位置
+	relocated map[string]uint64
 
-			// 构造内存索引保存的位置
-			logRecordPos := &data.LogRecordPos{Fid: fileID, Offset: offset, Size: uint32(size)}
+	// 读到的最大事务序列号
+	seqNo uint64
+}
 
-			// 解析 logRecord.Key，获得真实 key 和事务序列号
-			realKey, seqNo := parseLogRecordKey(logRecord.Key)
+func newIndexReplayer(db *DB) *indexReplayer {
+	return &indexReplayer{
+		db:                  db,
+		now:                 time.Now().UnixNano(),
+		transactionsRecords: make(map[uint64][]*data.TransactionRecord),
+		keySeqMap:           make(map[string]uint64),
+		relocated:           make(map[string]uint64),
+		seqNo:               nonTransactionSeqNo,
+	}
+}
 
-			// 如果不是事务完成的记录，暂存事务记录（使用真实 key）
-			if !bytes.Equal(realKey, txnFinKey) {
-				// 注意：此处不要修改 logRecord.Key，直接保留解析出来的 realKey 供后续更新索引时使用
-				transactionsRecords[seqNo] = append(transactionsRecords[seqNo], &data.TransactionRecord{
-					Record: logRecord,
-					Pos:    logRecordPos,
-				})
-			}
+// updateIndex 更新内存索引，使用真实key来更新
+func (r *indexReplayer) updateIndex(realKey []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
+	db := r.db
+	var oldPos *data.LogRecordPos
+	// 已经过期的数据和被删除的数据一样，本身也是无效的，也要统计
+	if typ == data.LogRecordDeleted || pos.IsExpired(r.now) {
+		oldPos, _ = db.index.Delete(realKey)
+		db.reclaimSize.Add(int64(pos.Size))
+		db.trackLive(nil, oldPos)
+	} else {
+		oldPos = db.index.Put(realKey, pos)
+		db.trackLive(pos, oldPos)
+	}
+	if oldPos != nil {
+		db.reclaimSize.Add(int64(oldPos.Size))
+	}
+}
 
-			// 如果是事务完成记录，则可以更新内存索引
-			if logRecord.Type == data.LogRecordTxnFinished {
-				//获取value(本次事务所涉及的所有key数量),如果不一致则不允许更新
-				num := binary.BigEndian.Uint64(logRecord.Value)
-				if len(transactionsRecords[seqNo]) == int(num) {
-					for _, txnRecord := range transactionsRecords[seqNo] {
-						// 使用解析出的真实 key进行更新
-						rk, _ := parseLogRecordKey(txnRecord.Record.Key)
-						// 检查这个 key 是否已经用更大事务序号更新，如果是，则跳过
-						if keySeq, ok := keySeqMap[string(rk)]; ok {
-							if keySeq > seqNo {
-								continue
-							}
-						}
-						// 更新内存索引，使用真实 key进行更新
-						updateIndex(rk, txnRecord.Record.Type, txnRecord.Pos)
-						// 更新 key 对应的事务序列号
-						keySeqMap[string(rk)] = seqNo
-					}
-					// 删除该事务序号下的记录
-					delete(transactionsRecords, seqNo)
-				}
-			}
+// applyRecord 按照事务序列号更新内存索引
+func (r *indexReplayer) applyRecord(realKey []byte, seqNo uint64, typ data.LogRecordType, pos *data.LogRecordPos) {
+	// 检查这个 key 是否已经用更大事务序号更新，如果是，则跳过
+	if keySeq, ok := r.keySeqMap[string(realKey)]; ok && keySeq > seqNo {
+		return
+	}
+	// 被序列号更大的范围删除覆盖，视为删除
+	if r.rangeTombstones.maxSeqNo(realKey) > seqNo {
+		typ = data.LogRecordDeleted
+	}
+	r.updateIndex(realKey, typ, pos)
+	r.keySeqMap[string(realKey)] = seqNo
+}
 
-			//如果是删除记录,并且是单语句事务,则更新内存索引
-			if logRecord.Type == data.LogRecordDeleted && !bytes.Equal(realKey, txnFinKey) {
-				rk := realKey
-				if keySeq, ok := keySeqMap[string(rk)]; ok {
-					if keySeq > seqNo {
+// handleRecord 处理数据文件中的一条记录
+func (r *indexReplayer) handleRecord(logRecord *data.LogRecord, logRecordPos *data.LogRecordPos) {
+	db := r.db
+	// 解析 logRecord.Key，获得真实 key 和事务序列号
+	realKey, seqNo := parseLogRecordKey(logRecord.Key)
+
+	switch {
+	case bytes.Equal(realKey, txnFinKey):
+		// 批量写的事务完成记录，value 是本次事务所涉及的 key 数量，数量一致才更新内存索引
+		if len(logRecord.Value) == 8 {
+			num := binary.BigEndian.Uint64(logRecord.Value)
+			if uint64(len(r.transactionsRecords[seqNo])) == num {
+				for _, txnRecord := range r.transactionsRecords[seqNo] {
+					rk, _ := parseLogRecordKey(txnRecord.Record.Key)
+					if seq, ok := r.relocated[string(rk)]; ok && seq == seqNo {
 						continue
 					}
+					r.applyRecord(rk, seqNo, txnRecord.Record.Type, txnRecord.Pos)
 				}
-				// 更新内存索引，使用真实 key进行更新
-				updateIndex(rk, logRecord.Type, logRecordPos)
-				// 更新 key 对应的事务序列号
-				keySeqMap[string(rk)] = seqNo
 			}
-
-			// 更新当前事务序号
-			if seqNo > currentSeqNo {
-				currentSeqNo = seqNo
+		}
+		// 删除该事务序号下的记录
+		delete(r.transactionsRecords, seqNo)
+	case logRecord.Type == data.LogRecordTxnFinished:
+		// 单条 Put 写入的数据，本身就是一个完成的事务，直接更新内存索引
+		r.applyRecord(realKey, seqNo, data.LogRecordNormal, logRecordPos)
+	case logRecord.Type == data.LogRecordRelocated:
+		// blob 回收移动了 value，序列号和原始记录相同，使用新的位置
+		r.applyRecord(realKey, seqNo, data.LogRecordNormal, logRecordPos)
+		r.relocated[string(realKey)] = seqNo
+	case logRecord.Type == data.LogRecordRangeDeleted:
+		// 范围删除，删除范围内序列号更小的 key
+		tombstone := &rangeTombstone{start: realKey, end: logRecord.Value, seqNo: seqNo}
+		r.rangeTombstones.add(tombstone)
+		db.reclaimSize.Add(int64(logRecordPos.Size))
+		for _, key := range db.keysInRange(tombstone.start, tombstone.end) {
+			if keySeq := r.keySeqMap[string(key)]; keySeq < seqNo {
+				if oldPos, ok := db.index.Delete(key); ok && oldPos != nil {
+					db.reclaimSize.Add(int64(oldPos.Size))
+					db.trackLive(nil, oldPos)
+				}
+				r.keySeqMap[string(key)] = seqNo
 			}
-
-			// 递增 offset，继续读取下一条记录
-			offset += size
+		}
+	default:
+		// 暂存事务记录，等待事务完成记录
+		r.transactionsRecords[seqNo] = append(r.transactionsRecords[seqNo], &data.TransactionRecord{
+			Record: logRecord,
+			Pos:    logRecordPos,
+		})
+		//如果是删除记录,并且是单语句事务,则更新内存索引
+		if logRecord.Type == data.LogRecordDeleted {
+			r.applyRecord(realKey, seqNo, logRecord.Type, logRecordPos)
 		}
 	}
 
-	// 更新全局事务序号
-	db.seqNo = currentSeqNo
-	return nil
+	// 更新当前事务序号
+	if seqNo > r.seqNo {
+		r.seqNo = seqNo
+	}
 }
 
 func checkOptions(options Options) error {
@@ -725,6 +1148,57 @@ func checkOptions(options Options) error {
 	if options.DataFileMergeRatio < 0 || options.DataFileMergeRatio > 1 {
 		return errors.New("invalid merge ratio, must between 0 and 1")
 	}
+	if options.RecoveryMode < RecoveryStrict || options.RecoveryMode > RecoverySkipCorrupt {
+		return errors.New("invalid recovery mode")
+	}
+	if options.RecoveryWorkers < 0 {
+		return errors.New("recovery workers must not be negative")
+	}
+	if options.ReadOnly && options.IndexType == BPlusTree {
+		return errors.New("read only mode does not support bptree index")
+	}
+	// B+ 树索引文件中保存的 key 没有加密
+	if options.Encryption != nil && options.IndexType == BPlusTree {
+		return errors.New("encryption does not support bptree index")
+	}
+	if options.CompressionThreshold < 0 {
+		return errors.New("compression threshold must not be negative")
+	}
+	if c := options.Compression; c != nil {
+		if builtin, ok := builtinCompressors[c.Id()]; c.Id() == 0 || ok && builtin != c {
+			return errors.New("invalid compressor id, must not be 0 or conflict with builtin compressors")
+		}
+	}
+	if options.ValueThreshold < 0 {
+		return errors.New("value threshold must not be negative")
+	}
+	if options.BlobGCDeadRatio < 0 || options.BlobGCDeadRatio > 1 {
+		return errors.New("invalid blob gc dead ratio, must between 0 and 1")
+	}
+	if options.ValueCacheSize < 0 {
+		return errors.New("value cache size must not be negative")
+	}
+	if options.MergeFileDeadRatio < 0 || options.MergeFileDeadRatio > 1 {
+		return errors.New("invalid merge file dead ratio, must between 0 and 1")
+	}
+	if options.WatchBufferSize <= 0 {
+		return errors.New("watch buffer size must be greater than 0")
+	}
+	if options.ExpireSweepInterval > 0 && options.ExpireSweepSamples <= 0 {
+		return errors.New("expire sweep samples must be greater than 0")
+	}
+	if options.AutoMergeInterval > 0 {
+		if options.AutoMergeRatio < 0 || options.AutoMergeRatio > 1 {
+			return errors.New("invalid auto merge ratio, must between 0 and 1")
+		}
+		if options.AutoMergeWindowStart < 0 || options.AutoMergeWindowStart >= 24*time.Hour ||
+			options.AutoMergeWindowEnd < 0 || options.AutoMergeWindowEnd >= 24*time.Hour {
+			return errors.New("invalid auto merge window, must between 0 and 24h")
+		}
+		if options.AutoMergeMinReclaimSize < 0 {
+			return errors.New("auto merge min reclaim size must not be negative")
+		}
+	}
 	return nil
 }
 
@@ -770,7 +1244,10 @@ func (db *DB) loadNextFileId() error {
 	if err != nil {
 		return err
 	}
-	db.nextFileId.Store(int64(nextFileId))
+	// 不能小于已有数据文件的 id，防止向已有的数据文件中追加写入
+	if int64(nextFileId) > db.nextFileId.Load() {
+		db.nextFileId.Store(int64(nextFileId))
+	}
 	return nil
 }
 
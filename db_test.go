@@ -1,8 +1,10 @@
 package bitcask_go
 
 import (
+	"bitcask-go/data"
 	"bitcask-go/utils"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -404,3 +406,272 @@ func TestDB_Backup(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, db2)
 }
+
+func TestDB_PutWithTTL(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1.未过期的数据可以正常读取
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.RandomValue(24), time.Hour)
+	assert.Nil(t, err)
+	val1, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val1)
+
+	// 2.过期之后读取不到
+	err = db.PutWithTTL(utils.GetTestKey(2), utils.RandomValue(24), 50*time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 1, len(db.ListKeys()))
+
+	iter := db.NewIterator(DefaultIteratorOptions)
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, utils.GetTestKey(1), iter.Key())
+		count++
+	}
+	iter.Close()
+	assert.Equal(t, 1, count)
+
+	// 3.ttl 为负数
+	err = db.PutWithTTL(utils.GetTestKey(3), utils.RandomValue(24), -time.Second)
+	assert.Equal(t, ErrInvalidTTL, err)
+
+	// 4.重启之后过期时间依然有效
+	err = db.PutWithTTL(utils.GetTestKey(4), utils.RandomValue(24), 300*time.Millisecond)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	val2, err := db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, val1, val2)
+	_, err = db2.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db2.Get(utils.GetTestKey(4))
+	assert.Nil(t, err)
+
+	time.Sleep(400 * time.Millisecond)
+	_, err = db2.Get(utils.GetTestKey(4))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_TTL(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl-persist")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 永不过期的 key
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(24))
+	assert.Nil(t, err)
+	ttl, err := db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, NoExpiration, ttl)
+
+	// 不存在的 key
+	_, err = db.TTL(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 设置了过期时间的 key
+	err = db.PutWithTTL(utils.GetTestKey(3), utils.RandomValue(24), time.Minute)
+	assert.Nil(t, err)
+	ttl, err = db.TTL(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Minute)
+
+	// Persist 之后永不过期
+	err = db.PutWithTTL(utils.GetTestKey(4), []byte("persist"), 100*time.Millisecond)
+	assert.Nil(t, err)
+	err = db.Persist(utils.GetTestKey(4))
+	assert.Nil(t, err)
+	ttl, err = db.TTL(utils.GetTestKey(4))
+	assert.Nil(t, err)
+	assert.Equal(t, NoExpiration, ttl)
+	time.Sleep(150 * time.Millisecond)
+	val, err := db.Get(utils.GetTestKey(4))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("persist"), val)
+
+	err = db.Persist(utils.GetTestKey(5))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_ParallelRecovery(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-parallel-recovery")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 2000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(32)))
+		}
+		wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+		for i := n * 100; i < n*100+100; i++ {
+			assert.Nil(t, wb.Put(utils.GetTestKey(i), []byte("batch")))
+			assert.Nil(t, wb.Delete(utils.GetTestKey(i+1000)))
+		}
+		assert.Nil(t, wb.Commit())
+		assert.Nil(t, db.DeleteRange(utils.GetTestKey(1500+n*100), utils.GetTestKey(1550+n*100)))
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	load := func(workers int) (map[string]string, *Stat) {
+		opts.RecoveryWorkers = workers
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		defer func() {
+			assert.Nil(t, db.Close())
+		}()
+		values := make(map[string]string)
+		err = db.Fold(func(key []byte, value []byte) bool {
+			values[string(key)] = string(value)
+			return true
+		})
+		assert.Nil(t, err)
+		return values, db.Stat()
+	}
+
+	// 顺序加载和并发加载的结果一致
+	values1, stat1 := load(1)
+	values2, stat2 := load(8)
+	assert.Equal(t, 2000-100-50, len(values1))
+	assert.Equal(t, values1, values2)
+	assert.Equal(t, stat1.ReclaimableSize, stat2.ReclaimableSize)
+}
+
+func TestDB_RecoveryMode(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-recovery-mode")
+	defer os.RemoveAll(dir)
+	opts.DirPath = dir
+	opts.Slots = 1
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	assert.Nil(t, db.Close())
+
+	fileName := data.GetDataFileName(dir, 0)
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	validSize := int64(len(content))
+
+	// 文件末尾追加一条校验失败的记录
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeq([]byte("torn"), 1000),
+		Value: []byte("torn-value"),
+		Type:  data.LogRecordTxnFinished,
+	})
+	encRecord[len(encRecord)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, append(content, encRecord...), 0644))
+
+	// strict 模式下打开失败
+	opts.RecoveryMode = RecoveryStrict
+	_, err = Open(opts)
+	assert.ErrorIs(t, err, data.ErrInvalidCRC)
+
+	// 截断文件末尾的记录
+	opts.RecoveryMode = RecoveryTruncateTail
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(db.ListKeys()))
+	assert.Nil(t, db.Close())
+	info, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, validSize, info.Size())
+
+	// 文件中间的记录损坏
+	content[len(content)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+	_ = os.Remove(data.GetDataHintFileName(dir, 0))
+	db, err = Open(opts)
+	assert.ErrorIs(t, err, data.ErrInvalidCRC)
+	assert.Contains(t, err.Error(), "data file 0")
+	assert.Nil(t, db)
+
+	// 跳过损坏的记录
+	opts.RecoveryMode = RecoverySkipCorrupt
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 99, len(db.ListKeys()))
+	assert.Nil(t, db.Close())
+}
+
+// 只有每个 slot 最新的数据文件末尾可能有写了一半的记录，截断时不修改备份中硬链接的文件
+func TestDB_RecoveryMode_NewestFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-recovery-newest")
+	defer os.RemoveAll(dir)
+	opts.DirPath = dir
+	opts.Slots = 1
+	opts.DataFileSize = 4 * 1024
+	opts.RecoveryMode = RecoveryTruncateTail
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	lastFid := db.activeFiles[0].FileId
+	assert.Greater(t, lastFid, uint32(0))
+	assert.Nil(t, db.Close())
+
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeq([]byte("torn"), 1000),
+		Value: []byte("torn-value"),
+		Type:  data.LogRecordTxnFinished,
+	})
+	encRecord[len(encRecord)-1] ^= 0xff
+	appendTorn := func(fid uint32) []byte {
+		fileName := data.GetDataFileName(dir, fid)
+		content, err := os.ReadFile(fileName)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(fileName, append(content, encRecord...), 0644))
+		_ = os.Remove(data.GetDataHintFileName(dir, fid))
+		return content
+	}
+
+	// 已经切换过的文件末尾校验失败是数据损坏
+	content := appendTorn(0)
+	_, err = Open(opts)
+	assert.ErrorIs(t, err, data.ErrInvalidCRC)
+	assert.Nil(t, os.WriteFile(data.GetDataFileName(dir, 0), content, 0644))
+
+	// 最新的文件末尾写了一半的记录被截断，硬链接的文件保持不变
+	content = appendTorn(lastFid)
+	linkName := filepath.Join(dir, "backup-link")
+	assert.Nil(t, os.Link(data.GetDataFileName(dir, lastFid), linkName))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, len(db.ListKeys()))
+	assert.Nil(t, db.Close())
+	info, err := os.Stat(data.GetDataFileName(dir, lastFid))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), info.Size())
+	info, err = os.Stat(linkName)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)+len(encRecord)), info.Size())
+}
@@ -0,0 +1,178 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"slices"
+	"sort"
+	"sync/atomic"
+)
+
+// rangeTombstone 范围删除记录，删除 [start, end) 范围内的 key，end 为空表示没有上界
+type rangeTombstone struct {
+	start []byte
+	end   []byte
+	seqNo uint64
+}
+
+// tombstoneIndex 记录 key 空间中每一段被范围删除覆盖的最大序列号，加载索引时不需要逐个检查范围删除记录
+// [bounds[i], bounds[i+1]) 这一段的最大序列号为 seqNos[i]，最后一段没有上界，0 表示没有被覆盖
+// 被序列号更大的范围删除完全覆盖的记录不再保留
+type tombstoneIndex struct {
+	bounds [][]byte
+	seqNos []uint64
+}
+
+// maxSeqNo 返回覆盖 key 的范围删除中最大的序列号，没有被覆盖时返回 0
+func (ti *tombstoneIndex) maxSeqNo(key []byte) uint64 {
+	i := sort.Search(len(ti.bounds), func(i int) bool {
+		return bytes.Compare(ti.bounds[i], key) > 0
+	})
+	if i == 0 {
+		return 0
+	}
+	return ti.seqNos[i-1]
+}
+
+// add 添加一条范围删除记录
+func (ti *tombstoneIndex) add(rt *rangeTombstone) {
+	lo := ti.split(rt.start)
+	hi := len(ti.bounds)
+	if len(rt.end) > 0 {
+		hi = ti.split(rt.end)
+	}
+	for i := lo; i < hi; i++ {
+		if ti.seqNos[i] < rt.seqNo {
+			ti.seqNos[i] = rt.seqNo
+		}
+	}
+
+	// 合并相邻的序列号相同的段
+	n := 0
+	for i := range ti.bounds {
+		if n > 0 && ti.seqNos[n-1] == ti.seqNos[i] {
+			continue
+		}
+		ti.bounds[n], ti.seqNos[n] = ti.bounds[i], ti.seqNos[i]
+		n++
+	}
+	ti.bounds, ti.seqNos = ti.bounds[:n], ti.seqNos[:n]
+}
+
+// split 在 key 的位置切分，新的段继承所在段的序列号，返回以 key 开始的段的下标
+func (ti *tombstoneIndex) split(key []byte) int {
+	i := sort.Search(len(ti.bounds), func(i int) bool {
+		return bytes.Compare(ti.bounds[i], key) >= 0
+	})
+	if i < len(ti.bounds) && bytes.Equal(ti.bounds[i], key) {
+		return i
+	}
+	var seqNo uint64
+	if i > 0 {
+		seqNo = ti.seqNos[i-1]
+	}
+	ti.bounds = slices.Insert(ti.bounds, i, key)
+	ti.seqNos = slices.Insert(ti.seqNos, i, seqNo)
+	return i
+}
+
+// DeleteRange 原子地删除 [start, end) 范围内的所有 key，end 为空表示删除 start 之后的所有 key
+// 只会写入一条范围删除记录，而不是每个 key 一条删除记录
+// start 和 end 不能同时为空，避免误删全部的数据
+func (db *DB) DeleteRange(start []byte, end []byte) error {
+	if len(start) == 0 && len(end) == 0 {
+		return ErrUnboundedRange
+	}
+	if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+		return ErrInvalidRange
+	}
+	return db.deleteRange(start, end)
+}
+
+// DeletePrefix 原子地删除所有前缀为 prefix 的 key
+func (db *DB) DeletePrefix(prefix []byte) error {
+	if len(prefix) == 0 {
+		return ErrKeyIsEmpty
+	}
+	return db.deleteRange(prefix, prefixSuccessor(prefix))
+}
+
+func (db *DB) deleteRange(start []byte, end []byte) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	// 范围内的 key 可能分布在任意 slot 中，锁住全部 slot
+	slots := make([]uint32, len(db.mus))
+	for i := range slots {
+		slots[i] = uint32(i)
+	}
+	return db.writeSlots(slots, true, db.options.SyncWrites, func() (func(), error) {
+		return db.writeRangeTombstone(start, end)
+	})
+}
+
+// writeRangeTombstone 写入范围删除记录，返回从内存索引中删除范围内的 key 的函数，调用前需要持有全部 slot 的写锁
+func (db *DB) writeRangeTombstone(start []byte, end []byte) (func(), error) {
+	keys := db.keysInRange(start, end)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	seqNo := atomic.AddUint64(&db.seqNo, 1)
+	logRecord := &data.LogRecord{
+		Key:   logRecordKeyWithSeq(start, seqNo),
+		Value: end,
+		Type:  data.LogRecordRangeDeleted,
+	}
+	slot := db.hash(start)
+	pos, err := db.appendLogRecord(slot, logRecord)
+	if err != nil {
+		return nil, err
+	}
+	db.reclaimSize.Add(int64(pos.Size))
+
+	return func() {
+		// 从内存索引中删除范围内的 key
+		for _, key := range keys {
+			oldPos, ok := db.index.Delete(key)
+			if !ok {
+				continue
+			}
+			if oldPos != nil {
+				db.reclaimSize.Add(int64(oldPos.Size))
+			}
+			db.trackLive(nil, oldPos)
+			db.retainVersion(key, oldPos, seqNo)
+		}
+		db.publish(seqNo, []*WatchEntry{{Key: start, Value: end, Type: WatchDeleteRange}})
+	}, nil
+}
+
+// keysInRange 获取内存索引中 [start, end) 范围内的所有 key
+func (db *DB) keysInRange(start []byte, end []byte) [][]byte {
+	iterator := db.index.Iterator(false)
+	defer iterator.Close()
+
+	var keys [][]byte
+	for iterator.Seek(start); iterator.Valid(); iterator.Next() {
+		key := iterator.Key()
+		if len(end) > 0 && bytes.Compare(key, end) >= 0 {
+			break
+		}
+		// B+ 树迭代器返回的 key 在迭代器关闭后失效，需要拷贝一份
+		keys = append(keys, append([]byte(nil), key...))
+	}
+	return keys
+}
+
+// prefixSuccessor 获取大于所有以 prefix 为前缀的 key 的最小 key，不存在时返回 nil
+func prefixSuccessor(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_DeleteRange(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-delete-range")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+
+	// [10, 20) 被删除
+	err = db.DeleteRange(utils.GetTestKey(10), utils.GetTestKey(20))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(utils.GetTestKey(19))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(utils.GetTestKey(20))
+	assert.Nil(t, err)
+	assert.Equal(t, 90, len(db.ListKeys()))
+
+	err = db.DeleteRange(utils.GetTestKey(20), utils.GetTestKey(10))
+	assert.Equal(t, ErrInvalidRange, err)
+	// 不允许没有边界的范围删除
+	err = db.DeleteRange(nil, nil)
+	assert.Equal(t, ErrUnboundedRange, err)
+	assert.Equal(t, 90, len(db.ListKeys()))
+
+	// 范围删除之后重新写入
+	err = db.Put(utils.GetTestKey(15), []byte("new"))
+	assert.Nil(t, err)
+
+	// 重启之后依然有效
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 91, len(db2.ListKeys()))
+	_, err = db2.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db2.Get(utils.GetTestKey(15))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+	err = db2.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_DeletePrefix(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-delete-prefix")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put([]byte("user:"+string(utils.GetTestKey(i))), utils.RandomValue(24)))
+		assert.Nil(t, db.Put([]byte("order:"+string(utils.GetTestKey(i))), utils.RandomValue(24)))
+	}
+
+	err = db.DeletePrefix([]byte("user:"))
+	assert.Nil(t, err)
+	iter := db.NewIterator(IteratorOptions{Prefix: []byte("user:")})
+	iter.Rewind()
+	assert.False(t, iter.Valid())
+	iter.Close()
+	assert.Equal(t, 100, len(db.ListKeys()))
+
+	err = db.DeletePrefix(nil)
+	assert.Equal(t, ErrKeyIsEmpty, err)
+
+	// merge 之后被删除的数据被清理
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(db2.ListKeys()))
+	assert.Equal(t, int64(0), db2.Stat().ReclaimableSize)
+	err = db2.Close()
+	assert.Nil(t, err)
+}
+
+func TestPrefixSuccessor(t *testing.T) {
+	assert.Equal(t, []byte("abd"), prefixSuccessor([]byte("abc")))
+	assert.Equal(t, []byte{'a', 'c'}, prefixSuccessor([]byte{'a', 'b', 0xff}))
+	assert.Nil(t, prefixSuccessor([]byte{0xff, 0xff}))
+}
+
+func TestTombstoneIndex(t *testing.T) {
+	var ti tombstoneIndex
+	assert.Equal(t, uint64(0), ti.maxSeqNo([]byte("a")))
+
+	ti.add(&rangeTombstone{start: []byte("b"), end: []byte("d"), seqNo: 5})
+	ti.add(&rangeTombstone{start: []byte("c"), end: []byte("f"), seqNo: 3})
+	ti.add(&rangeTombstone{start: []byte("x"), seqNo: 7})
+	assert.Equal(t, uint64(0), ti.maxSeqNo([]byte("a")))
+	assert.Equal(t, uint64(5), ti.maxSeqNo([]byte("b")))
+	assert.Equal(t, uint64(5), ti.maxSeqNo([]byte("cc")))
+	assert.Equal(t, uint64(3), ti.maxSeqNo([]byte("d")))
+	assert.Equal(t, uint64(0), ti.maxSeqNo([]byte("f")))
+	assert.Equal(t, uint64(7), ti.maxSeqNo([]byte("zzz")))
+
+	// 被序列号更大的范围删除完全覆盖的记录不再保留
+	ti.add(&rangeTombstone{start: []byte("a"), end: []byte("g"), seqNo: 9})
+	assert.Equal(t, 3, len(ti.bounds))
+	assert.Equal(t, uint64(9), ti.maxSeqNo([]byte("c")))
+	assert.Equal(t, uint64(0), ti.maxSeqNo([]byte("h")))
+	assert.Equal(t, uint64(7), ti.maxSeqNo([]byte("x")))
+
+	// 没有下界的范围删除
+	ti.add(&rangeTombstone{end: []byte("b"), seqNo: 10})
+	assert.Equal(t, uint64(10), ti.maxSeqNo(nil))
+	assert.Equal(t, uint64(10), ti.maxSeqNo([]byte("a")))
+	assert.Equal(t, uint64(9), ti.maxSeqNo([]byte("b")))
+}
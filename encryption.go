@@ -0,0 +1,208 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// KeyProvider 提供加密数据使用的密钥，密钥长度为 16、24 或 32 字节，分别对应 AES-128、AES-192、AES-256
+// 每条记录中保存了加密使用的密钥 id，轮换密钥时新的数据使用新的密钥，旧的密钥需要保留到 merge 重写完所有数据为止
+type KeyProvider interface {
+	// CurrentKey 加密新写入的数据使用的密钥及其 id
+	CurrentKey() (uint32, []byte, error)
+
+	// Key 根据 id 取出解密使用的密钥，不存在时返回 ErrEncryptionKeyNotFound
+	Key(id uint32) ([]byte, error)
+}
+
+// staticKeyProvider 使用固定的一组密钥，id 最大的密钥用于加密新的数据
+type staticKeyProvider struct {
+	keys      map[uint32][]byte
+	currentId uint32
+}
+
+// NewStaticKeyProvider 使用给定的一组密钥，id 最大的密钥用于加密新的数据
+func NewStaticKeyProvider(keys map[uint32][]byte) (KeyProvider, error) {
+	if len(keys) == 0 {
+		return nil, ErrEncryptionKeyNotFound
+	}
+	provider := &staticKeyProvider{keys: make(map[uint32][]byte, len(keys))}
+	for id, key := range keys {
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %w", id, err)
+		}
+		provider.keys[id] = append([]byte(nil), key...)
+		if id > provider.currentId {
+			provider.currentId = id
+		}
+	}
+	return provider, nil
+}
+
+// NewFileKeyProvider 从文件中读取密钥，格式见 ParseEncryptionKeys
+func NewFileKeyProvider(path string) (KeyProvider, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParseEncryptionKeys(string(content))
+	if err != nil {
+		return nil, err
+	}
+	return NewStaticKeyProvider(keys)
+}
+
+// NewEnvKeyProvider 从环境变量 name 中读取密钥，格式见 ParseEncryptionKeys
+func NewEnvKeyProvider(name string) (KeyProvider, error) {
+	keys, err := ParseEncryptionKeys(os.Getenv(name))
+	if err != nil {
+		return nil, err
+	}
+	return NewStaticKeyProvider(keys)
+}
+
+// ParseEncryptionKeys 解析 "id:十六进制密钥" 格式的密钥，多个密钥之间使用换行或者逗号分隔，# 开头的行是注释
+func ParseEncryptionKeys(s string) (map[uint32][]byte, error) {
+	keys := make(map[uint32][]byte)
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idStr, keyStr, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid encryption key entry %q", line)
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(idStr), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key id %q: %w", idStr, err)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(keyStr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %w", id, err)
+		}
+		keys[uint32(id)] = key
+	}
+	return keys, nil
+}
+
+func (p *staticKeyProvider) CurrentKey() (uint32, []byte, error) {
+	return p.currentId, p.keys[p.currentId], nil
+}
+
+func (p *staticKeyProvider) Key(id uint32) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, ErrEncryptionKeyNotFound
+	}
+	return key, nil
+}
+
+// aesGCMCipher 使用 AES-GCM 加密记录，加密之后的格式为：
+// +------------+-----------+------------------+
+// /  密钥 id    /  nonce     /  密文和认证标签     /
+// +------------+-----------+------------------+
+//
+//	4字节        12字节        变长
+//
+// 记录所在的文件 id、位置和 header 作为 GCM 的附加数据参与认证，密文被挪到其他位置或者 header 被篡改时解密失败
+type aesGCMCipher struct {
+	provider KeyProvider
+	mu       sync.RWMutex
+	aeads    map[uint32]cipher.AEAD // 每个密钥 id 对应的 AEAD，避免每条记录都重新初始化
+}
+
+func newAESGCMCipher(provider KeyProvider) (*aesGCMCipher, error) {
+	c := &aesGCMCipher{provider: provider, aeads: make(map[uint32]cipher.AEAD)}
+	// 提前检查当前的密钥是否可用
+	id, key, err := provider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.aead(id, key); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// aead 获取密钥 id 对应的 AEAD，key 为空时从 provider 中取出密钥
+func (c *aesGCMCipher) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	c.mu.RLock()
+	aead, ok := c.aeads[id]
+	c.mu.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	if key == nil {
+		var err error
+		if key, err = c.provider.Key(id); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.aeads[id] = aead
+	c.mu.Unlock()
+	return aead, nil
+}
+
+func (c *aesGCMCipher) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	id, key, err := c.provider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 4+aead.NonceSize(), 4+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	binary.BigEndian.PutUint32(out, id)
+	nonce := out[4:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, plaintext, additionalData), nil
+}
+
+func (c *aesGCMCipher) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < 4 {
+		return nil, ErrDecryptFailed
+	}
+	aead, err := c.aead(binary.BigEndian.Uint32(ciphertext), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < 4+aead.NonceSize() {
+		return nil, ErrDecryptFailed
+	}
+	nonce := ciphertext[4 : 4+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, ciphertext[4+aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return plaintext, nil
+}
+
+// newCipher 根据配置项创建加密数据使用的 cipher，没有开启加密时返回 nil
+func newCipher(options Options) (data.Cipher, error) {
+	if options.Encryption == nil {
+		return nil, nil
+	}
+	return newAESGCMCipher(options.Encryption)
+}
@@ -0,0 +1,223 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// containsInDir 数据目录中是否有文件包含 content
+func containsInDir(t *testing.T, dir string, content []byte) bool {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		fileContent, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		assert.Nil(t, err)
+		if bytes.Contains(fileContent, content) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDB_Encryption(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024
+	opts.DataFileMergeRatio = 0
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 16)
+	provider, err := NewStaticKeyProvider(map[uint32][]byte{1: key1})
+	assert.Nil(t, err)
+	opts.Encryption = provider
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	secret := []byte("secret-value-of-some-user")
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), secret))
+	}
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("batch-key"), secret))
+	assert.Nil(t, wb.Commit())
+	db.bgWg.Wait()
+	assert.Nil(t, db.Close())
+
+	// 数据文件和 hint 文件中都没有明文
+	hints, _ := filepath.Glob(filepath.Join(dir, "*"+data.DataHintFileSuffix))
+	assert.Greater(t, len(hints), 0)
+	assert.False(t, containsInDir(t, dir, secret))
+	assert.False(t, containsInDir(t, dir, utils.GetTestKey(999)))
+
+	// 离线检查同样需要密钥
+	_, err = Verify(dir)
+	assert.Equal(t, data.ErrNoCipher, err)
+	report, err := VerifyWithKeys(dir, provider)
+	assert.Nil(t, err)
+	assert.True(t, report.OK)
+	wrongKeys, _ := NewStaticKeyProvider(map[uint32][]byte{1: key2})
+	_, err = VerifyWithKeys(dir, wrongKeys)
+	assert.Equal(t, ErrDecryptFailed, err)
+
+	// 没有密钥无法打开
+	noKeyOpts := opts
+	noKeyOpts.Encryption = nil
+	_, err = Open(noKeyOpts)
+	assert.Equal(t, data.ErrNoCipher, err)
+
+	// 轮换密钥，旧的数据使用旧的密钥读取，新的数据使用新的密钥
+	provider, err = NewStaticKeyProvider(map[uint32][]byte{1: key1, 2: key2})
+	assert.Nil(t, err)
+	opts.Encryption = provider
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.Equal(t, secret, val)
+	assert.Nil(t, db.Put([]byte("new-key"), []byte("new-value")))
+
+	// merge 之后所有数据都使用新的密钥加密，merge 生成的 hint 文件同样加密
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	provider, err = NewStaticKeyProvider(map[uint32][]byte{2: key2})
+	assert.Nil(t, err)
+	opts.Encryption = provider
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.False(t, containsInDir(t, dir, utils.GetTestKey(999)))
+
+	assert.Equal(t, 802, len(db.ListKeys()))
+	for _, key := range [][]byte{utils.GetTestKey(999), []byte("batch-key")} {
+		val, err := db.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, secret, val)
+	}
+	val, err = db.Get([]byte("new-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new-value"), val)
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Close())
+
+	// 错误的密钥
+	provider, err = NewStaticKeyProvider(map[uint32][]byte{2: key1})
+	assert.Nil(t, err)
+	opts.Encryption = provider
+	_, err = Open(opts)
+	assert.Equal(t, ErrDecryptFailed, err)
+
+	// 修复时使用同样的密钥解密和重新加密
+	opts.Encryption, _ = NewStaticKeyProvider(map[uint32][]byte{2: key2})
+	repairDir, _ := os.MkdirTemp("", "bitcask-go-encryption-repair")
+	defer func() {
+		_ = os.RemoveAll(repairDir)
+	}()
+	repairOpts := opts
+	repairOpts.DirPath = repairDir
+	_, err = Repair(dir, repairOpts)
+	assert.Nil(t, err)
+	assert.False(t, containsInDir(t, repairDir, secret))
+	repaired, err := Open(repairOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 802, len(repaired.ListKeys()))
+	assert.Nil(t, repaired.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+}
+
+func TestDB_EncryptionMovedRecord(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption-moved")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.Slots = 1
+	provider, err := NewStaticKeyProvider(map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)})
+	assert.Nil(t, err)
+	opts.Encryption = provider
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	db.bgWg.Wait()
+	assert.Nil(t, db.Close())
+
+	// 用其他数据文件的内容替换，crc 依然正确，但是记录和所在的文件 id 不匹配
+	dataFiles, _ := filepath.Glob(filepath.Join(dir, "*"+data.DataFileNameSuffix))
+	assert.Greater(t, len(dataFiles), 2)
+	content, err := os.ReadFile(dataFiles[0])
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(dataFiles[1], content, 0644))
+	hints, _ := filepath.Glob(filepath.Join(dir, "*"+data.DataHintFileSuffix))
+	for _, hint := range hints {
+		assert.Nil(t, os.Remove(hint))
+	}
+	db, err = Open(opts)
+	assert.Equal(t, ErrDecryptFailed, err)
+}
+
+func TestKeyProvider(t *testing.T) {
+	keys, err := ParseEncryptionKeys("# keys\n1:" + strings.Repeat("01", 16) + "\n 3 : " + strings.Repeat("ab", 32) + ",2:" + strings.Repeat("02", 24))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(keys))
+	assert.Equal(t, bytes.Repeat([]byte{0xab}, 32), keys[3])
+
+	_, err = ParseEncryptionKeys("1-" + strings.Repeat("01", 16))
+	assert.NotNil(t, err)
+	_, err = ParseEncryptionKeys("1:zz")
+	assert.NotNil(t, err)
+
+	// 密钥长度不合法
+	_, err = NewStaticKeyProvider(map[uint32][]byte{1: []byte("short")})
+	assert.NotNil(t, err)
+	_, err = NewStaticKeyProvider(nil)
+	assert.Equal(t, ErrEncryptionKeyNotFound, err)
+
+	// 从文件中读取，id 最大的密钥用于加密
+	fileName := filepath.Join(t.TempDir(), "keys")
+	assert.Nil(t, os.WriteFile(fileName, []byte("1:"+strings.Repeat("01", 16)+"\n2:"+strings.Repeat("02", 16)+"\n"), 0600))
+	provider, err := NewFileKeyProvider(fileName)
+	assert.Nil(t, err)
+	id, key, err := provider.CurrentKey()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), id)
+	assert.Equal(t, bytes.Repeat([]byte{2}, 16), key)
+	key, err = provider.Key(1)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{1}, 16), key)
+	_, err = provider.Key(3)
+	assert.Equal(t, ErrEncryptionKeyNotFound, err)
+
+	// 从环境变量中读取
+	t.Setenv("BITCASK_TEST_KEYS", "7:"+strings.Repeat("07", 32))
+	provider, err = NewEnvKeyProvider("BITCASK_TEST_KEYS")
+	assert.Nil(t, err)
+	id, _, err = provider.CurrentKey()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(7), id)
+
+	// B+ 树索引不支持加密
+	opts := DefaultOptions
+	opts.DirPath = t.TempDir()
+	opts.IndexType = BPlusTree
+	opts.Encryption = provider
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
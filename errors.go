@@ -13,4 +13,21 @@ var (
 	ErrDatabaseIsUsing        = errors.New("the database directory is used by another process")
 	ErrMergeRatioUnreached    = errors.New("the merge ratio do not reach the option")
 	ErrNoEnoughSpaceForMerge  = errors.New("no enough disk space for merge")
+	ErrInvalidTTL             = errors.New("the ttl must not be negative")
+	ErrSnapshotReleased       = errors.New("the snapshot has been released")
+	ErrTxnConflict            = errors.New("transaction conflict, keys read have been modified")
+	ErrInvalidRange           = errors.New("the start key must be less than the end key")
+	ErrUnboundedRange         = errors.New("the range must have a start key or an end key")
+	ErrTxnFinished            = errors.New("the transaction has been committed or rolled back")
+	ErrMergeFileIdExhausted   = errors.New("merge output exceeds the reserved file ids")
+	ErrRepairDirNotEmpty      = errors.New("the directory to write repaired data is not empty")
+	ErrRestoreDirNotEmpty     = errors.New("the directory to restore data is not empty")
+	ErrBackupNotFound         = errors.New("no finished backup is found")
+	ErrBackupChainBroken      = errors.New("the backup chain is broken, some backups are missing")
+	ErrReadOnly               = errors.New("the database is opened in read only mode")
+	ErrUnknownCompression     = errors.New("the value is compressed by an unknown compressor")
+	ErrEncryptionKeyNotFound  = errors.New("the encryption key is not found")
+	ErrDecryptFailed          = errors.New("failed to decrypt the log record, the encryption key maybe wrong")
+	ErrBlobGCIsProgress       = errors.New("blob gc is in progress, try again later")
+	ErrDatabaseClosed         = errors.New("the database is closed")
 )
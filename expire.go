@@ -0,0 +1,99 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// runExpireSweeper 后台定期清理过期的 key，直到数据库关闭
+func (db *DB) runExpireSweeper() {
+	defer db.bgWg.Done()
+
+	ticker := time.NewTicker(db.options.ExpireSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			if _, err := db.sweepExpired(); err != nil {
+				log.Printf("failed to sweep expired keys: %v\n", err)
+			}
+		}
+	}
+}
+
+// sweepExpired 从上一轮结束的位置开始，抽样检查 ExpireSweepSamples 个 key，
+// 为其中已经过期的 key 写入删除记录并从内存索引中移除，返回清理的 key 数量
+func (db *DB) sweepExpired() (int, error) {
+	iterator := db.index.Iterator(false)
+	if db.sweepCursor == nil {
+		iterator.Rewind()
+	} else {
+		iterator.Seek(db.sweepCursor)
+	}
+
+	now := time.Now().UnixNano()
+	var expiredKeys [][]byte
+	for n := 0; iterator.Valid() && n < db.options.ExpireSweepSamples; n++ {
+		if iterator.Value().IsExpired(now) {
+			// B+ 树迭代器返回的 key 在迭代器关闭后失效，需要拷贝一份
+			expiredKeys = append(expiredKeys, append([]byte(nil), iterator.Key()...))
+		}
+		iterator.Next()
+	}
+
+	// 记录下一轮开始的位置，遍历到末尾后从头开始
+	db.sweepCursor = nil
+	if iterator.Valid() {
+		db.sweepCursor = append([]byte(nil), iterator.Key()...)
+	}
+	iterator.Close()
+
+	var count int
+	for _, key := range expiredKeys {
+		ok, err := db.deleteExpired(key, now)
+		if err != nil {
+			return count, err
+		}
+		if ok {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// deleteExpired 为已经过期的 key 写入一条删除记录，返回是否真正删除了
+// 检查、写入删除记录和更新索引都在 slot 的写锁内进行，期间 key 不会被重新写入
+func (db *DB) deleteExpired(key []byte, now int64) (bool, error) {
+	slot := db.hash(key)
+	db.mus[slot].Lock()
+	defer db.mus[slot].Unlock()
+
+	// 抽样之后 key 可能被重新写入，需要再次检查
+	oldPos := db.index.Get(key)
+	if oldPos == nil || !oldPos.IsExpired(now) {
+		return false, nil
+	}
+
+	seqNo := atomic.AddUint64(&db.seqNo, 1)
+	logRecord := &data.LogRecord{
+		Key:  logRecordKeyWithSeq(key, seqNo),
+		Type: data.LogRecordDeleted,
+	}
+	pos, err := db.appendLogRecord(slot, logRecord)
+	if err != nil {
+		return false, err
+	}
+	db.reclaimSize.Add(int64(pos.Size))
+
+	if oldPos, ok := db.index.Delete(key); ok && oldPos != nil {
+		db.reclaimSize.Add(int64(oldPos.Size))
+		db.trackLive(nil, oldPos)
+	}
+	db.publish(seqNo, []*WatchEntry{{Key: key, Type: WatchDelete}})
+	return true, nil
+}
@@ -0,0 +1,117 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_ExpireSweeper(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-expire-sweeper")
+	opts.DirPath = dir
+	opts.ExpireSweepInterval = 20 * time.Millisecond
+	opts.ExpireSweepSamples = 100
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 500; i++ {
+		err := db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(24), 50*time.Millisecond)
+		assert.Nil(t, err)
+	}
+	for i := 500; i < 600; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, uint(600), db.Stat().KeyNum)
+
+	// 每轮抽样 100 个，需要多轮才能清理完
+	time.Sleep(500 * time.Millisecond)
+	stat := db.Stat()
+	assert.Equal(t, uint(100), stat.KeyNum)
+	assert.Greater(t, stat.ReclaimableSize, int64(0))
+
+	// 关闭之后重启，过期的 key 不会再出现
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(100), db2.Stat().KeyNum)
+	err = db2.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_sweepExpired(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sweep-expired")
+	opts.DirPath = dir
+	opts.ExpireSweepSamples = 10
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 15; i++ {
+		err := db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(24), time.Millisecond)
+		assert.Nil(t, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	n, err := db.sweepExpired()
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	n, err = db.sweepExpired()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, 0, db.index.Size())
+}
+
+func TestDB_sweepExpiredConcurrentPut(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sweep-expired-put")
+	opts.DirPath = dir
+	opts.ExpireSweepSamples = 1000
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.PutWithTTL(utils.GetTestKey(i), []byte("old"), time.Millisecond))
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// 清理和重新写入同时进行，重新写入的 key 不能被清理掉
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("new")))
+			if i%100 == 0 {
+				db.Stat()
+			}
+		}
+	}()
+	for {
+		_, err := db.sweepExpired()
+		assert.Nil(t, err)
+		select {
+		case <-done:
+		default:
+			continue
+		}
+		break
+	}
+	_, err = db.sweepExpired()
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new"), val)
+	}
+}
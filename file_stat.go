@@ -0,0 +1,97 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"sort"
+)
+
+// FileStat 单个数据文件的统计信息
+type FileStat struct {
+	FileId    uint32 // 数据文件 id
+	Size      int64  // 数据文件的大小
+	LiveBytes int64  // 有效数据的字节数
+	DeadBytes int64  // 无效数据的字节数，可以被 merge 回收
+}
+
+// DeadRatio 无效数据的占比
+func (fs *FileStat) DeadRatio() float64 {
+	if fs.Size == 0 {
+		return 0
+	}
+	return float64(fs.DeadBytes) / float64(fs.Size)
+}
+
+// FileStats 返回每个数据文件的有效和无效数据量，按照文件 id 从小到大排序
+func (db *DB) FileStats() ([]*FileStat, error) {
+	for slot := range db.mus {
+		db.mus[slot].RLock()
+	}
+	defer func() {
+		for i := len(db.mus) - 1; i >= 0; i-- {
+			db.mus[i].RUnlock()
+		}
+	}()
+	return db.fileStats()
+}
+
+// fileStats 统计每个数据文件的有效和无效数据量，调用时需要持有全部 slot 的锁
+// 文件中除了有效数据之外的部分都是无效的，包括被覆盖的数据、删除记录和事务完成记录等
+func (db *DB) fileStats() ([]*FileStat, error) {
+	sizes := make(map[uint32]int64)
+	for _, file := range db.olderFiles {
+		size, err := file.IoManager.Size()
+		if err != nil {
+			return nil, err
+		}
+		sizes[file.FileId] = size
+	}
+	for _, file := range db.activeFiles {
+		if file != nil {
+			sizes[file.FileId] = file.WriteOff
+		}
+	}
+
+	db.statMu.Lock()
+	defer db.statMu.Unlock()
+	stats := make([]*FileStat, 0, len(sizes))
+	for fid, size := range sizes {
+		live := db.liveBytes[fid]
+		stats = append(stats, &FileStat{
+			FileId:    fid,
+			Size:      size,
+			LiveBytes: live,
+			DeadBytes: size - live,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].FileId < stats[j].FileId
+	})
+	return stats, nil
+}
+
+// trackLive 内存索引更新之后，统计 pos 对应的数据变为有效，oldPos 对应的数据变为无效
+func (db *DB) trackLive(pos *data.LogRecordPos, oldPos *data.LogRecordPos) {
+	db.statMu.Lock()
+	defer db.statMu.Unlock()
+	if pos != nil {
+		db.liveBytes[pos.Fid] += int64(pos.Size)
+		if pos.BlobSize > 0 {
+			db.blobLive[pos.BlobFid] += int64(pos.BlobSize)
+		}
+	}
+	if oldPos != nil {
+		db.liveBytes[oldPos.Fid] -= int64(oldPos.Size)
+		if oldPos.BlobSize > 0 {
+			db.blobLive[oldPos.BlobFid] -= int64(oldPos.BlobSize)
+		}
+	}
+}
+
+// loadLiveBytes 遍历内存索引，统计每个数据文件中有效数据的字节数
+func (db *DB) loadLiveBytes() {
+	iterator := db.index.Iterator(false)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		db.trackLive(iterator.Value(), nil)
+	}
+}
@@ -0,0 +1,67 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_FileStats(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-stats")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	stats, err := db.FileStats()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(stats))
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 1000; i < 1500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 1500; i < 1600; i++ {
+		assert.Nil(t, wb.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, wb.Commit())
+
+	// 有效数据量等于内存索引中所有数据的大小
+	var liveSize int64
+	for _, key := range db.ListKeys() {
+		liveSize += int64(db.index.Get(key).Size)
+	}
+	stats, err = db.FileStats()
+	assert.Nil(t, err)
+	var totalLive, totalSize int64
+	for _, stat := range stats {
+		assert.GreaterOrEqual(t, stat.LiveBytes, int64(0))
+		assert.Equal(t, stat.Size, stat.LiveBytes+stat.DeadBytes)
+		totalLive += stat.LiveBytes
+		totalSize += stat.Size
+	}
+	assert.Equal(t, liveSize, totalLive)
+	assert.Greater(t, totalSize, totalLive)
+
+	// 重启之后统计信息保持一致
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	stats2, err := db2.FileStats()
+	assert.Nil(t, err)
+	assert.Equal(t, stats, stats2)
+	err = db2.Close()
+	assert.Nil(t, err)
+}
@@ -0,0 +1,236 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"sort"
+	"sync"
+)
+
+// fileSyncer 记录活跃文件已经持久化到的位置，并合并多个写入者对同一个活跃文件的 Sync 调用
+// 等待的写入者中由一个 leader 调用 Sync，一次 Sync 持久化这之前所有写入者写入的数据，之后唤醒所有等待的写入者
+type fileSyncer struct {
+	file    *data.DataFile
+	mu      sync.Mutex
+	cond    *sync.Cond
+	synced  int64 // 已经持久化到的位置
+	pending int64 // 等待持久化的最大位置
+	syncing bool  // 是否有 leader 正在 Sync
+}
+
+func newFileSyncer(file *data.DataFile) *fileSyncer {
+	s := &fileSyncer{file: file}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// wait 等待文件中 end 之前的数据持久化，没有 leader 时自己成为 leader 调用 Sync
+func (s *fileSyncer) wait(end int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if end > s.pending {
+		s.pending = end
+	}
+	for s.synced < end {
+		if s.syncing {
+			s.cond.Wait()
+			continue
+		}
+
+		// 成为 leader，持久化目前所有等待者写入的数据，Sync 期间新的写入者继续追加，等待下一轮
+		s.syncing = true
+		target := s.pending
+		s.mu.Unlock()
+		err := s.file.Sync()
+		s.mu.Lock()
+		s.syncing = false
+		if err == nil && target > s.synced {
+			s.synced = target
+		}
+		// 失败时唤醒其他等待者，由下一个 leader 重试
+		s.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markSynced 持有 slot 的锁直接 Sync 了整个文件之后，唤醒等待 end 之前数据的写入者
+func (s *fileSyncer) markSynced(end int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if end > s.synced {
+		s.synced = end
+		s.cond.Broadcast()
+	}
+}
+
+// commitRequest 一次写入，由 group commit 的 leader 持有涉及的 slot 的写锁时执行
+type commitRequest struct {
+	slots []uint32 // 涉及的 slot
+	reads bool     // 写入之前需要读取 key 当前的状态，组内之前的写入需要先持久化并更新内存索引
+	sync  bool     // 是否需要等待持久化
+
+	// write 追加记录，返回更新内存索引、通知订阅者的函数，没有写入时返回 nil
+	// 需要持久化的写入在数据持久化之后才执行返回的函数，读者和订阅者不会看到没有持久化的数据
+	write func() (func(), error)
+
+	err  error
+	done bool
+}
+
+// commitQueue 等待 group commit 的写入者，队首的写入者成为 leader，一次提交队列中已有的全部写入
+type commitQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	requests []*commitRequest
+}
+
+func newCommitQueue() *commitQueue {
+	q := &commitQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// writeSlot 持有 slot 的写锁执行写入，reads 见 commitRequest
+func (db *DB) writeSlot(slot uint32, reads bool, write func() (func(), error)) error {
+	return db.writeSlots([]uint32{slot}, reads, db.options.SyncWrites, write)
+}
+
+// writeSlots 持有 slots 的写锁执行写入，需要持久化时加入 group commit，
+// 和其他写入者一起由 leader 写入，合并到同一次 Sync 中，持久化之后才更新内存索引
+func (db *DB) writeSlots(slots []uint32, reads bool, syncWrites bool, write func() (func(), error)) error {
+	if !syncWrites {
+		for _, slot := range slots {
+			db.mus[slot].Lock()
+		}
+		defer func() {
+			for i := len(slots) - 1; i >= 0; i-- {
+				db.mus[slots[i]].Unlock()
+			}
+		}()
+		apply, err := write()
+		if err == nil && apply != nil {
+			apply()
+		}
+		return err
+	}
+
+	req := &commitRequest{slots: slots, reads: reads, sync: true, write: write}
+	q := db.commits
+	q.mu.Lock()
+	q.requests = append(q.requests, req)
+	for !req.done && q.requests[0] != req {
+		q.cond.Wait()
+	}
+	if req.done {
+		q.mu.Unlock()
+		return req.err
+	}
+
+	// 成为 leader，提交队列中已有的全部写入，提交期间新来的写入者等待下一轮
+	group := q.requests
+	q.mu.Unlock()
+	db.commitGroup(group)
+
+	q.mu.Lock()
+	for _, r := range group {
+		r.done = true
+	}
+	q.requests = q.requests[len(group):]
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	return req.err
+}
+
+// commitGroup 持有一组写入涉及的全部 slot 的写锁，依次追加记录，之后每个活跃文件只 Sync 一次，再依次更新内存索引
+// 持有锁直到更新完内存索引，同一个 slot 的读者和写入者看到的都是已经持久化的数据
+func (db *DB) commitGroup(group []*commitRequest) {
+	slotSet := make(map[uint32]struct{})
+	for _, req := range group {
+		for _, slot := range req.slots {
+			slotSet[slot] = struct{}{}
+		}
+	}
+	slots := make([]uint32, 0, len(slotSet))
+	for slot := range slotSet {
+		slots = append(slots, slot)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+	for _, slot := range slots {
+		db.mus[slot].Lock()
+	}
+	defer func() {
+		for i := len(slots) - 1; i >= 0; i-- {
+			db.mus[slots[i]].Unlock()
+		}
+	}()
+
+	var written []*commitRequest
+	var applies []func()
+	// flush 持久化之前追加的记录，成功之后按照写入的顺序更新内存索引
+	flush := func() {
+		var syncErr error
+		for _, req := range written {
+			if req.sync {
+				syncErr = db.syncSlots(slots)
+				break
+			}
+		}
+		for i, req := range written {
+			// 不需要持久化的写入即使 Sync 失败也和单独写入时一样生效
+			if syncErr != nil && req.sync {
+				req.err = syncErr
+				continue
+			}
+			applies[i]()
+		}
+		written, applies = nil, nil
+	}
+	for _, req := range group {
+		if req.reads && len(written) > 0 {
+			flush()
+		}
+		apply, err := req.write()
+		if err != nil {
+			req.err = err
+			continue
+		}
+		if apply != nil {
+			written = append(written, req)
+			applies = append(applies, apply)
+		}
+	}
+	flush()
+}
+
+// syncSlots 持久化 slots 的活跃文件中已经写入的数据，调用前需要持有 slots 的写锁
+func (db *DB) syncSlots(slots []uint32) error {
+	if len(slots) == 1 {
+		if db.activeFiles[slots[0]] == nil {
+			return nil
+		}
+		return db.syncers[slots[0]].wait(db.activeFiles[slots[0]].WriteOff)
+	}
+
+	// 不同 slot 的活跃文件并发地 Sync
+	var wg sync.WaitGroup
+	errs := make([]error, len(slots))
+	for i, slot := range slots {
+		if db.activeFiles[slot] == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, syncer *fileSyncer, end int64) {
+			defer wg.Done()
+			errs[i] = syncer.wait(end)
+		}(i, db.syncers[slot], db.activeFiles[slot].WriteOff)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package bitcask_go
+
+import (
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingIOManager 统计 Sync 的次数，每次 Sync 模拟磁盘的延迟
+type countingIOManager struct {
+	fio.IOManager
+	syncs atomic.Int64
+}
+
+func (m *countingIOManager) Sync() error {
+	m.syncs.Add(1)
+	time.Sleep(2 * time.Millisecond)
+	return m.IOManager.Sync()
+}
+
+func TestDB_GroupCommit(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit")
+	opts.DirPath = dir
+	opts.SyncWrites = true
+	opts.Slots = 1
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("first"), []byte("value")))
+	ioManager := &countingIOManager{IOManager: db.activeFiles[0].IoManager}
+	db.activeFiles[0].IoManager = ioManager
+
+	// 并发的写入合并到少数几次 Sync 中
+	const writers = 64
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%4 == 0 {
+				wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+				assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+				assert.Nil(t, wb.Commit())
+				return
+			}
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+		}(i)
+	}
+	wg.Wait()
+	assert.Less(t, ioManager.syncs.Load(), int64(writers))
+	assert.Greater(t, ioManager.syncs.Load(), int64(0))
+
+	// 返回之后数据已经持久化
+	assert.Equal(t, db.activeFiles[0].WriteOff, db.syncers[0].synced)
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < writers; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+// failingIOManager Sync 总是失败
+type failingIOManager struct {
+	fio.IOManager
+}
+
+func (m *failingIOManager) Sync() error {
+	return errors.New("sync failed")
+}
+
+func TestDB_GroupCommitSyncFailed(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit-failed")
+	opts.DirPath = dir
+	opts.SyncWrites = true
+	opts.Slots = 1
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("first"), []byte("value")))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := db.Watch(ctx, nil)
+	assert.Nil(t, err)
+
+	// 持久化失败的写入不会被读到，也不会通知订阅者
+	ioManager := db.activeFiles[0].IoManager
+	db.activeFiles[0].IoManager = &failingIOManager{IOManager: ioManager}
+	assert.NotNil(t, db.Put([]byte("key"), []byte("value")))
+	_, err = db.Get([]byte("key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.NotNil(t, db.Delete([]byte("first")))
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("batch"), []byte("value")))
+	assert.NotNil(t, wb.Commit())
+	_, err = db.Get([]byte("batch"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.Get([]byte("first"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	select {
+	case event := <-ch:
+		t.Fatalf("unexpected event %d", event.SeqNo)
+	default:
+	}
+
+	db.activeFiles[0].IoManager = ioManager
+	assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+	val, err = db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	event := receiveEvents(t, ch, 1)[0]
+	assert.Equal(t, []byte("key"), event.Entries[0].Key)
+}
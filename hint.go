@@ -0,0 +1,316 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// errHintAborted 数据库关闭，停止写入 hint 文件
+var errHintAborted = errors.New("writing hint file is aborted")
+
+// truncateFileSuffix 截断数据文件时临时文件的后缀
+const truncateFileSuffix = ".truncate"
+
+// hintEntry 数据文件的 hint 文件中的一条记录
+type hintEntry struct {
+	record *data.LogRecord
+	pos    *data.LogRecordPos
+}
+
+// writeHintInBackground 在后台为不再写入的数据文件生成 hint 文件，加快下次启动时加载索引的速度
+// B+ 树索引不需要从数据文件中加载，也就不需要 hint 文件，只读实例不写入任何文件
+func (db *DB) writeHintInBackground(dataFile *data.DataFile) {
+	if db.options.IndexType == BPlusTree || db.options.ReadOnly {
+		return
+	}
+	select {
+	case <-db.closeCh:
+		return
+	default:
+	}
+
+	db.bgWg.Add(1)
+	go func() {
+		defer db.bgWg.Done()
+		if err := db.writeDataHintFile(dataFile); err != nil {
+			// 删除没有写完的 hint 文件，下次启动时从数据文件中加载
+			_ = db.removeDataHintFile(dataFile.FileId)
+			if err != errHintAborted {
+				log.Printf("failed to write hint file of data file %d: %v\n", dataFile.FileId, err)
+			}
+		}
+	}()
+}
+
+// writeDataHintFile 为数据文件生成 hint 文件，保存每条记录的 key、类型、位置信息，
+// 事务完成记录和范围删除记录还需要保存 value，最后写入一条结束记录，没有结束记录的 hint 文件是无效的
+func (db *DB) writeDataHintFile(dataFile *data.DataFile) error {
+	hintFileName := data.GetDataHintFileName(db.options.DirPath, dataFile.FileId)
+	if err := os.Remove(hintFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	hintFile, err := data.OpenDataHintFile(db.options.DirPath, dataFile.FileId)
+	if err != nil {
+		return err
+	}
+	hintFile.Cipher = db.cipher
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	var offset int64 = 0
+	for {
+		select {
+		case <-db.closeCh:
+			return errHintAborted
+		default:
+		}
+
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if db.dataFileRemoved(dataFile) {
+				return errHintAborted
+			}
+			return err
+		}
+		pos := &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset, Size: uint32(size), Expire: logRecord.Expire}
+		setBlobPos(pos, logRecord)
+		realKey, _ := parseLogRecordKey(logRecord.Key)
+		if !bytes.Equal(realKey, txnFinKey) && logRecord.Type != data.LogRecordRangeDeleted {
+			logRecord.Value = nil
+		}
+		if err := hintFile.WriteDataHintRecord(logRecord, pos); err != nil {
+			return err
+		}
+		offset += size
+	}
+
+	finRecord := &data.LogRecord{
+		Value: binary.AppendVarint(nil, offset),
+		Type:  data.LogRecordHintFinished,
+	}
+	encRecord, _ := data.EncodeLogRecord(finRecord)
+	if err := hintFile.Write(encRecord); err != nil {
+		return err
+	}
+	if err := hintFile.Sync(); err != nil {
+		return err
+	}
+	// 写入期间数据文件已经被 merge 删除了，不再需要 hint 文件
+	if db.dataFileRemoved(dataFile) {
+		return errHintAborted
+	}
+	return nil
+}
+
+// dataFileRemoved 数据文件是否已经被 merge 删除
+func (db *DB) dataFileRemoved(dataFile *data.DataFile) bool {
+	db.filesMu.RLock()
+	defer db.filesMu.RUnlock()
+	return db.olderFiles[dataFile.FileId] != dataFile
+}
+
+// readDataHintFile 读取数据文件的 hint 文件，hint 文件不存在、校验失败或者和数据文件不一致时返回 false
+func (db *DB) readDataHintFile(dataFile *data.DataFile) ([]*hintEntry, bool) {
+	hintFileName := data.GetDataHintFileName(db.options.DirPath, dataFile.FileId)
+	if _, err := os.Stat(hintFileName); err != nil {
+		return nil, false
+	}
+	dataSize, err := dataFile.IoManager.Size()
+	if err != nil {
+		return nil, false
+	}
+	hintFile, err := data.OpenDataHintFile(db.options.DirPath, dataFile.FileId)
+	if err != nil {
+		return nil, false
+	}
+	hintFile.Cipher = db.cipher
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	var entries []*hintEntry
+	var offset int64 = 0
+	for {
+		hintRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			// 读到文件末尾还没有结束记录，说明 hint 文件没有写完
+			return nil, false
+		}
+		offset += size
+
+		if hintRecord.Type == data.LogRecordHintFinished {
+			// 结束记录中的数据文件大小对不上，说明数据文件被替换过
+			size, n := binary.Varint(hintRecord.Value)
+			if n <= 0 || size != dataSize {
+				return nil, false
+			}
+			return entries, true
+		}
+		record, pos := data.DecodeDataHintRecord(hintRecord)
+		if record == nil {
+			return nil, false
+		}
+		entries = append(entries, &hintEntry{record: record, pos: pos})
+	}
+}
+
+// fileScanResult 读取一个数据文件中所有记录的结果
+type fileScanResult struct {
+	entries    []*hintEntry
+	fromHint   bool  // 是否是从 hint 文件中读取的
+	truncateAt int64 // 文件末尾有写了一半的记录时，需要截断的位置，否则为 -1
+	end        int64 // 读取到的位置，之后的数据还没有读取
+	err        error
+}
+
+// scanDataFile 从 from 位置开始读取数据文件中的所有记录，从头读取时优先从 hint 文件中读取
+// 从数据文件中读取时，只保留事务完成记录和范围删除记录的 value，其他记录加载索引时用不到 value
+// tolerateTail 为 true 时文件末尾校验失败的记录视为写了一半的记录，否则视为数据损坏
+func (db *DB) scanDataFile(dataFile *data.DataFile, from int64, tolerateTail bool) *fileScanResult {
+	fileSize, err := dataFile.IoManager.Size()
+	if err != nil {
+		return &fileScanResult{err: err}
+	}
+	if from == 0 {
+		if entries, ok := db.readDataHintFile(dataFile); ok {
+			return &fileScanResult{entries: entries, fromHint: true, truncateAt: -1, end: fileSize}
+		}
+		// hint 文件不存在或者无效，删除之后从数据文件中读取，只读实例不修改文件
+		if !db.options.ReadOnly {
+			if err := db.removeDataHintFile(dataFile.FileId); err != nil {
+				return &fileScanResult{err: err}
+			}
+		}
+	}
+
+	result := &fileScanResult{truncateAt: -1}
+	var offset = from
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err == data.ErrInvalidCRC {
+			switch {
+			case offset+size >= fileSize && tolerateTail:
+				// 文件的最后一条记录校验失败，是写入时进程退出导致的
+				result.truncateAt = offset
+			case db.options.RecoveryMode == RecoverySkipCorrupt:
+				log.Printf("skip the corrupted record in data file %d at offset %d\n", dataFile.FileId, offset)
+				offset += size
+				continue
+			default:
+				return &fileScanResult{err: fmt.Errorf("%w: data file %d, offset %d", err, dataFile.FileId, offset)}
+			}
+			break
+		}
+		if err != nil {
+			if err == io.EOF {
+				// 文件末尾还有不足一条记录的数据
+				if offset < fileSize && tolerateTail {
+					result.truncateAt = offset
+				}
+				break
+			}
+			return &fileScanResult{err: err}
+		}
+
+		// 构造内存索引保存的位置
+		pos := &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset, Size: uint32(size), Expire: logRecord.Expire}
+		setBlobPos(pos, logRecord)
+		realKey, _ := parseLogRecordKey(logRecord.Key)
+		if !bytes.Equal(realKey, txnFinKey) && logRecord.Type != data.LogRecordRangeDeleted {
+			logRecord.Value = nil
+		}
+		result.entries = append(result.entries, &hintEntry{record: logRecord, pos: pos})
+
+		// 递增 offset，继续读取下一条记录
+		offset += size
+	}
+	result.end = offset
+	return result
+}
+
+// newestFilesOfSlots 找出每个 slot 最新的数据文件，只有这些文件在进程退出时还在写入，末尾可能有写了一半的记录，
+// 更早的文件在切换活跃文件时已经持久化了。除了事务完成记录之外，一个文件中的记录都属于同一个 slot，
+// 读不到这样的记录时无法判断文件属于哪个 slot，也视为最新的文件
+func (db *DB) newestFilesOfSlots(dataFiles []*data.DataFile) map[uint32]bool {
+	newest := make(map[uint32]bool)
+	slotFiles := make(map[uint32]uint32)
+	for _, dataFile := range dataFiles {
+		slot, ok := db.slotOfDataFile(dataFile)
+		if !ok {
+			newest[dataFile.FileId] = true
+			continue
+		}
+		if fid, exists := slotFiles[slot]; !exists || dataFile.FileId > fid {
+			slotFiles[slot] = dataFile.FileId
+		}
+	}
+	for _, fid := range slotFiles {
+		newest[fid] = true
+	}
+	return newest
+}
+
+// slotOfDataFile 根据文件中第一条不是事务完成记录的 key 判断文件属于哪个 slot
+func (db *DB) slotOfDataFile(dataFile *data.DataFile) (uint32, bool) {
+	var offset int64 = 0
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			return 0, false
+		}
+		realKey, _ := parseLogRecordKey(logRecord.Key)
+		if !bytes.Equal(realKey, txnFinKey) {
+			return db.hash(realKey), true
+		}
+		offset += size
+	}
+}
+
+// truncateDataFile 将数据文件截断到 size 大小，返回重新打开的数据文件
+// 截断之前的部分拷贝到新的文件中再替换原来的文件，备份中硬链接到原来文件的数据不会被修改
+func (db *DB) truncateDataFile(dataFile *data.DataFile, size int64) (*data.DataFile, error) {
+	if err := dataFile.Close(); err != nil {
+		return nil, err
+	}
+	fileName := data.GetDataFileName(db.options.DirPath, dataFile.FileId)
+	if err := utils.CopyFile(fileName, fileName+truncateFileSuffix, size); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(fileName+truncateFileSuffix, fileName); err != nil {
+		return nil, err
+	}
+	ioType := fio.StandardFIO
+	if db.options.MMapAtStartup {
+		ioType = fio.MemoryMap
+	}
+	newFile, err := db.openDataFile(db.options.DirPath, dataFile.FileId, ioType)
+	if err != nil {
+		return nil, err
+	}
+	// 其他数据文件的 hint 文件可能正在后台写入，同样会读取 olderFiles
+	db.filesMu.Lock()
+	db.olderFiles[dataFile.FileId] = newFile
+	db.filesMu.Unlock()
+	return newFile, nil
+}
+
+// removeDataHintFile 删除数据文件对应的 hint 文件
+func (db *DB) removeDataHintFile(fileId uint32) error {
+	err := os.Remove(data.GetDataHintFileName(db.options.DirPath, fileId))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_DataHintFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-data-hint")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 1000; i < 1100; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), []byte("batch")))
+	}
+	assert.Nil(t, wb.Delete(utils.GetTestKey(1100)))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.DeleteRange(utils.GetTestKey(2000), utils.GetTestKey(2100)))
+
+	// 关闭时会中止还没有写完的 hint 文件，先等待后台任务完成
+	db.bgWg.Wait()
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 写满的数据文件都生成了 hint 文件
+	stats := make(map[uint32]bool)
+	for fid := range db.olderFiles {
+		_, err := os.Stat(data.GetDataHintFileName(dir, fid))
+		assert.Nil(t, err)
+		stats[fid] = true
+	}
+	assert.Greater(t, len(stats), 0)
+
+	// 损坏一个 hint 文件，加载时使用数据文件
+	for fid := range stats {
+		hintFileName := data.GetDataHintFileName(dir, fid)
+		content, err := os.ReadFile(hintFileName)
+		assert.Nil(t, err)
+		content[len(content)/2] ^= 0xff
+		assert.Nil(t, os.WriteFile(hintFileName, content, 0644))
+		break
+	}
+
+	check := func(db *DB) {
+		assert.Equal(t, 5000-1000-1-100, len(db.ListKeys()))
+		_, err := db.Get(utils.GetTestKey(10))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = db.Get(utils.GetTestKey(1100))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = db.Get(utils.GetTestKey(2050))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err := db.Get(utils.GetTestKey(1050))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("batch"), val)
+	}
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	check(db2)
+	stat := db2.Stat()
+	db2.bgWg.Wait()
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	// 所有文件都有 hint 文件，结果和从数据文件加载一致
+	for fid := range db2.olderFiles {
+		_, err := os.Stat(data.GetDataHintFileName(dir, fid))
+		assert.Nil(t, err)
+	}
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	check(db3)
+	assert.Equal(t, stat.ReclaimableSize, db3.Stat().ReclaimableSize)
+	err = db3.Close()
+	assert.Nil(t, err)
+}
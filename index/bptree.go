@@ -6,7 +6,8 @@ import (
 	"path/filepath"
 )
 
-const bptreeIndexFileName = "bptree-index"
+// BPlusTreeIndexFileName B+ 树索引文件的名称
+const BPlusTreeIndexFileName = "bptree-index"
 
 var indexBucketName = []byte("bitcask-index")
 
@@ -21,7 +22,7 @@ func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
 	opts := bolt.DefaultOptions
 	opts.NoSync = !syncWrites
 
-	bptree, err := bolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, opts)
+	bptree, err := bolt.Open(filepath.Join(dirPath, BPlusTreeIndexFileName), 0644, opts)
 	if err != nil {
 		panic("failed to open bptree")
 	}
@@ -106,6 +107,21 @@ func (bpt *BPlusTree) Close() error {
 	return bpt.tree.Close()
 }
 
+// Checkpoint 开启一个只读事务固定当前时刻的索引，返回的函数将这个时刻的索引写入到 dirPath 目录中
+// 写入期间不会阻塞索引的读写，返回的函数必须被调用一次，用来结束只读事务
+func (bpt *BPlusTree) Checkpoint() (func(dirPath string) error, error) {
+	tx, err := bpt.tree.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return func(dirPath string) error {
+		defer func() {
+			_ = tx.Rollback()
+		}()
+		return tx.CopyFile(filepath.Join(dirPath, BPlusTreeIndexFileName), 0644)
+	}, nil
+}
+
 // B+树迭代器
 type bptreeIterator struct {
 	tx        *bolt.Tx
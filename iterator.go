@@ -3,6 +3,7 @@ package bitcask_go
 import (
 	"bitcask-go/index"
 	"bytes"
+	"time"
 )
 
 // Iterator 迭代器
@@ -30,6 +31,7 @@ func (it *Iterator) Rewind() {
 // Seek 根据传入的 key 查找第一个大于(或小于)等于的目标key，从这个key开始遍历
 func (it *Iterator) Seek(key []byte) {
 	it.indexIter.Seek(key)
+	it.skipToNext()
 }
 
 // Next 跳转到下一个key
@@ -63,15 +65,17 @@ func (it *Iterator) Close() {
 	it.indexIter.Close()
 }
 
+// 跳过前缀不匹配以及已经过期的 key
 func (it *Iterator) skipToNext() {
 	prefixLen := len(it.options.Prefix)
-	if prefixLen == 0 {
-		return
-	}
+	now := time.Now().UnixNano()
 
 	for ; it.indexIter.Valid(); it.indexIter.Next() {
+		if it.indexIter.Value().IsExpired(now) {
+			continue
+		}
 		key := it.indexIter.Key()
-		if prefixLen <= len(key) && bytes.Compare(it.options.Prefix, key[:prefixLen]) == 0 {
+		if prefixLen == 0 || prefixLen <= len(key) && bytes.Compare(it.options.Prefix, key[:prefixLen]) == 0 {
 			break
 		}
 	}
@@ -2,31 +2,59 @@ package bitcask_go
 
 import (
 	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/index"
 	"bitcask-go/utils"
+	"bytes"
 	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	mergeDirName     = "-merge"
-	mergeFinishedKye = "merge.finished"
+	mergeDirName        = "-merge"
+	mergeFinishedKye    = "merge.finished"
+	mergeFirstFileIdKey = "merge.first-file-id"
+	mergeCompactedKey   = "merge.compacted"
 )
 
 // Merge 清理无效数据、生成 Hint 文件，merge操作是不阻塞主协程
+// 重写全部数据文件时，完成之后如果没有打开的快照、正在进行的备份和打开的只读实例，立即使用 merge 之后的数据文件并删除旧的数据文件，
+// 否则等到下次 merge、自动 merge 的检查或者重新启动时再加载。加载之前创建的迭代器读取已经删除的数据文件时返回 ErrDataFileNotFound
+// 只重写部分数据文件时同样在完成之后替换原来的文件。上次 merge 的结果还不能加载时返回 ErrMergeIsProgress
 func (db *DB) Merge() error {
+	return db.merge(db.options.DataFileMergeRatio)
+}
+
+// merge 无效数据占比达到 ratio 时进行 merge
+func (db *DB) merge(ratio float32) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	// 上次 merge 的结果还没有加载时先加载，还不能加载时不再重新 merge，否则会删除 merge 目录中的结果
+	if _, err := db.applyMerge(); err != nil {
+		return err
+	}
+	if db.hasPendingMerge() {
+		return ErrMergeIsProgress
+	}
 	for slot := range db.mus {
-		db.mus[slot].RLock()
+		db.mus[slot].Lock()
 	}
 	unlockAllFn := func() {
-		for i := 0; i < len(db.mus); i++ {
-			db.mus[i].RUnlock()
+		for i := len(db.mus) - 1; i >= 0; i-- {
+			db.mus[i].Unlock()
 		}
 	}
 	// 如果 merge 正在进行中，则直接返回
 	if db.isMerging {
+		unlockAllFn()
 		return ErrMergeIsProgress
 	}
 
@@ -38,7 +66,7 @@ func (db *DB) Merge() error {
 	}
 
 	//如果无效数据比总数据量不超过阈值
-	if float32(db.reclaimSize)/float32(totalSize) < db.options.DataFileMergeRatio {
+	if float32(db.reclaimSize.Load())/float32(totalSize) < ratio {
 		unlockAllFn()
 		return ErrMergeRatioUnreached
 	}
@@ -55,7 +83,7 @@ func (db *DB) Merge() error {
 		return err
 	}
 
-	if uint64(totalSize-db.reclaimSize) >= availableDiskSize {
+	if uint64(totalSize-db.reclaimSize.Load()) >= availableDiskSize {
 		unlockAllFn()
 		return ErrNoEnoughSpaceForMerge
 	}
@@ -68,8 +96,13 @@ func (db *DB) Merge() error {
 			unlockAllFn()
 			return err
 		}
-		// 将当前活跃数据文件转换为旧的数据文件
+		db.syncers[slot].markSynced(db.activeFiles[slot].WriteOff)
+		// 将当前活跃数据文件转换为旧的数据文件，之后的写入会打开新的活跃文件，不会参与本次 merge
+		db.filesMu.Lock()
 		db.olderFiles[db.activeFiles[slot].FileId] = db.activeFiles[slot]
+		db.filesMu.Unlock()
+		db.writeHintInBackground(db.activeFiles[slot])
+		db.activeFiles[slot] = nil
 	}
 
 	// 取出所有需要 merge 的文件
@@ -77,18 +110,50 @@ func (db *DB) Merge() error {
 	for _, file := range db.olderFiles {
 		mergeFiles = append(mergeFiles, file)
 	}
-	unlockAllFn() //解锁，此后可以进行写入
+
+	// 只重写无效数据占比达到阈值的文件，B+ 树索引不会从数据文件中重建，只能全部重写
+	var compactFiles []*data.DataFile
+	if db.options.MergeFileDeadRatio > 0 && db.options.IndexType != BPlusTree {
+		stats, err := db.fileStats()
+		if err != nil {
+			unlockAllFn()
+			return err
+		}
+		for _, stat := range stats {
+			if stat.DeadRatio() >= float64(db.options.MergeFileDeadRatio) {
+				compactFiles = append(compactFiles, db.olderFiles[stat.FileId])
+			}
+		}
+		if len(compactFiles) == 0 {
+			unlockAllFn()
+			return ErrMergeRatioUnreached
+		}
+	}
+	if len(compactFiles) > 0 && len(compactFiles) < len(mergeFiles) {
+		unlockAllFn()
+		if err := db.compact(compactFiles); err != nil {
+			return err
+		}
+		_, err := db.applyMerge()
+		return err
+	}
 	if len(mergeFiles) == 0 {
+		unlockAllFn()
 		return nil
 	}
+
+	// merge 之后的文件使用新的文件 id，在线加载时不会和正在使用的文件冲突
+	// 每个 slot 单独写入，每个 slot 最后一个文件可能写不满，为此多预留出 Slots 个文件 id
+	firstMergeFileId := uint32(db.nextFileId.Load())
+	nonMergeFileId := firstMergeFileId + uint32(len(mergeFiles)) + uint32(db.options.Slots)
+	db.nextFileId.Store(int64(nonMergeFileId))
+	unlockAllFn() //解锁，此后可以进行写入
+
 	// 待 merge 的文件 从小大大排序，依次 merge
 	sort.Slice(mergeFiles, func(i, j int) bool {
 		return mergeFiles[i].FileId < mergeFiles[j].FileId
 	})
 
-	// 记录不需要参与Merge的最小文件Id
-	nonMergeFileId := mergeFiles[len(mergeFiles)-1].FileId + 1
-
 	mergePath := db.getMergePath() // 获取 merge 目录
 	// 如果目录存在，说明发生过 merge 将其删除掉
 	if _, err := os.Stat(mergePath); err == nil {
@@ -102,22 +167,70 @@ func (db *DB) Merge() error {
 		return err
 	}
 
+	if err := db.rewriteMergeFiles(mergePath, mergeFiles, firstMergeFileId, nonMergeFileId); err != nil {
+		return err
+	}
+
+	// 写标识 merge 完成的文件，记录 merge 之后的文件 id 范围
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
+	mergeFinRecords := []*data.LogRecord{
+		{Key: []byte(mergeFinishedKye), Value: []byte(strconv.Itoa(int(nonMergeFileId)))},
+		{Key: []byte(mergeFirstFileIdKey), Value: []byte(strconv.Itoa(int(firstMergeFileId)))},
+	}
+	for _, mergeFinRecord := range mergeFinRecords {
+		encRecord, _ := data.EncodeLogRecord(mergeFinRecord)
+		if err := mergeFinishedFile.Write(encRecord); err != nil {
+			return err
+		}
+	}
+	if err := mergeFinishedFile.Sync(); err != nil {
+		return err
+	}
+
+	// 没有打开的快照时直接使用 merge 之后的数据
+	_, err = db.applyMerge()
+	return err
+}
+
+// rewriteMergeFiles 将 mergeFiles 中的有效数据写入 merge 目录中 id 从 firstMergeFileId 开始的新文件，同时生成 hint 索引文件
+func (db *DB) rewriteMergeFiles(mergePath string, mergeFiles []*data.DataFile, firstMergeFileId, nonMergeFileId uint32) error {
 	// 打开一个新的临时 bitcask 实例
 	mergeOptions := db.options
 	mergeOptions.DirPath = mergePath
 	mergeOptions.SyncWrites = false
+	mergeOptions.BytesPerSync = 0
+	mergeOptions.ExpireSweepInterval = 0
+	mergeOptions.AutoMergeInterval = 0
+	mergeOptions.ValueCacheSize = 0
 	mergeDB, err := Open(mergeOptions)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		_ = mergeDB.Close()
+	}()
+	mergeDB.nextFileId.Store(int64(firstMergeFileId))
 
 	// 打开 hint 文件 存储索引
 	hintFile, err := data.OpenHintFile(mergePath)
 	if err != nil {
 		return err
 	}
-	// 遍历处理每个数据文件
-	for _, dataFile := range mergeFiles {
+	defer func() {
+		_ = hintFile.Close()
+	}()
+	hintFile.Cipher = db.cipher
+	var hintMu sync.Mutex
+
+	// 每个协程处理一部分数据文件，有效的数据按照 key 所在的 slot 写入，保持 slot 分片，已经过期的数据直接丢弃
+	now := time.Now().UnixNano()
+	err = forEachFile(mergeFiles, int(db.options.Slots), func(dataFile *data.DataFile) error {
 		var offset int64 = 0
 		for {
 			logRecord, size, err := dataFile.ReadLogRecord(offset)
@@ -134,61 +247,562 @@ func (db *DB) Merge() error {
 			// 如果内存没有写入这条key，所以下面的代码是不会执行的
 			if logRecordPos != nil &&
 				logRecordPos.Fid == dataFile.FileId &&
-				logRecordPos.Offset == offset {
+				logRecordPos.Offset == offset &&
+				!logRecordPos.IsExpired(now) {
 				// 不需要使用事务序列号 清除事务标记
 				logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
-				logRecord.Type = data.LogRecordTxnFinished        //事务结束标志
-				pos, err := mergeDB.appendLogRecord(0, logRecord) //mergeDB追加一条记录,只追加到第一个就可以
+				logRecord.Type = data.LogRecordTxnFinished //事务结束标志
+				pos, err := mergeDB.appendLogRecordWithLock(mergeDB.hash(realKey), logRecord)
 				if err != nil {
 					return err
 				}
 				// 将当前位置索引写到 Hint 文件中去
-				if err := hintFile.WriteHintRecord(realKey, pos); err != nil {
+				hintMu.Lock()
+				err = hintFile.WriteHintRecord(realKey, pos)
+				hintMu.Unlock()
+				if err != nil {
 					return err
 				}
 			}
 			// 增加 offset
 			offset += size
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// merge 产生的文件 id 必须小于 nonMergeFileId，否则会和之后写入的文件冲突
+	if uint32(mergeDB.nextFileId.Load()) > nonMergeFileId {
+		return ErrMergeFileIdExhausted
 	}
+
 	// sync 保证持久化
 	if err := hintFile.Sync(); err != nil {
 		return err
-	} //只有这一个文件
-	if err := mergeDB.activeFiles[0].Sync(); err != nil {
+	}
+	// 所有数据都无效时不会产生新的数据文件
+	for _, activeFile := range mergeDB.activeFiles {
+		if activeFile == nil {
+			continue
+		}
+		if err := activeFile.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compact 只重写部分数据文件，每个文件重写之后使用原来的文件 id，由 applyMerge 替换原来的文件，
+// 有效数据在重写之后的位置写入 hint 索引文件，替换时将内存索引改为指向新的位置
+// 没有参与重写的更早的文件中可能还有被删除的旧数据，所以删除记录、范围删除记录和事务完成记录都会保留，
+// 这些记录只有在全部重写时才会被清理
+func (db *DB) compact(files []*data.DataFile) error {
+	mergePath := db.getMergePath()
+	if _, err := os.Stat(mergePath); err == nil {
+		if err := os.RemoveAll(mergePath); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
 		return err
 	}
-	// 写标识 merge 完成的文件
+
+	hintFile, err := data.OpenHintFile(mergePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
+	hintFile.Cipher = db.cipher
+	var hintMu sync.Mutex
+
+	// 每个文件单独重写，可以并发进行
+	now := time.Now().UnixNano()
+	err = forEachFile(files, int(db.options.Slots), func(dataFile *data.DataFile) error {
+		compactFile, err := db.openDataFile(mergePath, dataFile.FileId, fio.StandardFIO)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = compactFile.Close()
+		}()
+		var offset int64 = 0
+		for {
+			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+			if record, pos := db.compactRecord(logRecord, dataFile.FileId, offset, now); record != nil {
+				// 使用当前的密钥重新加密
+				newOffset := compactFile.WriteOff
+				encRecord, _, err := compactFile.EncodeLogRecord(record)
+				if err != nil {
+					return err
+				}
+				if err := compactFile.Write(encRecord); err != nil {
+					return err
+				}
+				if pos != nil {
+					realKey, _ := parseLogRecordKey(record.Key)
+					newPos := *pos
+					newPos.Offset = newOffset
+					newPos.Size = uint32(len(encRecord))
+					hintMu.Lock()
+					err = hintFile.WriteHintRecord(realKey, &newPos)
+					hintMu.Unlock()
+					if err != nil {
+						return err
+					}
+				}
+			}
+			offset += size
+		}
+		return compactFile.Sync()
+	})
+	if err != nil {
+		return err
+	}
+	if err := hintFile.Sync(); err != nil {
+		return err
+	}
+
+	// 写标识 merge 完成的文件，记录被重写的文件 id
 	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
+	fileIds := make([]string, 0, len(files))
+	for _, dataFile := range files {
+		fileIds = append(fileIds, strconv.Itoa(int(dataFile.FileId)))
+	}
 	mergeFinRecord := &data.LogRecord{
-		Key:   []byte(mergeFinishedKye),
-		Value: []byte(strconv.Itoa(int(nonMergeFileId))),
+		Key:   []byte(mergeCompactedKey),
+		Value: []byte(strings.Join(fileIds, ",")),
 	}
-
 	encRecord, _ := data.EncodeLogRecord(mergeFinRecord)
 	if err := mergeFinishedFile.Write(encRecord); err != nil {
 		return err
 	}
+	return mergeFinishedFile.Sync()
+}
 
-	if err := mergeFinishedFile.Sync(); err != nil {
+// compactRecord 决定重写文件时如何处理一条记录，返回 nil 表示丢弃，记录是内存索引指向的有效数据时同时返回索引中的位置
+func (db *DB) compactRecord(logRecord *data.LogRecord, fid uint32, offset int64, now int64) (*data.LogRecord, *data.LogRecordPos) {
+	realKey, _ := parseLogRecordKey(logRecord.Key)
+	if bytes.Equal(realKey, txnFinKey) ||
+		logRecord.Type == data.LogRecordDeleted ||
+		logRecord.Type == data.LogRecordRangeDeleted {
+		return logRecord, nil
+	}
+
+	pos := db.index.Get(realKey)
+	expired := logRecord.Expire > 0 && logRecord.Expire <= now
+	if pos != nil && pos.Fid == fid && pos.Offset == offset && !expired {
+		return logRecord, pos
+	}
+	// 单条写入的数据和 blob 回收移动 value 写入的记录已经被更新的数据覆盖，可以直接丢弃
+	if (logRecord.Type == data.LogRecordTxnFinished || logRecord.Type == data.LogRecordRelocated) && !expired {
+		return nil, nil
+	}
+	// 批量写的数据要保留记录，否则事务完成记录中的数量对不上，整个批次都会失效；
+	// 过期的数据要保留记录，否则更早的文件中的旧版本会重新生效。只保留 key 和过期时间即可
+	return &data.LogRecord{
+		Key:    logRecord.Key,
+		Type:   logRecord.Type,
+		Expire: logRecord.Expire,
+	}, nil
+}
+
+// forEachFile 使用 workers 个协程并发处理数据文件，返回遇到的第一个错误
+func forEachFile(files []*data.DataFile, workers int, fn func(dataFile *data.DataFile) error) error {
+	if workers > len(files) {
+		workers = len(files)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		next     atomic.Int64
+		failed   atomic.Bool
+		errOnce  sync.Once
+		firstErr error
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !failed.Load() {
+				idx := int(next.Add(1) - 1)
+				if idx >= len(files) {
+					return
+				}
+				if err := fn(files[idx]); err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						failed.Store(true)
+					})
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// hasPendingMerge 是否有已经完成、还没有加载的 merge 数据
+func (db *DB) hasPendingMerge() bool {
+	_, err := os.Stat(filepath.Join(db.getMergePath(), data.MergeFinishedFileName))
+	return err == nil
+}
+
+// applyMerge 在线加载已经完成的 merge，返回是否加载了
+// 有快照打开、备份正在进行或者有只读实例打开时还可能读取参与 merge 的文件，暂不加载
+func (db *DB) applyMerge() (bool, error) {
+	if db.options.ReadOnly {
+		return false, nil
+	}
+	for slot := range db.mus {
+		db.mus[slot].Lock()
+	}
+	defer func() {
+		for i := len(db.mus) - 1; i >= 0; i-- {
+			db.mus[i].Unlock()
+		}
+	}()
+
+	if !db.hasPendingMerge() {
+		return false, nil
+	}
+	db.snapMu.Lock()
+	hasSnapshot := len(db.snapshots) > 0
+	db.snapMu.Unlock()
+	if hasSnapshot || db.backups.Load() > 0 {
+		return false, nil
+	}
+	// 只读实例还可能读取参与 merge 的文件
+	unlockReaders, ok, err := lockReaders(db.options.DirPath)
+	if err != nil || !ok {
+		return false, err
+	}
+	defer unlockReaders()
+	mergePath := db.getMergePath()
+	compactedFileIds, err := db.getCompactedFileIds(mergePath)
+	if err != nil {
+		return false, err
+	}
+	if compactedFileIds != nil {
+		return true, db.applyCompactedFiles(mergePath, compactedFileIds)
+	}
+	firstMergeFileId, nonMergeFileId, err := db.getMergeFileIds(mergePath)
+	if err != nil {
+		return false, err
+	}
+
+	// 先移动数据文件和对应的 hint 文件，再移动 hint 索引文件，最后移动 merge 完成文件
+	// 中途失败时 merge 目录中还有 merge 完成文件，可以重新加载，重新启动时也会继续加载
+	dirEntries, err := os.ReadDir(mergePath)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range dirEntries {
+		switch entry.Name() {
+		// merge 使用的临时实例的 B+ 树索引是空的，不能覆盖正在使用的索引
+		case data.SeqNoFileName, data.NextFileIdFileName, fileLockName, readerLockName, index.BPlusTreeIndexFileName,
+			data.HintFileName, data.MergeFinishedFileName:
+			continue
+		}
+		if err := os.Rename(filepath.Join(mergePath, entry.Name()), filepath.Join(db.options.DirPath, entry.Name())); err != nil {
+			return false, err
+		}
+	}
+	for fid := firstMergeFileId; fid < nonMergeFileId; fid++ {
+		if db.dataFileOf(0, fid) != nil {
+			continue
+		}
+		if _, err := os.Stat(data.GetDataFileName(db.options.DirPath, fid)); os.IsNotExist(err) {
+			continue
+		}
+		dataFile, err := db.openDataFile(db.options.DirPath, fid, fio.StandardFIO)
+		if err != nil {
+			return false, err
+		}
+		db.filesMu.Lock()
+		db.olderFiles[fid] = dataFile
+		db.filesMu.Unlock()
+	}
+	hintSrc := filepath.Join(mergePath, data.HintFileName)
+	if _, err := os.Stat(hintSrc); err == nil {
+		if err := os.Rename(hintSrc, filepath.Join(db.options.DirPath, data.HintFileName)); err != nil {
+			return false, err
+		}
+	}
+
+	// 参与 merge 的文件，加载之后全部删除，其中的无效数据都被回收了
+	var mergedFiles []*data.DataFile
+	var reclaimed int64
+	db.filesMu.RLock()
+	for fid, dataFile := range db.olderFiles {
+		if fid < firstMergeFileId {
+			mergedFiles = append(mergedFiles, dataFile)
+		}
+	}
+	db.filesMu.RUnlock()
+	sort.Slice(mergedFiles, func(i, j int) bool {
+		return mergedFiles[i].FileId < mergedFiles[j].FileId
+	})
+	for _, dataFile := range mergedFiles {
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			return false, err
+		}
+		db.statMu.Lock()
+		reclaimed += size - db.liveBytes[dataFile.FileId]
+		db.statMu.Unlock()
+	}
+
+	if err := db.applyMergeHintFile(firstMergeFileId); err != nil {
+		return false, err
+	}
+	// merge 期间被更新或者删除的 key 在 merge 之后的文件中的数据是无效的
+	for fid := firstMergeFileId; fid < nonMergeFileId; fid++ {
+		dataFile := db.dataFileOf(0, fid)
+		if dataFile == nil {
+			continue
+		}
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			return false, err
+		}
+		db.statMu.Lock()
+		reclaimed -= size - db.liveBytes[fid]
+		db.statMu.Unlock()
+	}
+	err = os.Rename(filepath.Join(mergePath, data.MergeFinishedFileName),
+		filepath.Join(db.options.DirPath, data.MergeFinishedFileName))
+	if err != nil {
+		return false, err
+	}
+
+	// 从小到大删除参与 merge 的文件，中途失败时剩下的文件不会再被加载，由下一次 merge 删除
+	db.filesMu.Lock()
+	for _, dataFile := range mergedFiles {
+		delete(db.olderFiles, dataFile.FileId)
+	}
+	db.filesMu.Unlock()
+	db.statMu.Lock()
+	for _, dataFile := range mergedFiles {
+		delete(db.liveBytes, dataFile.FileId)
+	}
+	db.statMu.Unlock()
+	if db.reclaimSize.Add(-reclaimed) < 0 {
+		db.reclaimSize.Store(0)
+	}
+	if db.cache != nil {
+		db.cache.purge()
+	}
+	for _, dataFile := range mergedFiles {
+		_ = dataFile.Close()
+		if err := os.Remove(data.GetDataFileName(db.options.DirPath, dataFile.FileId)); err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+		if err := db.removeDataHintFile(dataFile.FileId); err != nil {
+			return true, err
+		}
+	}
+	return true, os.RemoveAll(mergePath)
+}
+
+// applyCompactedFiles 使用重写之后的文件替换正在使用的同名文件，并将内存索引改为指向重写之后的位置，调用前需要持有全部 slot 的锁
+// 每个文件先打开重写之后的文件再替换，替换失败时原来的文件和索引都不变，merge 目录中剩下的文件在下次加载
+func (db *DB) applyCompactedFiles(mergePath string, fileIds []uint32) error {
+	// 文件中记录的位置发生了变化，之前 merge 生成的 hint 索引文件失效了，下次启动时从数据文件中加载索引
+	for _, fileName := range []string{data.HintFileName, data.MergeFinishedFileName} {
+		err := os.Remove(filepath.Join(db.options.DirPath, fileName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// 重写之后的有效数据的位置，按照文件分组
+	hintFile, err := data.OpenHintFile(mergePath)
+	if err != nil {
 		return err
 	}
+	hintFile.Cipher = db.cipher
+	newPositions := make(map[uint32][]*hintEntry)
+	var offset int64 = 0
+	for {
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			_ = hintFile.Close()
+			return err
+		}
+		pos := data.DecodeLogRecordPos(logRecord.Value)
+		newPositions[pos.Fid] = append(newPositions[pos.Fid], &hintEntry{record: logRecord, pos: pos})
+		offset += size
+	}
+	_ = hintFile.Close()
+
+	// 替换之前每个文件中的无效数据量
+	deadBefore := make(map[uint32]int64)
+	compacted := make(map[uint32]*data.DataFile)
+	repointed := make(map[string]struct{})
+	for _, fid := range fileIds {
+		srcPath := data.GetDataFileName(mergePath, fid)
+		db.filesMu.RLock()
+		oldFile := db.olderFiles[fid]
+		db.filesMu.RUnlock()
+		// 已经替换过的文件不存在
+		if _, err := os.Stat(srcPath); os.IsNotExist(err) || oldFile == nil {
+			continue
+		}
+		oldSize, err := oldFile.IoManager.Size()
+		if err != nil {
+			return err
+		}
+		newFile, err := db.openDataFile(mergePath, fid, fio.StandardFIO)
+		if err != nil {
+			return err
+		}
+		newSize, err := newFile.IoManager.Size()
+		if err == nil {
+			err = db.removeDataHintFile(fid)
+		}
+		if err == nil {
+			err = os.Rename(srcPath, data.GetDataFileName(db.options.DirPath, fid))
+		}
+		if err != nil {
+			_ = newFile.Close()
+			return err
+		}
+		newFile.WriteOff = newSize
+		db.statMu.Lock()
+		deadBefore[fid] = oldSize - db.liveBytes[fid]
+		db.statMu.Unlock()
+		db.filesMu.Lock()
+		db.olderFiles[fid] = newFile
+		db.filesMu.Unlock()
+		_ = oldFile.Close()
+		compacted[fid] = newFile
+
+		// 重写之后没有再更新过的 key 还指向这个文件，改为指向新的位置
+		for _, entry := range newPositions[fid] {
+			oldPos := db.index.Get(entry.record.Key)
+			if oldPos != nil && oldPos.Fid == fid {
+				db.index.Put(entry.record.Key, entry.pos)
+				db.trackLive(entry.pos, oldPos)
+				repointed[string(entry.record.Key)] = struct{}{}
+			}
+		}
+	}
+	if len(compacted) == 0 {
+		return os.RemoveAll(mergePath)
+	}
+
+	// 剩下还指向重写的文件的 key 都已经过期，重写时只保留了 key 和过期时间
+	var expiredKeys [][]byte
+	iterator := db.index.Iterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if _, ok := compacted[iterator.Value().Fid]; !ok {
+			continue
+		}
+		if _, ok := repointed[string(iterator.Key())]; !ok {
+			expiredKeys = append(expiredKeys, iterator.Key())
+		}
+	}
+	iterator.Close()
+	for _, key := range expiredKeys {
+		oldPos, _ := db.index.Delete(key)
+		db.trackLive(nil, oldPos)
+	}
+
+	var reclaimed int64
+	db.statMu.Lock()
+	for fid, dataFile := range compacted {
+		reclaimed += deadBefore[fid] - (dataFile.WriteOff - db.liveBytes[fid])
+	}
+	db.statMu.Unlock()
+	if db.reclaimSize.Add(-reclaimed) < 0 {
+		db.reclaimSize.Store(0)
+	}
+	if db.cache != nil {
+		db.cache.purge()
+	}
+	for _, dataFile := range compacted {
+		db.writeHintInBackground(dataFile)
+	}
+	return os.RemoveAll(mergePath)
+}
+
+// applyMergeHintFile 读取 merge 生成的 hint 索引文件，merge 之后没有再更新过的 key 还指向参与 merge 的文件，改为指向 merge 之后的位置
+// 重复加载时 key 已经指向 merge 之后的文件，不会再被替换。剩下还指向参与 merge 的文件的 key 都已经过期，merge 时被丢弃了
+func (db *DB) applyMergeHintFile(firstMergeFileId uint32) error {
+	hintFile, err := data.OpenHintFile(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
+	hintFile.Cipher = db.cipher
+	var offset int64 = 0
+	for {
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		oldPos := db.index.Get(logRecord.Key)
+		if oldPos != nil && oldPos.Fid < firstMergeFileId {
+			pos := data.DecodeLogRecordPos(logRecord.Value)
+			db.index.Put(logRecord.Key, pos)
+			db.trackLive(pos, oldPos)
+		}
+		offset += size
+	}
 
+	var expiredKeys [][]byte
+	iterator := db.index.Iterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if iterator.Value().Fid < firstMergeFileId {
+			expiredKeys = append(expiredKeys, iterator.Key())
+		}
+	}
+	iterator.Close()
+	for _, key := range expiredKeys {
+		oldPos, _ := db.index.Delete(key)
+		db.trackLive(nil, oldPos)
+	}
 	return nil
 }
 
 // 获取 merge 目录
 func (db *DB) getMergePath() string {
+	return getMergePath(db.options.DirPath)
+}
+
+// getMergePath 获取数据目录对应的 merge 目录
+func getMergePath(dirPath string) string {
 	// 此处应使用 file 而非path
 	// path 主要用于处理以斜杠(/)分隔的路径（Unix 风格），
 	// 而 filepath 会根据运行程序的操作系统来处理路径
 	//（例如，在 Windows 上使用反斜杠(\)）。如果您的代码是跨平台的
 	// 建议始终使用 filepath 而不是 path。
-	dir := filepath.Dir(filepath.Clean(db.options.DirPath))
-	base := filepath.Base(db.options.DirPath)
+	dir := filepath.Dir(filepath.Clean(dirPath))
+	base := filepath.Base(dirPath)
 
 	return filepath.Join(dir, base+mergeDirName)
 }
@@ -200,6 +814,14 @@ func (db *DB) loadMergeFiles() error {
 	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
 		return nil
 	}
+	// 有只读实例打开时保留完成的 merge，等只读实例都关闭之后在线加载
+	if db.hasPendingMerge() {
+		unlockReaders, ok, err := lockReaders(db.options.DirPath)
+		if err != nil || !ok {
+			return err
+		}
+		defer unlockReaders()
+	}
 	//删除 merge 目录
 	defer func() {
 		_ = os.RemoveAll(mergePath)
@@ -221,8 +843,15 @@ func (db *DB) loadMergeFiles() error {
 		if entry.Name() == data.SeqNoFileName { // 事务序列号文件
 			continue
 		}
-		// 文件锁目录跳过
-		if entry.Name() == fileLockName {
+		if entry.Name() == data.NextFileIdFileName { // 临时实例的文件 id 记录文件
+			continue
+		}
+		// 文件锁目录跳过，临时实例的读者锁文件不能替换只读实例正在使用的读者锁文件
+		if entry.Name() == fileLockName || entry.Name() == readerLockName {
+			continue
+		}
+		// 临时实例的 B+ 树索引是空的
+		if entry.Name() == index.BPlusTreeIndexFileName {
 			continue
 		}
 		mergeFileNames = append(mergeFileNames, entry.Name()) // 记录 merge 文件名
@@ -233,21 +862,24 @@ func (db *DB) loadMergeFiles() error {
 		return nil
 	}
 
-	// 获取到下一个文件ID,因为文件是顺序编号的
-	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+	// 只重写了部分数据文件，替换对应的文件即可
+	compactedFileIds, err := db.getCompactedFileIds(mergePath)
 	if err != nil {
 		return err
 	}
+	if compactedFileIds != nil {
+		return db.loadCompactedFiles(mergePath, compactedFileIds)
+	}
 
-	// 删除对应的数据文件(数据目录中以及被 merge完成的文件)
-	var fileId uint32 = 0
-	for ; fileId < nonMergeFileId; fileId++ {
-		fileName := data.GetDataFileName(db.options.DirPath, fileId)
-		if _, err := os.Stat(fileName); err == nil {
-			if err := os.Remove(fileName); err != nil {
-				return err
-			}
-		}
+	// 获取 merge 之后的文件 id 范围
+	firstMergeFileId, _, err := db.getMergeFileIds(mergePath)
+	if err != nil {
+		return err
+	}
+
+	// 删除参与 merge 的数据文件和对应的 hint 文件，上次在线加载到一半时退出，已经移动过来的文件不会被删除
+	if err := db.removeFilesBefore(firstMergeFileId); err != nil {
+		return err
 	}
 
 	// 将新的数据文件移动到数据目录中(merge后的文件)
@@ -258,26 +890,128 @@ func (db *DB) loadMergeFiles() error {
 			return err
 		}
 	}
+
+	// B+ 树索引不会从 hint 文件和数据文件中重建，需要将索引改为指向 merge 之后的位置，有效数据量之后遍历索引重新统计
+	if db.options.IndexType == BPlusTree {
+		if err := db.applyMergeHintFile(firstMergeFileId); err != nil {
+			return err
+		}
+		db.liveBytes = make(map[uint32]int64)
+		db.blobLive = make(map[uint32]int64)
+	}
 	return nil
 }
 
-// 获取 merge 完成的文件id的下一个
-func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
+// getMergeFileIds 获取 merge 之后的第一个文件 id 和不参与 merge 的最小文件 id
+// 之前的 merge 完成文件中没有记录第一个文件 id，merge 之后的文件从 0 开始，参与 merge 的文件 id 都小于 nonMergeFileId
+func (db *DB) getMergeFileIds(dirPath string) (uint32, uint32, error) {
 	// 打开 merge 完成文件
 	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
 	// 读取 merge 完成文件中的记录
-	record, _, err := mergeFinishedFile.ReadLogRecord(0)
+	record, size, err := mergeFinishedFile.ReadLogRecord(0)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 	nonMergeFileId, err := strconv.Atoi(string(record.Value))
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+
+	record, _, err = mergeFinishedFile.ReadLogRecord(size)
+	if err == io.EOF {
+		return uint32(nonMergeFileId), uint32(nonMergeFileId), nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	firstMergeFileId, err := strconv.Atoi(string(record.Value))
+	if err != nil {
+		return 0, 0, err
 	}
-	return uint32(nonMergeFileId), nil
+	return uint32(firstMergeFileId), uint32(nonMergeFileId), nil
+}
+
+// removeFilesBefore 删除数据目录中 id 小于 fileId 的数据文件和对应的 hint 文件
+func (db *DB) removeFilesBefore(fileId uint32) error {
+	dirEntries, err := os.ReadDir(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirEntries {
+		if !strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			continue
+		}
+		fid, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), data.DataFileNameSuffix))
+		if err != nil || uint32(fid) >= fileId {
+			continue
+		}
+		if err := os.Remove(filepath.Join(db.options.DirPath, entry.Name())); err != nil {
+			return err
+		}
+		if err := db.removeDataHintFile(uint32(fid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getCompactedFileIds 获取只重写了部分文件时被重写的文件 id，全部重写时返回 nil
+func (db *DB) getCompactedFileIds(dirPath string) ([]uint32, error) {
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
+	record, _, err := mergeFinishedFile.ReadLogRecord(0)
+	if err != nil {
+		return nil, err
+	}
+	if string(record.Key) != mergeCompactedKey {
+		return nil, nil
+	}
+
+	fileIds := make([]uint32, 0)
+	for _, s := range strings.Split(string(record.Value), ",") {
+		fid, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, err
+		}
+		fileIds = append(fileIds, uint32(fid))
+	}
+	return fileIds, nil
+}
+
+// loadCompactedFiles 使用重写之后的文件替换数据目录中的同名文件
+func (db *DB) loadCompactedFiles(mergePath string, fileIds []uint32) error {
+	// 文件中记录的位置发生了变化，之前 merge 生成的 hint 文件失效了，需要从数据文件中加载索引
+	for _, fileName := range []string{data.HintFileName, data.MergeFinishedFileName} {
+		err := os.Remove(filepath.Join(db.options.DirPath, fileName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, fid := range fileIds {
+		if err := db.removeDataHintFile(fid); err != nil {
+			return err
+		}
+		srcPath := data.GetDataFileName(mergePath, fid)
+		// 上次替换到一半时退出了，已经替换过的文件不存在
+		if _, err := os.Stat(srcPath); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(srcPath, data.GetDataFileName(db.options.DirPath, fid)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // 从 hint 文件中加载索引
@@ -293,6 +1027,7 @@ func (db *DB) loadIndexFromHintFile() error {
 	if err != nil {
 		return err
 	}
+	hintFile.Cipher = db.cipher
 	// 读取文件中的索引
 	var offset int64 = 0
 	for {
@@ -305,7 +1040,7 @@ func (db *DB) loadIndexFromHintFile() error {
 		}
 		// 解码 拿到实际的位置索引
 		pos := data.DecodeLogRecordPos(logRecord.Value)
-		db.index.Put(logRecord.Key, pos)
+		db.trackLive(pos, db.index.Put(logRecord.Key, pos))
 		offset += size
 	}
 	return nil
@@ -3,8 +3,10 @@ package bitcask_go
 import (
 	"bitcask-go/utils"
 	"os"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -203,3 +205,378 @@ func TestDB_Merge_5(t *testing.T) {
 		assert.NotNil(t, val)
 	}
 }
+
+// 过期的数据在 merge 之后被清理
+func TestDB_Merge_Expired(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-expired")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(128), 50*time.Millisecond)
+		assert.Nil(t, err)
+	}
+	for i := 1000; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, uint(1000), db2.Stat().KeyNum)
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+}
+
+// 只重写无效数据较多的文件
+func TestDB_Merge_Selective(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("./", "bitcask-go-TestDB_Merge_Selective")
+	opts.DataFileSize = 64 * 1024
+	opts.DirPath = dir
+	opts.Slots = 1
+	opts.DataFileMergeRatio = 0
+	opts.MergeFileDeadRatio = 0.5
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 前面的文件都是有效数据
+	for i := 0; i < 2000; i++ {
+		err := db.Put([]byte("a-"+string(utils.GetTestKey(i))), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	// 后面的文件中的数据大部分被覆盖
+	for n := 0; n < 5; n++ {
+		for i := 0; i < 500; i++ {
+			err := db.Put([]byte("b-"+string(utils.GetTestKey(i))), utils.RandomValue(64))
+			assert.Nil(t, err)
+		}
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, wb.Put([]byte("c-"+string(utils.GetTestKey(i))), []byte("batch")))
+	}
+	assert.Nil(t, wb.Commit())
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Put([]byte("c-"+string(utils.GetTestKey(i))), []byte("single")))
+	}
+	// 删除记录在后面的文件中，被删除的数据在前面的文件中
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete([]byte("a-"+string(utils.GetTestKey(i)))))
+	}
+
+	before, err := db.FileStats()
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// 重启校验
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Nil(t, err)
+	assert.Equal(t, 1900+500+100, len(db2.ListKeys()))
+	for i := 0; i < 100; i++ {
+		_, err := db2.Get([]byte("a-" + string(utils.GetTestKey(i))))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	for i := 0; i < 100; i++ {
+		val, err := db2.Get([]byte("c-" + string(utils.GetTestKey(i))))
+		assert.Nil(t, err)
+		if i < 50 {
+			assert.Equal(t, []byte("single"), val)
+		} else {
+			assert.Equal(t, []byte("batch"), val)
+		}
+	}
+
+	// 有效数据较多的文件保持不变，其他文件被重写
+	after, err := db2.FileStats()
+	assert.Nil(t, err)
+	afterSizes := make(map[uint32]int64)
+	for _, stat := range after {
+		afterSizes[stat.FileId] = stat.Size
+	}
+	var kept, compacted int
+	for _, stat := range before {
+		if stat.DeadRatio() >= 0.5 {
+			compacted++
+			assert.Less(t, afterSizes[stat.FileId], stat.Size)
+		} else {
+			kept++
+			assert.Equal(t, stat.Size, afterSizes[stat.FileId])
+		}
+	}
+	assert.Greater(t, kept, 0)
+	assert.Greater(t, compacted, 0)
+}
+
+// 只重写部分数据文件时同样在线替换原来的文件，不需要重新启动就可以回收空间
+func TestDB_Merge_SelectiveOnline(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("./", "bitcask-go-TestDB_Merge_SelectiveOnline")
+	opts.DataFileSize = 64 * 1024
+	opts.DirPath = dir
+	opts.Slots = 1
+	opts.DataFileMergeRatio = 0
+	opts.MergeFileDeadRatio = 0.5
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put([]byte("a-"+string(utils.GetTestKey(i))), utils.RandomValue(64)))
+	}
+	overwrite := func() {
+		for n := 0; n < 5; n++ {
+			for i := 0; i < 500; i++ {
+				assert.Nil(t, db.Put([]byte("b-"+string(utils.GetTestKey(i))), []byte(strconv.Itoa(n))))
+			}
+		}
+	}
+	overwrite()
+	assert.Nil(t, db.PutWithTTL([]byte("expired"), []byte("value"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+
+	// 每次 merge 之后磁盘空间都会减少
+	for round := 0; round < 2; round++ {
+		before := db.Stat()
+		assert.Nil(t, db.Merge())
+		assert.False(t, db.hasPendingMerge())
+		after := db.Stat()
+		assert.Less(t, after.DiskSize, before.DiskSize)
+		assert.Less(t, after.ReclaimableSize, before.ReclaimableSize)
+		assert.Equal(t, 2500, len(db.ListKeys()))
+		for i := 0; i < 500; i++ {
+			val, err := db.Get([]byte("b-" + string(utils.GetTestKey(i))))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("4"), val)
+		}
+		overwrite()
+	}
+
+	// 上次的结果还没有加载时不会重新 merge
+	snap := db.NewSnapshot()
+	assert.Nil(t, db.Merge())
+	assert.True(t, db.hasPendingMerge())
+	assert.Equal(t, ErrMergeIsProgress, db.Merge())
+	assert.True(t, db.hasPendingMerge())
+	snap.Release()
+	assert.Nil(t, db.Merge())
+	assert.False(t, db.hasPendingMerge())
+
+	// 重启校验
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 2500, len(db.ListKeys()))
+	_, err = db.Get([]byte("expired"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for i := 0; i < 500; i++ {
+		val, err := db.Get([]byte("b-" + string(utils.GetTestKey(i))))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("4"), val)
+	}
+}
+
+// merge 之后数据仍然按照 slot 分布在不同的文件中
+func TestDB_Merge_KeepSlots(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("./", "bitcask-go-TestDB_Merge_KeepSlots")
+	opts.DataFileSize = 1024 * 1024
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 10000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	// merge 期间的写入
+	err = db.Put(utils.GetTestKey(1), []byte("new"))
+	assert.Nil(t, err)
+
+	// 重启校验
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Nil(t, err)
+	keys := db2.ListKeys()
+	assert.Equal(t, 10001, len(keys))
+	val, err := db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+
+	fileSlots := make(map[uint32]uint32)
+	for _, key := range keys {
+		pos := db2.index.Get(key)
+		slot := db2.hash(key)
+		if s, ok := fileSlots[pos.Fid]; ok {
+			assert.Equal(t, s, slot)
+		}
+		fileSlots[pos.Fid] = slot
+	}
+	assert.GreaterOrEqual(t, len(fileSlots), int(opts.Slots))
+}
+
+// merge 完成之后立即使用 merge 之后的数据文件，有快照打开时等到快照释放之后再加载
+func TestDB_Merge_Online(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("./", "bitcask-go-TestDB_Merge_Online")
+	opts.DataFileSize = 1024 * 1024
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 10000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.PutWithTTL([]byte("expired"), []byte("value"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	before := db.Stat()
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.False(t, db.hasPendingMerge())
+	after := db.Stat()
+	assert.Less(t, after.DiskSize, before.DiskSize)
+	assert.Less(t, after.ReclaimableSize, before.ReclaimableSize)
+	assert.Equal(t, 10000, len(db.ListKeys()))
+	for i := 10000; i < 20000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+
+	// 快照还可能读取参与 merge 的文件
+	for i := 10000; i < 15000; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("new"))
+		assert.Nil(t, err)
+	}
+	snap := db.NewSnapshot()
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.True(t, db.hasPendingMerge())
+	val, err := snap.Get(utils.GetTestKey(10000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+	snap.Release()
+
+	applied, err := db.applyMerge()
+	assert.Nil(t, err)
+	assert.True(t, applied)
+	assert.False(t, db.hasPendingMerge())
+	for i := 10000; i < 20000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		if i < 15000 {
+			assert.Equal(t, []byte("new"), val)
+		} else {
+			assert.Equal(t, utils.GetTestKey(i), val)
+		}
+	}
+
+	// 重启校验
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Nil(t, err)
+	assert.Equal(t, 10000, len(db2.ListKeys()))
+	val, err = db2.Get(utils.GetTestKey(10000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+	val, err = db2.Get(utils.GetTestKey(19999))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(19999), val)
+}
+
+// B+ 树索引持久化在磁盘上，merge 之后索引指向 merge 之后的文件，重新启动之后数据仍然有效
+func TestDB_Merge_BPlusTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("./", "bitcask-go-TestDB_Merge_BPlusTree")
+	opts.DataFileSize = 64 * 1024
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for n := 0; n < 2; n++ {
+		for i := 0; i < 3000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i+n)))
+		}
+	}
+	assert.Nil(t, db.Merge())
+	assert.False(t, db.hasPendingMerge())
+	assert.Nil(t, db.Put([]byte("after"), []byte("value")))
+
+	// 有快照时 merge 的结果在重新启动时加载
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("new")))
+	}
+	snap := db.NewSnapshot()
+	assert.Nil(t, db.Merge())
+	assert.True(t, db.hasPendingMerge())
+	snap.Release()
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.False(t, db.hasPendingMerge())
+	assert.Equal(t, 3001, len(db.ListKeys()))
+	val, err := db.Get([]byte("after"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	for i := 0; i < 3000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		if i < 1000 {
+			assert.Equal(t, []byte("new"), val)
+		} else {
+			assert.Equal(t, utils.GetTestKey(i+1), val)
+		}
+	}
+}
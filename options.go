@@ -1,5 +1,10 @@
 package bitcask_go
 
+import (
+	"runtime"
+	"time"
+)
+
 type Options struct {
 	// 数据库数据目录
 	DirPath string
@@ -7,7 +12,8 @@ type Options struct {
 	// 数据文件的大小
 	DataFileSize int64
 
-	// 每次写入是否持久化
+	// 每次写入是否持久化，写入在返回之前等待数据持久化，同时等待的写入会合并为一次 Sync
+	// 写入的数据持久化之后才能被读取到，也才会通知订阅者
 	SyncWrites bool
 
 	// 累计写到多少字节后进行持久化
@@ -22,8 +28,66 @@ type Options struct {
 	// 数据文件合并的阈值
 	DataFileMergeRatio float32
 
+	// merge 时只重写无效数据占比达到该值的数据文件，为 0 表示重写全部数据文件
+	// 重写之后的文件在线替换原来的文件，有快照打开或者备份正在进行时等到之后再替换，在此之前不会再 merge
+	MergeFileDeadRatio float32
+
 	//hash槽的数量
 	Slots int64
+
+	// 后台清理过期 key 的时间间隔，为 0 表示不开启
+	ExpireSweepInterval time.Duration
+
+	// 每一轮清理时抽样检查的 key 数量
+	ExpireSweepSamples int
+
+	// 每个变更订阅者可以缓存的事件数量，消费过慢超过之后订阅会被关闭
+	WatchBufferSize int
+
+	// 后台检查是否需要自动 merge 的时间间隔，为 0 表示不开启
+	AutoMergeInterval time.Duration
+
+	// 自动 merge 的无效数据占比阈值
+	AutoMergeRatio float32
+
+	// 允许自动 merge 的时间窗口，为距离当天零点(本地时间)的时长，
+	// 开始时间大于结束时间表示跨越零点，两者相等表示不限制
+	AutoMergeWindowStart time.Duration
+	AutoMergeWindowEnd   time.Duration
+
+	// 自动 merge 要求的最小可回收数据量，字节为单位
+	AutoMergeMinReclaimSize int64
+
+	// 启动时并发读取数据文件加载索引的协程数量，为 0 时和 1 一样顺序读取
+	RecoveryWorkers int
+
+	// 启动时遇到损坏的数据的处理方式，默认直接返回错误
+	RecoveryMode RecoveryMode
+
+	// 以只读的方式打开，可以和写入的进程同时使用同一个数据目录，不支持 B+ 树索引
+	// 有只读实例打开时写入进程不会删除数据文件和 blob 文件，merge 和 blob 回收的结果等到只读实例都关闭之后再生效
+	ReadOnly bool
+
+	// 写入时压缩 value 使用的算法，为 nil 表示不压缩，内置的算法见 FlateCompression 和 GzipCompression
+	Compression Compressor
+
+	// 小于该长度的 value 不进行压缩，字节为单位
+	CompressionThreshold int
+
+	// 加密数据文件和 hint 文件中的 key 和 value 使用的密钥，为 nil 表示不加密，使用 AES-GCM 算法
+	Encryption KeyProvider
+
+	// 长度达到该值的 value 单独写入 blob 文件，数据文件中只保存指向 value 的指针，为 0 表示不开启
+	ValueThreshold int
+
+	// blob 文件的无效数据占比达到该值时，BlobGC 才会回收该文件
+	BlobGCDeadRatio float32
+
+	// PutAsync 和 CommitAsync 使用的内存写入队列的长度，队列满时写入会阻塞，不大于 0 时使用 1024
+	AsyncQueueSize int
+
+	// 读取时缓存 value 使用的内存上限，字节为单位，为 0 表示不开启缓存
+	ValueCacheSize int64
 }
 
 // IteratorOptions 索引迭代器配置项
@@ -44,6 +108,19 @@ type WriteBatchOptions struct {
 	SyncWrites bool
 }
 
+type RecoveryMode = int8
+
+const (
+	// RecoveryStrict 遇到校验失败的数据直接返回错误
+	RecoveryStrict RecoveryMode = iota
+
+	// RecoveryTruncateTail 截断数据文件末尾写了一半的记录，其他位置的损坏返回错误
+	RecoveryTruncateTail
+
+	// RecoverySkipCorrupt 截断数据文件末尾写了一半的记录，跳过其他位置校验失败的记录
+	RecoverySkipCorrupt
+)
+
 type IndexerType = int8
 
 const (
@@ -58,14 +135,30 @@ const (
 )
 
 var DefaultOptions = Options{
-	DirPath:            "./tmp/bitcask-go",
-	DataFileSize:       256 * 1024 * 1024, // 256MB
-	SyncWrites:         false,
-	BytesPerSync:       0,
-	IndexType:          ART,
-	MMapAtStartup:      true,
-	DataFileMergeRatio: 0.5,
-	Slots:              4,
+	DirPath:              "./tmp/bitcask-go",
+	DataFileSize:         256 * 1024 * 1024, // 256MB
+	SyncWrites:           false,
+	BytesPerSync:         0,
+	IndexType:            ART,
+	MMapAtStartup:        true,
+	DataFileMergeRatio:   0.5,
+	MergeFileDeadRatio:   0,
+	Slots:                4,
+	ExpireSweepInterval:  0,
+	ExpireSweepSamples:   1000,
+	WatchBufferSize:      1024,
+	AutoMergeInterval:    0,
+	AutoMergeRatio:       0.5,
+	RecoveryWorkers:      runtime.NumCPU(),
+	RecoveryMode:         RecoveryStrict,
+	ReadOnly:             false,
+	Compression:          nil,
+	CompressionThreshold: 256,
+	Encryption:           nil,
+	ValueThreshold:       0,
+	BlobGCDeadRatio:      0.5,
+	AsyncQueueSize:       1024,
+	ValueCacheSize:       0,
 }
 
 var DefaultIteratorOptions = IteratorOptions{
@@ -0,0 +1,237 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/index"
+	"bitcask-go/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// openReadOnly 以只读的方式打开数据库，不创建数据目录、不修改任何数据文件
+// 写入进程持有 flock 的排他锁，只读实例对写入进程创建的读者锁文件加共享锁，不创建任何文件，可以和写入进程以及其他只读实例同时使用数据目录
+// 有只读实例打开时，写入进程不会删除或者替换数据文件，merge 和 blob 回收的结果等到只读实例都关闭之后再加载
+// 写入进程正在删除文件，或者 Restore、Repair 正在写入数据目录时返回 ErrDatabaseIsUsing
+func openReadOnly(options Options) (*DB, error) {
+	if _, err := os.Stat(options.DirPath); err != nil {
+		return nil, err
+	}
+	// 写入进程还没有创建读者锁文件时不加锁
+	readerLock, locked, err := utils.TryRLockFile(filepath.Join(options.DirPath, readerLockName))
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, ErrDatabaseIsUsing
+	}
+	db, err := open(options, nil, false)
+	if err != nil {
+		if readerLock != nil {
+			_ = readerLock.Close()
+		}
+		return nil, err
+	}
+	db.readerLock = readerLock
+	return db, nil
+}
+
+// createReaderLockFile 创建读者锁文件，文件已经存在时不做修改
+func createReaderLockFile(dirPath string) error {
+	file, err := os.OpenFile(filepath.Join(dirPath, readerLockName), os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// excludeReaders 写入一个新的数据目录期间对读者锁文件加排他锁，只读实例无法打开写了一半的数据目录，调用返回的函数释放锁
+func excludeReaders(dirPath string) (func(), error) {
+	if err := createReaderLockFile(dirPath); err != nil {
+		return nil, err
+	}
+	unlockReaders, ok, err := lockReaders(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrDatabaseIsUsing
+	}
+	return unlockReaders, nil
+}
+
+// lockReaders 删除或者替换只读实例可能正在使用的文件之前，对读者锁文件加排他锁，有只读实例打开时返回 false
+// 持有锁期间新的只读实例无法打开，调用返回的函数释放锁
+func lockReaders(dirPath string) (func(), bool, error) {
+	file, locked, err := utils.TryLockFile(filepath.Join(dirPath, readerLockName))
+	if err != nil || !locked {
+		return nil, false, err
+	}
+	return func() {
+		if file != nil {
+			_ = file.Close()
+		}
+	}, true, nil
+}
+
+// closeReadOnly 关闭只读实例，只读实例没有活跃文件，也不需要保存事务序列号
+func (db *DB) closeReadOnly() error {
+	for slot := range db.mus {
+		db.mus[slot].Lock()
+	}
+	defer func() {
+		for i := len(db.mus) - 1; i >= 0; i-- {
+			db.mus[i].Unlock()
+		}
+	}()
+
+	if err := db.index.Close(); err != nil {
+		return err
+	}
+	for _, file := range db.olderFiles {
+		_ = file.Close()
+	}
+	for _, file := range db.blobFiles {
+		_ = file.Close()
+	}
+	if db.readerLock != nil {
+		_ = db.readerLock.Close()
+	}
+	return nil
+}
+
+// Refresh 只读实例读取写入进程在上次加载之后追加的数据，更新内存索引
+// 如果数据文件被写入进程 merge 替换或者删除了，则重新加载全部的索引，写入实例调用时直接返回
+func (db *DB) Refresh() error {
+	if !db.options.ReadOnly {
+		return nil
+	}
+
+	// 锁住全部 slot，更新索引期间不能读取
+	for slot := range db.mus {
+		db.mus[slot].Lock()
+	}
+	defer func() {
+		for i := len(db.mus) - 1; i >= 0; i-- {
+			db.mus[i].Unlock()
+		}
+	}()
+	db.filesMu.Lock()
+	defer db.filesMu.Unlock()
+
+	for fid, info := range db.fileInfos {
+		current, err := os.Stat(data.GetDataFileName(db.options.DirPath, fid))
+		if err != nil || !os.SameFile(info, current) {
+			return db.reload()
+		}
+	}
+
+	// 写入进程新建的数据文件
+	dirEntries, err := os.ReadDir(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirEntries {
+		if !strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			continue
+		}
+		fid, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), data.DataFileNameSuffix))
+		if err != nil {
+			return ErrDataDirectoryCorrupted
+		}
+		if _, ok := db.olderFiles[uint32(fid)]; ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		dataFile, err := db.openDataFile(db.options.DirPath, uint32(fid), fio.StandardFIO)
+		if err != nil {
+			return err
+		}
+		db.olderFiles[uint32(fid)] = dataFile
+		db.fileInfos[uint32(fid)] = info
+	}
+
+	fileIds := make([]uint32, 0, len(db.olderFiles))
+	for fid := range db.olderFiles {
+		fileIds = append(fileIds, fid)
+	}
+	sort.Slice(fileIds, func(i, j int) bool {
+		return fileIds[i] < fileIds[j]
+	})
+
+	// 从上次读到的位置继续读取，末尾写了一半的记录等到下次再读取
+	if db.replayer == nil {
+		db.replayer = newIndexReplayer(db)
+	}
+	db.replayer.now = time.Now().UnixNano()
+	for _, fid := range fileIds {
+		dataFile := db.olderFiles[fid]
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			return err
+		}
+		if offset, ok := db.scannedOffsets[fid]; ok && offset >= size {
+			continue
+		}
+		// 文件末尾可能是写入进程正在写入的记录，不能视为数据损坏
+		result := db.scanDataFile(dataFile, db.scannedOffsets[fid], true)
+		if result.err != nil {
+			return result.err
+		}
+		for _, entry := range result.entries {
+			db.replayer.handleRecord(entry.record, entry.pos)
+		}
+		db.scannedOffsets[fid] = result.end
+	}
+	atomic.StoreUint64(&db.seqNo, db.replayer.seqNo)
+	// 读取数据之后再打开新的 blob 文件，保证索引指向的 blob 文件都已经打开
+	return db.loadBlobFiles()
+}
+
+// reload 数据文件被替换之后，关闭所有数据文件，重新加载全部的索引
+// 调用时需要持有全部 slot 的写锁和 filesMu
+func (db *DB) reload() error {
+	for _, file := range db.olderFiles {
+		_ = file.Close()
+	}
+	for _, file := range db.blobFiles {
+		_ = file.Close()
+	}
+	if err := db.index.Close(); err != nil {
+		return err
+	}
+	db.index = index.NewIndexer(db.options.IndexType, db.options.DirPath, db.options.SyncWrites)
+	db.olderFiles = make(map[uint32]*data.DataFile)
+	db.fileInfos = make(map[uint32]os.FileInfo)
+	db.scannedOffsets = make(map[uint32]int64)
+	db.replayer = nil
+	db.reclaimSize.Store(0)
+	db.statMu.Lock()
+	db.liveBytes = make(map[uint32]int64)
+	db.blobLive = make(map[uint32]int64)
+	db.statMu.Unlock()
+	db.blobFiles = make(map[uint32]*data.DataFile)
+	// 替换之后的文件复用了文件 id，缓存的位置不再有效
+	if db.cache != nil {
+		db.cache.purge()
+	}
+
+	if err := db.loadDataFile(); err != nil {
+		return err
+	}
+	if err := db.loadIndexFromHintFile(); err != nil {
+		return err
+	}
+	if err := db.loadIndexFromDataFile(); err != nil {
+		return err
+	}
+	return db.loadBlobFiles()
+}
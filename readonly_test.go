@@ -0,0 +1,154 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_ReadOnly(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-read-only")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+
+	// 写入进程持有文件锁的时候也可以以只读的方式打开
+	roOpts := opts
+	roOpts.ReadOnly = true
+	ro, err := Open(roOpts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = ro.Close()
+	}()
+
+	// 另一个只读实例
+	ro2, err := Open(roOpts)
+	assert.Nil(t, err)
+	assert.Nil(t, ro2.Close())
+
+	_, err = ro.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := ro.Get(utils.GetTestKey(1999))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	assert.Equal(t, 1999, len(ro.ListKeys()))
+
+	// 写入操作都返回 ErrReadOnly
+	assert.Equal(t, ErrReadOnly, ro.Put(utils.GetTestKey(1), []byte("v")))
+	assert.Equal(t, ErrReadOnly, ro.Delete(utils.GetTestKey(1)))
+	assert.Equal(t, ErrReadOnly, ro.Merge())
+	assert.Equal(t, ErrReadOnly, ro.DeletePrefix([]byte("bitcask")))
+	_, err = ro.CompareAndSwap(utils.GetTestKey(1), nil, []byte("v"))
+	assert.Equal(t, ErrReadOnly, err)
+	wb := ro.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Equal(t, ErrReadOnly, wb.Put(utils.GetTestKey(1), []byte("v")))
+	assert.Equal(t, ErrReadOnly, wb.Commit())
+
+	// Refresh 之后可以读到写入进程新写入的数据
+	assert.Nil(t, db.Put([]byte("new-key"), []byte("new-value")))
+	assert.Nil(t, db.Delete(utils.GetTestKey(1)))
+	wb = db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("batch-key"), []byte("batch-value")))
+	assert.Nil(t, wb.Commit())
+	_, err = ro.Get([]byte("new-key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, ro.Refresh())
+	val, err = ro.Get([]byte("new-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new-value"), val)
+	val, err = ro.Get([]byte("batch-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("batch-value"), val)
+	_, err = ro.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 有只读实例打开时 merge 的结果暂不加载，不会删除只读实例正在使用的数据文件
+	for i := 2; i < 1500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.True(t, db.hasPendingMerge())
+	assert.Equal(t, ErrMergeIsProgress, db.Merge())
+	assert.Nil(t, ro.Refresh())
+	assert.Equal(t, len(db.ListKeys()), len(ro.ListKeys()))
+	_, err = ro.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 写入进程重新启动时也不会加载
+	db.bgWg.Wait()
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, db.hasPendingMerge())
+	val, err = ro.Get(utils.GetTestKey(1999))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	// 只读实例都关闭之后加载
+	assert.Nil(t, ro.Close())
+	applied, err := db.applyMerge()
+	assert.Nil(t, err)
+	assert.True(t, applied)
+
+	// 写入进程正在删除文件时只读实例无法打开
+	unlockReaders, ok, err := lockReaders(dir)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, err = Open(roOpts)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+	unlockReaders()
+
+	ro, err = Open(roOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, len(db.ListKeys()), len(ro.ListKeys()))
+	val, err = ro.Get(utils.GetTestKey(1999))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+}
+
+func TestDB_ReadOnlyOpen(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(os.TempDir(), "bitcask-go-read-only-not-exist")
+	opts.ReadOnly = true
+	_, err := Open(opts)
+	assert.NotNil(t, err)
+	_, err = os.Stat(opts.DirPath)
+	assert.True(t, os.IsNotExist(err))
+
+	opts.IndexType = BPlusTree
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+
+	// 写入实例调用 Refresh 直接返回
+	dir, _ := os.MkdirTemp("", "bitcask-go-read-only-open")
+	opts = DefaultOptions
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Refresh())
+
+	// 只读实例不在数据目录中创建文件
+	assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+	before, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	opts.ReadOnly = true
+	ro, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, ro.Close())
+	after, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(before), len(after))
+}
@@ -0,0 +1,270 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/flock"
+)
+
+// RepairReport 修复的结果
+type RepairReport struct {
+	DataFiles      int   // 处理的数据文件数量
+	Records        int   // 保留的记录数量
+	SkippedBytes   int64 // 无法解析而跳过的字节数
+	DroppedTxns    int   // 丢弃的未完成事务数量
+	DroppedRecords int   // 未完成事务中被丢弃的记录数量
+}
+
+// repairTxn 一个事务序列号下的批量写记录
+type repairTxn struct {
+	puts     uint64
+	deletes  uint64
+	finished bool
+	num      uint64 // 事务完成记录中的记录数量
+}
+
+// committed 批量写是否完成，没有事务完成记录的单条删除记录是 Delete 写入的
+func (txn *repairTxn) committed() bool {
+	if txn.finished {
+		return txn.num == txn.puts+txn.deletes
+	}
+	return txn.puts == 0 && txn.deletes == 1
+}
+
+// Repair 从损坏的数据目录 dirPath 中尽可能多地找回有效的记录，写入到 opts.DirPath 这个新的目录中
+// 遇到校验失败的数据时，逐个字节向后寻找下一条合法的记录；没有完成的批量写会被丢弃
+// 写入之后会重新生成每个数据文件的 hint 文件、事务序列号和文件 id 文件，opts.DirPath 需要不存在或者为空
+func Repair(dirPath string, opts Options) (*RepairReport, error) {
+	if err := checkOptions(opts); err != nil {
+		return nil, err
+	}
+	if entries, err := os.ReadDir(opts.DirPath); err == nil && len(entries) > 0 {
+		return nil, ErrRepairDirNotEmpty
+	}
+	if _, err := os.Stat(dirPath); err != nil {
+		return nil, err
+	}
+	fileLock := flock.New(filepath.Join(dirPath, fileLockName))
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !hold {
+		return nil, ErrDatabaseIsUsing
+	}
+	defer func() {
+		_ = fileLock.Unlock()
+	}()
+	// 加密的记录需要解密之后才能判断属于哪个批量写，写入新目录时使用当前的密钥重新加密
+	cipher, err := newCipher(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	dirEntries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var fileIds []int
+	for _, entry := range dirEntries {
+		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			fid, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), data.DataFileNameSuffix))
+			if err != nil {
+				return nil, ErrDataDirectoryCorrupted
+			}
+			fileIds = append(fileIds, fid)
+		}
+	}
+	sort.Ints(fileIds)
+
+	// 第一遍找出每个文件中的有效记录，统计每个批量写的记录数量
+	report := &RepairReport{DataFiles: len(fileIds)}
+	offsets := make(map[int][]int64)
+	txns := make(map[uint64]*repairTxn)
+	for _, fid := range fileIds {
+		skipped, err := salvageDataFile(dirPath, uint32(fid), cipher, func(logRecord *data.LogRecord, offset int64) {
+			offsets[fid] = append(offsets[fid], offset)
+			realKey, seqNo := parseLogRecordKey(logRecord.Key)
+			if seqNo == nonTransactionSeqNo {
+				return
+			}
+			txn, ok := txns[seqNo]
+			if !ok {
+				txn = &repairTxn{}
+				txns[seqNo] = txn
+			}
+			switch {
+			case bytes.Equal(realKey, txnFinKey):
+				if len(logRecord.Value) == 8 {
+					txn.finished = true
+					txn.num = binary.BigEndian.Uint64(logRecord.Value)
+				}
+			case logRecord.Type == data.LogRecordNormal:
+				txn.puts++
+			case logRecord.Type == data.LogRecordDeleted:
+				txn.deletes++
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		report.SkippedBytes += skipped
+	}
+	for _, txn := range txns {
+		if (txn.finished || txn.puts+txn.deletes > 0) && !txn.committed() {
+			report.DroppedTxns++
+		}
+	}
+
+	// 第二遍将有效的记录写入到新目录中同名的数据文件
+	if err := os.MkdirAll(opts.DirPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	unlockReaders, err := excludeReaders(opts.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockReaders()
+	for _, fid := range fileIds {
+		if len(offsets[fid]) == 0 {
+			continue
+		}
+		content, err := os.ReadFile(data.GetDataFileName(dirPath, uint32(fid)))
+		if err != nil {
+			return nil, err
+		}
+		dataFile, err := data.OpenDataFile(opts.DirPath, uint32(fid), fio.StandardFIO)
+		if err != nil {
+			return nil, err
+		}
+		dataFile.Cipher = cipher
+		for _, offset := range offsets[fid] {
+			logRecord, _, _ := data.DecodeLogRecord(content[offset:])
+			// 第一遍已经解密过，不会失败
+			logRecord, _ = data.DecryptLogRecord(logRecord, cipher, uint32(fid), offset)
+			realKey, seqNo := parseLogRecordKey(logRecord.Key)
+			if seqNo == nonTransactionSeqNo {
+				// merge 之后的数据不带有事务序列号，原来是通过 hint 文件加载的，改为单条写入的记录
+				if logRecord.Type == data.LogRecordNormal {
+					logRecord.Type = data.LogRecordTxnFinished
+				}
+			} else if logRecord.Type != data.LogRecordTxnFinished && logRecord.Type != data.LogRecordRangeDeleted &&
+				logRecord.Type != data.LogRecordRelocated {
+				if !txns[seqNo].committed() {
+					if !bytes.Equal(realKey, txnFinKey) {
+						report.DroppedRecords++
+					}
+					continue
+				}
+			}
+			encRecord, _, err := dataFile.EncodeLogRecord(logRecord)
+			if err != nil {
+				_ = dataFile.Close()
+				return nil, err
+			}
+			if err := dataFile.Write(encRecord); err != nil {
+				_ = dataFile.Close()
+				return nil, err
+			}
+			report.Records++
+		}
+		if err := dataFile.Sync(); err != nil {
+			_ = dataFile.Close()
+			return nil, err
+		}
+		if err := dataFile.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	// blob 文件中的 value 通过数据文件中的指针读取，原样拷贝到新目录
+	for _, entry := range dirEntries {
+		if !strings.HasSuffix(entry.Name(), data.BlobFileNameSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		if err := utils.CopyFile(filepath.Join(dirPath, entry.Name()), filepath.Join(opts.DirPath, entry.Name()), info.Size()); err != nil {
+			return nil, err
+		}
+	}
+
+	// 打开新目录加载索引，等待后台生成 hint 文件，关闭时写入事务序列号和文件 id
+	opts.ExpireSweepInterval = 0
+	opts.AutoMergeInterval = 0
+	db, err := Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	// B+ 树索引不会从数据文件中加载，新目录中还没有索引
+	if opts.IndexType == BPlusTree {
+		if err := db.loadIndexFromDataFile(); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+	db.bgWg.Wait()
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// salvageDataFile 找出数据文件中所有有效的记录，遇到无法解析的数据时逐个字节向后寻找下一条合法的记录
+// 返回跳过的字节数，加密的记录使用 cipher 解密，校验通过的记录解密失败说明密钥不对，直接返回错误
+func salvageDataFile(dirPath string, fileId uint32, cipher data.Cipher,
+	fn func(logRecord *data.LogRecord, offset int64)) (int64, error) {
+	var skipped int64
+	err := salvageFile(data.GetDataFileName(dirPath, fileId), fileId, cipher, fn, func(_ int64, size int64) {
+		skipped += size
+	})
+	if err != nil {
+		return 0, err
+	}
+	return skipped, nil
+}
+
+// salvageFile 和 salvageDataFile 相同，可以用于数据文件和 blob 文件，每跳过一段连续的无法解析的数据调用一次 skip
+func salvageFile(fileName string, fileId uint32, cipher data.Cipher,
+	fn func(logRecord *data.LogRecord, offset int64), skip func(offset int64, size int64)) error {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	var offset, skipFrom int64 = 0, -1
+	for offset < int64(len(content)) {
+		logRecord, size, err := data.DecodeLogRecord(content[offset:])
+		// hint 文件的结束记录不会出现在数据文件中
+		if err != nil || logRecord.Type == data.LogRecordHintFinished {
+			if skipFrom < 0 {
+				skipFrom = offset
+			}
+			offset++
+			continue
+		}
+		if logRecord, err = data.DecryptLogRecord(logRecord, cipher, fileId, offset); err != nil {
+			return err
+		}
+		if skipFrom >= 0 {
+			skip(skipFrom, offset-skipFrom)
+			skipFrom = -1
+		}
+		fn(logRecord, offset)
+		offset += size
+	}
+	if skipFrom >= 0 {
+		skip(skipFrom, offset-skipFrom)
+	}
+	return nil
+}
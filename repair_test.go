@@ -0,0 +1,95 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepair(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-repair")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.RecoveryMode = RecoveryStrict
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 500; i < 600; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), []byte("batch")))
+	}
+	assert.Nil(t, wb.Commit())
+	db.bgWg.Wait()
+	assert.Nil(t, db.Close())
+
+	// 损坏第一个数据文件中间的一个字节，数据库无法打开
+	fileName := data.GetDataFileName(dir, 0)
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	content[len(content)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+	assert.Nil(t, os.Remove(data.GetDataHintFileName(dir, 0)))
+
+	// 没有完成的批量写
+	dataFile, err := data.OpenDataFile(dir, 10000, fio.StandardFIO)
+	assert.Nil(t, err)
+	for i := 3000; i < 3010; i++ {
+		encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+			Key:   logRecordKeyWithSeq(utils.GetTestKey(i), 10000),
+			Value: []byte("uncommitted"),
+			Type:  data.LogRecordNormal,
+		})
+		assert.Nil(t, dataFile.Write(encRecord))
+	}
+	assert.Nil(t, dataFile.Close())
+
+	_, err = Open(opts)
+	assert.ErrorIs(t, err, data.ErrInvalidCRC)
+
+	repairOpts := DefaultOptions
+	repairDir, _ := os.MkdirTemp("", "bitcask-go-repair-out")
+	defer func() {
+		_ = os.RemoveAll(repairDir)
+	}()
+	repairOpts.DirPath = repairDir
+	repairOpts.DataFileSize = opts.DataFileSize
+
+	// 修复时不能写入到已有数据的目录
+	_, err = Repair(dir, opts)
+	assert.Equal(t, ErrRepairDirNotEmpty, err)
+
+	report, err := Repair(dir, repairOpts)
+	assert.Nil(t, err)
+	assert.Greater(t, report.SkippedBytes, int64(0))
+	assert.Equal(t, 1, report.DroppedTxns)
+	assert.Equal(t, 10, report.DroppedRecords)
+
+	// 修复后的目录可以通过检查，也可以正常打开
+	verifyReport, err := Verify(repairDir)
+	assert.Nil(t, err)
+	assert.True(t, verifyReport.OK)
+
+	db2, err := Open(repairOpts)
+	assert.Nil(t, err)
+	keys := len(db2.ListKeys())
+	assert.LessOrEqual(t, keys, 3000-500)
+	assert.GreaterOrEqual(t, keys, 3000-500-1)
+	_, err = db2.Get(utils.GetTestKey(3000))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db2.Get(utils.GetTestKey(550))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("batch"), val)
+	assert.Nil(t, db2.Close())
+}
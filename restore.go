@@ -0,0 +1,146 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// backupDirs 找出 backupDir 以及其下一级子目录中所有完整的备份，返回清单 id 到备份目录的映射
+func backupDirs(backupDir string) (map[uint64]string, map[uint64]*Manifest, error) {
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	candidates := []string{backupDir}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			candidates = append(candidates, filepath.Join(backupDir, entry.Name()))
+		}
+	}
+
+	dirs := make(map[uint64]string)
+	manifests := make(map[uint64]*Manifest)
+	for _, dir := range candidates {
+		manifest, err := ReadManifest(dir)
+		if err != nil {
+			// 没有清单的目录不是备份，或者备份没有完成
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, nil, err
+		}
+		dirs[manifest.Id] = dir
+		manifests[manifest.Id] = manifest
+	}
+	return dirs, manifests, nil
+}
+
+// Restore 从备份中恢复出完整的数据目录到 targetDir，targetDir 需要不存在或者为空
+// backupDir 是一个备份目录，或者是存放了多个全量、增量备份目录的目录
+// 从 upToManifest 对应的备份开始沿着 ParentId 找到全量备份，再依次应用每个增量备份，upToManifest 为 nil 时恢复到最新的备份
+func Restore(backupDir, targetDir string, upToManifest *Manifest) error {
+	if entries, err := os.ReadDir(targetDir); err == nil && len(entries) > 0 {
+		return ErrRestoreDirNotEmpty
+	}
+	dirs, manifests, err := backupDirs(backupDir)
+	if err != nil {
+		return err
+	}
+	if len(manifests) == 0 {
+		return ErrBackupNotFound
+	}
+
+	var target *Manifest
+	if upToManifest != nil {
+		target = manifests[upToManifest.Id]
+	} else {
+		for _, manifest := range manifests {
+			if target == nil || manifest.Id > target.Id {
+				target = manifest
+			}
+		}
+	}
+	if target == nil {
+		return ErrBackupNotFound
+	}
+
+	// 从目标备份向前找到全量备份
+	chain := []*Manifest{target}
+	for chain[0].ParentId != 0 {
+		parent, ok := manifests[chain[0].ParentId]
+		if !ok {
+			return ErrBackupChainBroken
+		}
+		chain = append([]*Manifest{parent}, chain...)
+	}
+
+	if err := os.MkdirAll(targetDir, os.ModePerm); err != nil {
+		return err
+	}
+	unlockReaders, err := excludeReaders(targetDir)
+	if err != nil {
+		return err
+	}
+	defer unlockReaders()
+	for _, manifest := range chain {
+		if err := applyBackup(dirs[manifest.Id], targetDir, manifest); err != nil {
+			return err
+		}
+	}
+
+	// 事务序列号和下一个文件 id 以最后一个备份为准
+	if err := writeMetaFile(targetDir, data.SeqNoFileName, seqNoKey, strconv.FormatUint(target.SeqNo, 10)); err != nil {
+		return err
+	}
+	return writeMetaFile(targetDir, data.NextFileIdFileName, nextFileIdKey,
+		strconv.FormatUint(uint64(target.NextFileId), 10))
+}
+
+// applyBackup 将一个备份应用到 targetDir 中，应用之后 targetDir 中的文件和备份时刻的数据目录一致
+func applyBackup(dir, targetDir string, manifest *Manifest) error {
+	files := make(map[string]*ManifestFile)
+	for _, file := range manifest.Files {
+		files[file.Name] = file
+	}
+
+	// 删除备份时刻已经不存在的文件，例如被 merge 掉的数据文件
+	entries, err := os.ReadDir(targetDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == readerLockName {
+			continue
+		}
+		if _, ok := files[entry.Name()]; !ok {
+			if err := os.Remove(filepath.Join(targetDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, file := range manifest.Files {
+		src, dest := filepath.Join(dir, file.Name), filepath.Join(targetDir, file.Name)
+		if file.Offset == 0 {
+			if err := utils.CopyFile(src, dest, file.Size); err != nil {
+				return err
+			}
+			continue
+		}
+		// 之前的备份中文件的大小必须和这次备份的起始位置一致
+		info, err := os.Stat(dest)
+		if err != nil || info.Size() != file.Offset {
+			return ErrBackupChainBroken
+		}
+		if file.Offset == file.Size {
+			continue
+		}
+		if err := utils.AppendFile(src, dest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
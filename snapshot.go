@@ -0,0 +1,187 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/index"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot 数据库在某个事务序列号上的只读快照
+// 快照只能看到序列号小于等于 seqNo 的已提交数据，使用完毕后需要调用 Release 释放
+type Snapshot struct {
+	db       *DB
+	seqNo    uint64
+	released atomic.Bool
+}
+
+// keyVersion 快照打开期间某个 key 被覆盖前的版本
+type keyVersion struct {
+	seqNo uint64             // 覆盖这个版本的写入的事务序列号
+	pos   *data.LogRecordPos // 旧版本的位置，为 nil 表示 key 之前不存在
+}
+
+// NewSnapshot 创建一个当前时刻的快照
+func (db *DB) NewSnapshot() *Snapshot {
+	// 锁住全部 slot，保证没有正在进行的写入
+	for slot := range db.mus {
+		db.mus[slot].RLock()
+	}
+	defer func() {
+		for i := len(db.mus) - 1; i >= 0; i-- {
+			db.mus[i].RUnlock()
+		}
+	}()
+
+	snap := &Snapshot{
+		db:    db,
+		seqNo: atomic.LoadUint64(&db.seqNo),
+	}
+	db.snapMu.Lock()
+	db.snapshots[snap] = struct{}{}
+	db.snapMu.Unlock()
+	return snap
+}
+
+// SeqNo 快照对应的事务序列号
+func (s *Snapshot) SeqNo() uint64 {
+	return s.seqNo
+}
+
+// Get 读取快照中 key 对应的数据
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	if s.released.Load() {
+		return nil, ErrSnapshotReleased
+	}
+
+	slot := s.db.hash(key)
+	s.db.mus[slot].RLock()
+	defer s.db.mus[slot].RUnlock()
+
+	logRecordPos := s.db.snapshotPos(key, s.db.index.Get(key), s.seqNo)
+	if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	return s.db.getValueByPosition(slot, logRecordPos)
+}
+
+// NewIterator 创建快照上的迭代器
+func (s *Snapshot) NewIterator(opts IteratorOptions) *Iterator {
+	// 将快照中可见的数据放到一个临时的索引中
+	snapIndex := index.NewBTree()
+	if !s.released.Load() {
+		for slot := range s.db.mus {
+			s.db.mus[slot].RLock()
+		}
+
+		indexIter := s.db.index.Iterator(false)
+		for indexIter.Rewind(); indexIter.Valid(); indexIter.Next() {
+			key := append([]byte(nil), indexIter.Key()...)
+			if pos := s.db.snapshotPos(key, indexIter.Value(), s.seqNo); pos != nil {
+				snapIndex.Put(key, pos)
+			}
+		}
+		indexIter.Close()
+
+		// 快照之后被删除的 key 已经不在内存索引中了
+		s.db.snapMu.Lock()
+		var versionKeys [][]byte
+		for key := range s.db.versions {
+			versionKeys = append(versionKeys, []byte(key))
+		}
+		s.db.snapMu.Unlock()
+		for _, key := range versionKeys {
+			if s.db.index.Get(key) != nil {
+				continue
+			}
+			if pos := s.db.snapshotPos(key, nil, s.seqNo); pos != nil {
+				snapIndex.Put(key, pos)
+			}
+		}
+
+		for i := len(s.db.mus) - 1; i >= 0; i-- {
+			s.db.mus[i].RUnlock()
+		}
+	}
+
+	return &Iterator{
+		indexIter: snapIndex.Iterator(opts.Reverse),
+		db:        s.db,
+		options:   opts,
+	}
+}
+
+// Release 释放快照，不再为其保留旧版本数据
+func (s *Snapshot) Release() {
+	if !s.released.CompareAndSwap(false, true) {
+		return
+	}
+
+	db := s.db
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+	delete(db.snapshots, s)
+
+	// 没有快照了，清空所有旧版本
+	if len(db.snapshots) == 0 {
+		db.versions = make(map[string][]*keyVersion)
+		return
+	}
+
+	// 只保留最老的快照之后被覆盖的版本
+	minSeqNo := ^uint64(0)
+	for snap := range db.snapshots {
+		if snap.seqNo < minSeqNo {
+			minSeqNo = snap.seqNo
+		}
+	}
+	for key, versions := range db.versions {
+		var idx int
+		for idx < len(versions) && versions[idx].seqNo <= minSeqNo {
+			idx++
+		}
+		if idx == len(versions) {
+			delete(db.versions, key)
+		} else {
+			db.versions[key] = versions[idx:]
+		}
+	}
+}
+
+// retainVersion 有快照打开时，保留 key 被 seqNo 覆盖之前的版本
+// 调用时需要持有 key 所在 slot 的写锁
+func (db *DB) retainVersion(key []byte, oldPos *data.LogRecordPos, seqNo uint64) {
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+	if len(db.snapshots) == 0 {
+		return
+	}
+	db.versions[string(key)] = append(db.versions[string(key)], &keyVersion{
+		seqNo: seqNo,
+		pos:   oldPos,
+	})
+}
+
+// snapshotPos 获取 key 在 seqNo 时刻的位置信息，currentPos 为内存索引中当前的位置
+func (db *DB) snapshotPos(key []byte, currentPos *data.LogRecordPos, seqNo uint64) *data.LogRecordPos {
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+	// 第一个在快照之后发生的覆盖，其覆盖前的版本就是快照看到的版本
+	for _, version := range db.versions[string(key)] {
+		if version.seqNo > seqNo {
+			return version.pos
+		}
+	}
+	return currentPos
+}
+
+// modifiedAfter 判断 key 在 seqNo 之后是否被修改过，只对打开的快照之后的修改有效
+func (db *DB) modifiedAfter(key []byte, seqNo uint64) bool {
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+	versions := db.versions[string(key)]
+	return len(versions) > 0 && versions[len(versions)-1].seqNo > seqNo
+}
@@ -0,0 +1,103 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot_Get(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-get")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), []byte("v2"))
+	assert.Nil(t, err)
+
+	snap := db.NewSnapshot()
+
+	// 快照之后的写入、删除、批量写都不可见
+	err = db.Put(utils.GetTestKey(1), []byte("v1-new"))
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	_ = wb.Put(utils.GetTestKey(3), []byte("v3"))
+	_ = wb.Put(utils.GetTestKey(1), []byte("v1-batch"))
+	assert.Nil(t, wb.Commit())
+
+	val, err := snap.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	val, err = snap.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+	_, err = snap.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 数据库读取的是最新的数据
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1-batch"), val)
+
+	// 释放之后不再保留旧版本
+	snap.Release()
+	_, err = snap.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrSnapshotReleased, err)
+	assert.Equal(t, 0, len(db.versions))
+}
+
+func TestSnapshot_NewIterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-iterator")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	snap1 := db.NewSnapshot()
+	for i := 0; i < 5; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	snap2 := db.NewSnapshot()
+	for i := 10; i < 20; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	countKeys := func(snap *Snapshot) int {
+		iter := snap.NewIterator(DefaultIteratorOptions)
+		defer iter.Close()
+		var count int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			val, err := iter.Value()
+			assert.Nil(t, err)
+			assert.Equal(t, iter.Key(), val)
+			count++
+		}
+		return count
+	}
+	assert.Equal(t, 10, countKeys(snap1))
+	assert.Equal(t, 5, countKeys(snap2))
+
+	// 释放较老的快照后，较新的快照依然可用
+	snap1.Release()
+	assert.Equal(t, 5, countKeys(snap2))
+	snap2.Release()
+	assert.Equal(t, 15, len(db.ListKeys()))
+}
@@ -0,0 +1,144 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"sync"
+)
+
+// Txn 乐观读写事务
+// 读取基于事务开始时的快照，写入暂存在内存中，提交时如果读过的 key 在事务开始之后被修改过，则提交失败
+type Txn struct {
+	mu            *sync.Mutex
+	db            *DB
+	snapshot      *Snapshot                  // 事务开始时的快照
+	pendingWrites map[string]*data.LogRecord // 暂存用户写入的数据
+	readKeys      map[string]struct{}        // 事务中读取过的 key
+	finished      bool                       // 事务是否已经提交或回滚
+}
+
+// Begin 开启一个读写事务
+func (db *DB) Begin() *Txn {
+	return &Txn{
+		mu:            new(sync.Mutex),
+		db:            db,
+		snapshot:      db.NewSnapshot(),
+		pendingWrites: make(map[string]*data.LogRecord),
+		readKeys:      make(map[string]struct{}),
+	}
+}
+
+// Get 读取数据，优先读取事务中暂存的数据
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return nil, ErrTxnFinished
+	}
+
+	// 事务自身的写入
+	if record, ok := txn.pendingWrites[string(key)]; ok {
+		if record.Type == data.LogRecordDeleted {
+			return nil, ErrKeyNotFound
+		}
+		return record.Value, nil
+	}
+
+	// 不存在的 key 也要记录，防止其他事务在此期间写入
+	txn.readKeys[string(key)] = struct{}{}
+	return txn.snapshot.Get(key)
+}
+
+// Put 在事务中写入数据
+func (txn *Txn) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return ErrTxnFinished
+	}
+	if txn.db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	txn.pendingWrites[string(key)] = &data.LogRecord{Key: key, Value: value}
+	return nil
+}
+
+// Delete 在事务中删除数据
+func (txn *Txn) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return ErrTxnFinished
+	}
+	if txn.db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	txn.pendingWrites[string(key)] = &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
+	return nil
+}
+
+// Commit 提交事务，读过的 key 在事务开始之后被修改过则返回 ErrTxnConflict
+func (txn *Txn) Commit() error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return ErrTxnFinished
+	}
+	txn.finished = true
+	defer txn.snapshot.Release()
+
+	// 只读事务，直接返回
+	if len(txn.pendingWrites) == 0 {
+		return nil
+	}
+
+	// 读写涉及的 slot 都需要加锁，校验和写入之间不能有其他的写入
+	keys := make([]string, 0, len(txn.pendingWrites)+len(txn.readKeys))
+	writeKeys := make([]string, 0, len(txn.pendingWrites))
+	for key := range txn.pendingWrites {
+		keys = append(keys, key)
+		writeKeys = append(writeKeys, key)
+	}
+	for key := range txn.readKeys {
+		keys = append(keys, key)
+	}
+	// 冲突检测需要读到之前的写入，需要持久化时和其他写入者合并 Sync
+	slots := txn.db.sortedSlots(keys)
+	return txn.db.writeSlots(slots, true, txn.db.options.SyncWrites, func() (func(), error) {
+		return txn.commitLocked(writeKeys)
+	})
+}
+
+// commitLocked 检查冲突并写入暂存的数据，返回更新内存索引的函数，调用前需要持有读写涉及的所有 slot 的写锁
+func (txn *Txn) commitLocked(writeKeys []string) (func(), error) {
+	// 冲突检测
+	for key := range txn.readKeys {
+		if txn.db.modifiedAfter([]byte(key), txn.snapshot.seqNo) {
+			return nil, ErrTxnConflict
+		}
+	}
+
+	return txn.db.commitRecords(txn.pendingWrites, txn.db.sortedSlots(writeKeys), txn.db.options.SyncWrites)
+}
+
+// Rollback 回滚事务，丢弃所有暂存的写入
+func (txn *Txn) Rollback() {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return
+	}
+	txn.finished = true
+	txn.pendingWrites = nil
+	txn.snapshot.Release()
+}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"hash/crc32"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -85,3 +87,120 @@ func CopyDir(src, dest string, exclude []string) error {
 		return os.WriteFile(filepath.Join(dest, fileName), data, info.Mode())
 	})
 }
+
+// CopyFile 拷贝文件的前 size 个字节，数据分块读写，不会一次性读入内存
+func CopyFile(src, dest string, size int64) error {
+	return CopyFileRange(src, dest, 0, size)
+}
+
+// CopyFileRange 拷贝文件中 [offset, size) 范围内的数据到新的文件中
+func CopyFileRange(src, dest string, offset, size int64) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = srcFile.Close()
+	}()
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destFile, io.NewSectionReader(srcFile, offset, size-offset)); err != nil {
+		_ = destFile.Close()
+		return err
+	}
+	if err := destFile.Sync(); err != nil {
+		_ = destFile.Close()
+		return err
+	}
+	return destFile.Close()
+}
+
+// AppendFile 将 src 文件的全部数据追加到 dest 文件的末尾
+func AppendFile(src, dest string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = srcFile.Close()
+	}()
+	destFile, err := os.OpenFile(dest, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destFile, srcFile); err != nil {
+		_ = destFile.Close()
+		return err
+	}
+	if err := destFile.Sync(); err != nil {
+		_ = destFile.Close()
+		return err
+	}
+	return destFile.Close()
+}
+
+// LinkOrCopyFile 为不会再修改的文件创建硬链接，不在同一个文件系统等无法创建硬链接时拷贝文件
+func LinkOrCopyFile(src, dest string, size int64) error {
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+	return CopyFile(src, dest, size)
+}
+
+// FileInode 返回文件的 inode 编号，同名的文件被替换之后 inode 会变化
+func FileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
+// ChecksumRange 计算文件中 [offset, size) 范围内数据的 CRC 校验值
+func ChecksumRange(path string, offset, size int64) (uint32, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	hash := crc32.NewIEEE()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, offset, size-offset)); err != nil {
+		return 0, err
+	}
+	return hash.Sum32(), nil
+}
+
+// TryRLockFile 对已经存在的文件加共享锁，文件不存在时不会创建，直接返回 nil
+// 其他进程持有排他锁时 locked 为 false，关闭返回的文件即释放锁
+func TryRLockFile(fileName string) (file *os.File, locked bool, err error) {
+	return tryLockFile(fileName, syscall.LOCK_SH)
+}
+
+// TryLockFile 和 TryRLockFile 相同，加的是排他锁，其他进程持有共享锁或者排他锁时 locked 为 false
+func TryLockFile(fileName string) (file *os.File, locked bool, err error) {
+	return tryLockFile(fileName, syscall.LOCK_EX)
+}
+
+func tryLockFile(fileName string, how int) (file *os.File, locked bool, err error) {
+	file, err = os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, true, nil
+		}
+		return nil, false, err
+	}
+	if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+		_ = file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return file, true, nil
+}
@@ -0,0 +1,600 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type VerifyProblemKind = string
+
+const (
+	// VerifyCorruptRecord 记录校验失败
+	VerifyCorruptRecord VerifyProblemKind = "corrupt_record"
+
+	// VerifyTornTail 文件末尾有写了一半的记录
+	VerifyTornTail VerifyProblemKind = "torn_tail"
+
+	// VerifyIncompleteTxn 批量写的数据没有对应的事务完成记录，或者记录数量对不上
+	VerifyIncompleteTxn VerifyProblemKind = "incomplete_txn"
+
+	// VerifyInvalidHint hint 文件没有写完或者和数据文件不一致
+	VerifyInvalidHint VerifyProblemKind = "invalid_hint"
+
+	// VerifyDanglingHint hint 文件中的索引指向不存在的数据
+	VerifyDanglingHint VerifyProblemKind = "dangling_hint"
+
+	// VerifyInvalidMetaFile 事务序列号、文件 id、merge 完成标识等文件无效
+	VerifyInvalidMetaFile VerifyProblemKind = "invalid_meta_file"
+
+	// VerifyLeftoverMergeDir 存在残留的 merge 目录
+	VerifyLeftoverMergeDir VerifyProblemKind = "leftover_merge_dir"
+
+	// VerifyDanglingBlob key 最新的记录指向的 blob 文件或者其中的 value 不存在
+	VerifyDanglingBlob VerifyProblemKind = "dangling_blob"
+)
+
+// VerifyReport 数据目录的检查结果
+type VerifyReport struct {
+	DirPath  string           `json:"dir_path"`
+	OK       bool             `json:"ok"` // 没有发现任何问题
+	Files    []*VerifyFile    `json:"files"`
+	Problems []*VerifyProblem `json:"problems"`
+}
+
+// VerifyFile 检查过的文件
+type VerifyFile struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Records int    `json:"records"` // 有效的记录数量
+}
+
+// VerifyProblem 发现的问题
+type VerifyProblem struct {
+	Kind    VerifyProblemKind `json:"kind"`
+	File    string            `json:"file,omitempty"`
+	Offset  int64             `json:"offset"`
+	SeqNo   uint64            `json:"seq_no,omitempty"`
+	Message string            `json:"message"`
+}
+
+// verifier 检查数据目录时的状态
+type verifier struct {
+	dirPath   string
+	report    *VerifyReport
+	dataSizes map[uint32]int64  // 数据文件的大小
+	txnCounts map[uint64]uint64 // 每个事务序列号下批量写的记录数量
+	txnPuts   map[uint64]bool   // 事务序列号下是否有写入的记录，只有删除记录的是单条 Delete
+	txnFins   map[uint64]uint64 // 事务完成记录中的记录数量
+	cipher    data.Cipher       // 解密加密的记录，没有提供密钥时为 nil
+	now       int64
+
+	blobSizes       map[uint32]int64          // blob 文件的大小
+	blobRefs        map[string]*verifyBlobRef // 每个 key 最新的记录指向的 blob 中的 value
+	rangeTombstones tombstoneIndex            // 范围删除记录，被覆盖的 key 的 value 可能已经被回收了
+}
+
+// verifyBlobRef 数据文件中指向 blob 文件的记录
+type verifyBlobRef struct {
+	key    string
+	file   string
+	offset int64
+	seqNo  uint64
+	pos    *data.LogRecordPos // blob 文件中的位置
+}
+
+// Verify 离线检查数据目录，校验数据文件、blob 文件、hint 文件、事务序列号文件、merge 完成标识文件中的每条记录，
+// 检查没有完成的事务、hint 文件中无效的索引、指向不存在的 blob 的记录以及残留的 merge 目录，不会修改任何数据
+// 检查期间对已有的锁文件加共享锁，不会创建锁文件，数据库正在使用时返回 ErrDatabaseIsUsing
+// 没有密钥，遇到加密的记录时返回 data.ErrNoCipher，加密的数据目录使用 VerifyWithKeys 检查
+func Verify(dirPath string) (*VerifyReport, error) {
+	return VerifyWithKeys(dirPath, nil)
+}
+
+// VerifyWithKeys 和 Verify 相同，使用 keys 中的密钥解密加密的记录，密钥不对时返回 ErrDecryptFailed
+func VerifyWithKeys(dirPath string, keys KeyProvider) (*VerifyReport, error) {
+	if _, err := os.Stat(dirPath); err != nil {
+		return nil, err
+	}
+	cipher, err := newCipher(Options{Encryption: keys})
+	if err != nil {
+		return nil, err
+	}
+	// 只对已经存在的锁文件加共享锁，不创建锁文件，和数据库实例、Repair 持有的排他锁互斥
+	lockFile, locked, err := utils.TryRLockFile(filepath.Join(dirPath, fileLockName))
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, ErrDatabaseIsUsing
+	}
+	if lockFile != nil {
+		defer func() {
+			_ = lockFile.Close()
+		}()
+	}
+
+	v := &verifier{
+		dirPath:   dirPath,
+		cipher:    cipher,
+		report:    &VerifyReport{DirPath: dirPath, Files: []*VerifyFile{}, Problems: []*VerifyProblem{}},
+		dataSizes: make(map[uint32]int64),
+		txnCounts: make(map[uint64]uint64),
+		txnPuts:   make(map[uint64]bool),
+		txnFins:   make(map[uint64]uint64),
+		now:       time.Now().UnixNano(),
+		blobSizes: make(map[uint32]int64),
+		blobRefs:  make(map[string]*verifyBlobRef),
+	}
+
+	dirEntries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var dataFileIds, hintFileIds, blobFileIds []uint32
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, data.DataFileNameSuffix):
+			fid, err := strconv.Atoi(strings.TrimSuffix(name, data.DataFileNameSuffix))
+			if err != nil {
+				return nil, ErrDataDirectoryCorrupted
+			}
+			dataFileIds = append(dataFileIds, uint32(fid))
+		case strings.HasSuffix(name, data.DataHintFileSuffix):
+			fid, err := strconv.Atoi(strings.TrimSuffix(name, data.DataHintFileSuffix))
+			if err != nil {
+				return nil, ErrDataDirectoryCorrupted
+			}
+			hintFileIds = append(hintFileIds, uint32(fid))
+		case strings.HasSuffix(name, data.BlobFileNameSuffix):
+			fid, err := strconv.Atoi(strings.TrimSuffix(name, data.BlobFileNameSuffix))
+			if err != nil {
+				return nil, ErrDataDirectoryCorrupted
+			}
+			blobFileIds = append(blobFileIds, uint32(fid))
+		}
+	}
+	sort.Slice(dataFileIds, func(i, j int) bool { return dataFileIds[i] < dataFileIds[j] })
+	sort.Slice(hintFileIds, func(i, j int) bool { return hintFileIds[i] < hintFileIds[j] })
+	sort.Slice(blobFileIds, func(i, j int) bool { return blobFileIds[i] < blobFileIds[j] })
+
+	for _, fid := range dataFileIds {
+		if err := v.verifyDataFile(fid); err != nil {
+			return nil, err
+		}
+	}
+	v.verifyTxns()
+	for _, fid := range blobFileIds {
+		if err := v.verifyBlobFile(fid); err != nil {
+			return nil, err
+		}
+	}
+	if err := v.verifyBlobRefs(); err != nil {
+		return nil, err
+	}
+	for _, fid := range hintFileIds {
+		if err := v.verifyDataHintFile(fid); err != nil {
+			return nil, err
+		}
+	}
+	if err := v.verifyMergeHintFile(); err != nil {
+		return nil, err
+	}
+	if err := v.verifyMetaFiles(); err != nil {
+		return nil, err
+	}
+	v.verifyMergeDir()
+
+	v.report.OK = len(v.report.Problems) == 0
+	return v.report, nil
+}
+
+func (v *verifier) addProblem(kind VerifyProblemKind, file string, offset int64, seqNo uint64, format string, args ...any) {
+	v.report.Problems = append(v.report.Problems, &VerifyProblem{
+		Kind:    kind,
+		File:    file,
+		Offset:  offset,
+		SeqNo:   seqNo,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// openFile 以只读的方式使用文件，文件不存在时返回 nil
+func (v *verifier) openFile(fileName string, open func() (*data.DataFile, error)) (*data.DataFile, error) {
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return open()
+}
+
+// verifyDataFile 校验数据文件中的每条记录，并统计批量写的记录
+// 和 Repair 一样遇到损坏的记录时向后寻找下一条合法的记录，损坏的记录中的长度也可能是错误的
+func (v *verifier) verifyDataFile(fid uint32) error {
+	fileName := data.GetDataFileName(v.dirPath, fid)
+	name := filepath.Base(fileName)
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+	v.dataSizes[fid] = fileSize
+
+	file := &VerifyFile{Name: name, Size: fileSize}
+	v.report.Files = append(v.report.Files, file)
+	return salvageFile(fileName, fid, v.cipher, func(logRecord *data.LogRecord, offset int64) {
+		file.Records++
+
+		// merge 之后的记录不再带有事务序列号
+		realKey, seqNo := parseLogRecordKey(logRecord.Key)
+		if !bytes.Equal(realKey, txnFinKey) {
+			v.trackBlobRef(name, offset, realKey, seqNo, logRecord)
+		}
+		switch {
+		case seqNo == nonTransactionSeqNo:
+		case bytes.Equal(realKey, txnFinKey):
+			if len(logRecord.Value) != 8 {
+				v.addProblem(VerifyCorruptRecord, name, offset, seqNo, "invalid transaction finished record")
+			} else {
+				v.txnFins[seqNo] = binary.BigEndian.Uint64(logRecord.Value)
+			}
+		case logRecord.Type == data.LogRecordNormal:
+			v.txnCounts[seqNo]++
+			v.txnPuts[seqNo] = true
+		case logRecord.Type == data.LogRecordDeleted:
+			v.txnCounts[seqNo]++
+		}
+	}, func(offset int64, size int64) {
+		v.addSkipped(name, offset, size, fileSize)
+	})
+}
+
+// addSkipped 记录扫描时跳过的一段无法解析的数据，一直到文件末尾的是写了一半的记录
+func (v *verifier) addSkipped(file string, offset int64, size int64, fileSize int64) {
+	if offset+size >= fileSize {
+		v.addProblem(VerifyTornTail, file, offset, 0, "incomplete or corrupted record at the end, %d bytes", size)
+		return
+	}
+	v.addProblem(VerifyCorruptRecord, file, offset, 0, "%d bytes skipped before the next valid record", size)
+}
+
+// trackBlobRef 记录每个 key 最新的记录是否指向 blob 文件，同一个 key 的记录都在同一个 slot 的文件中，按照文件 id 的顺序读取即可
+// 只有最新的记录指向的 value 需要存在，之前的记录和已经过期的记录指向的 value 可能已经被回收了
+func (v *verifier) trackBlobRef(file string, offset int64, key []byte, seqNo uint64, logRecord *data.LogRecord) {
+	if logRecord.Type == data.LogRecordRangeDeleted {
+		v.rangeTombstones.add(&rangeTombstone{start: key, end: logRecord.Value, seqNo: seqNo})
+		return
+	}
+	expired := logRecord.Expire > 0 && logRecord.Expire <= v.now
+	if logRecord.Type == data.LogRecordDeleted || !logRecord.Blob || expired {
+		delete(v.blobRefs, string(key))
+		return
+	}
+	v.blobRefs[string(key)] = &verifyBlobRef{
+		key:    string(key),
+		file:   file,
+		offset: offset,
+		seqNo:  seqNo,
+		pos:    data.DecodeLogRecordPos(logRecord.Value),
+	}
+}
+
+// verifyBlobFile 校验 blob 文件中的每条记录
+func (v *verifier) verifyBlobFile(fid uint32) error {
+	fileName := data.GetBlobFileName(v.dirPath, fid)
+	name := filepath.Base(fileName)
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+	v.blobSizes[fid] = fileSize
+
+	file := &VerifyFile{Name: name, Size: fileSize}
+	v.report.Files = append(v.report.Files, file)
+	return salvageFile(fileName, fid, v.cipher, func(*data.LogRecord, int64) {
+		file.Records++
+	}, func(offset int64, size int64) {
+		v.addSkipped(name, offset, size, fileSize)
+	})
+}
+
+// verifyBlobRefs 检查每个 key 最新的记录指向的 blob 文件中是否有对应的 value
+func (v *verifier) verifyBlobRefs() error {
+	refs := make([]*verifyBlobRef, 0, len(v.blobRefs))
+	for _, ref := range v.blobRefs {
+		// 被之后的范围删除覆盖了
+		if v.rangeTombstones.maxSeqNo([]byte(ref.key)) > ref.seqNo {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].file != refs[j].file {
+			return refs[i].file < refs[j].file
+		}
+		return refs[i].offset < refs[j].offset
+	})
+
+	blobFiles := make(map[uint32]*data.DataFile)
+	defer func() {
+		for _, blobFile := range blobFiles {
+			_ = blobFile.Close()
+		}
+	}()
+	for _, ref := range refs {
+		if _, ok := v.blobSizes[ref.pos.Fid]; !ok {
+			v.addProblem(VerifyDanglingBlob, ref.file, ref.offset, 0, "blob file %d does not exist", ref.pos.Fid)
+			continue
+		}
+		blobFile, ok := blobFiles[ref.pos.Fid]
+		if !ok {
+			var err error
+			if blobFile, err = data.OpenBlobFile(v.dirPath, ref.pos.Fid); err != nil {
+				return err
+			}
+			blobFile.Cipher = v.cipher
+			blobFiles[ref.pos.Fid] = blobFile
+		}
+		blobRecord, _, err := blobFile.ReadLogRecord(ref.pos.Offset)
+		if err == data.ErrNoCipher || err == ErrDecryptFailed {
+			return err
+		}
+		if err != nil || string(blobRecord.Key) != ref.key {
+			v.addProblem(VerifyDanglingBlob, ref.file, ref.offset, 0,
+				"no matching value at offset %d of blob file %d", ref.pos.Offset, ref.pos.Fid)
+		}
+	}
+	return nil
+}
+
+// verifyTxns 检查批量写的记录和事务完成记录是否匹配
+func (v *verifier) verifyTxns() {
+	var seqNos []uint64
+	for seqNo := range v.txnCounts {
+		seqNos = append(seqNos, seqNo)
+	}
+	for seqNo := range v.txnFins {
+		if _, ok := v.txnCounts[seqNo]; !ok {
+			seqNos = append(seqNos, seqNo)
+		}
+	}
+	sort.Slice(seqNos, func(i, j int) bool { return seqNos[i] < seqNos[j] })
+
+	for _, seqNo := range seqNos {
+		num, finished := v.txnFins[seqNo]
+		switch {
+		case !finished && v.txnPuts[seqNo]:
+			v.addProblem(VerifyIncompleteTxn, "", 0, seqNo,
+				"%d records without transaction finished record", v.txnCounts[seqNo])
+		case finished && num != v.txnCounts[seqNo]:
+			v.addProblem(VerifyIncompleteTxn, "", 0, seqNo,
+				"expect %d records, found %d", num, v.txnCounts[seqNo])
+		}
+	}
+}
+
+// verifyDataHintFile 校验数据文件的 hint 文件，并检查其中的每条索引是否指向数据文件中对应的记录
+func (v *verifier) verifyDataHintFile(fid uint32) error {
+	name := filepath.Base(data.GetDataHintFileName(v.dirPath, fid))
+	hintFile, err := data.OpenDataHintFile(v.dirPath, fid)
+	if err != nil {
+		return err
+	}
+	hintFile.Cipher = v.cipher
+	defer func() {
+		_ = hintFile.Close()
+	}()
+	fileSize, err := hintFile.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	file := &VerifyFile{Name: name, Size: fileSize}
+	v.report.Files = append(v.report.Files, file)
+
+	dataSize, ok := v.dataSizes[fid]
+	if !ok {
+		v.addProblem(VerifyDanglingHint, name, 0, 0, "data file %d does not exist", fid)
+		return nil
+	}
+	dataFile, err := data.OpenDataFile(v.dirPath, fid, fio.StandardFIO)
+	if err != nil {
+		return err
+	}
+	dataFile.Cipher = v.cipher
+	defer func() {
+		_ = dataFile.Close()
+	}()
+
+	var offset int64 = 0
+	for {
+		hintRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err == data.ErrInvalidCRC {
+			v.addProblem(VerifyInvalidHint, name, offset, 0, "crc mismatch")
+			return nil
+		}
+		if err != nil {
+			if err == io.EOF {
+				v.addProblem(VerifyInvalidHint, name, offset, 0, "hint finished record not found")
+				return nil
+			}
+			return err
+		}
+		file.Records++
+
+		if hintRecord.Type == data.LogRecordHintFinished {
+			if size, n := binary.Varint(hintRecord.Value); n <= 0 || size != dataSize {
+				v.addProblem(VerifyInvalidHint, name, offset, 0,
+					"data file size is %d, but hint file is written for %d", dataSize, size)
+			}
+			return nil
+		}
+		record, pos := data.DecodeDataHintRecord(hintRecord)
+		if record == nil {
+			v.addProblem(VerifyInvalidHint, name, offset, 0, "invalid hint record")
+			return nil
+		}
+		logRecord, _, err := dataFile.ReadLogRecord(pos.Offset)
+		if err != nil || !bytes.Equal(logRecord.Key, record.Key) || logRecord.Type != record.Type {
+			v.addProblem(VerifyDanglingHint, name, offset, 0,
+				"no matching record at offset %d of data file %d", pos.Offset, fid)
+		}
+		offset += size
+	}
+}
+
+// verifyMergeHintFile 校验 merge 生成的 hint 文件，并检查其中的每条索引是否指向 merge 之后的数据文件中的记录
+func (v *verifier) verifyMergeHintFile() error {
+	fileName := filepath.Join(v.dirPath, data.HintFileName)
+	hintFile, err := v.openFile(fileName, func() (*data.DataFile, error) {
+		return data.OpenHintFile(v.dirPath)
+	})
+	if err != nil || hintFile == nil {
+		return err
+	}
+	hintFile.Cipher = v.cipher
+	defer func() {
+		_ = hintFile.Close()
+	}()
+	fileSize, err := hintFile.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	file := &VerifyFile{Name: data.HintFileName, Size: fileSize}
+	v.report.Files = append(v.report.Files, file)
+
+	dataFiles := make(map[uint32]*data.DataFile)
+	defer func() {
+		for _, dataFile := range dataFiles {
+			_ = dataFile.Close()
+		}
+	}()
+	var offset int64 = 0
+	for {
+		hintRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err == data.ErrInvalidCRC {
+			v.addProblem(VerifyInvalidHint, data.HintFileName, offset, 0, "crc mismatch")
+			return nil
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		file.Records++
+
+		pos := data.DecodeLogRecordPos(hintRecord.Value)
+		if _, ok := v.dataSizes[pos.Fid]; !ok {
+			v.addProblem(VerifyDanglingHint, data.HintFileName, offset, 0, "data file %d does not exist", pos.Fid)
+			offset += size
+			continue
+		}
+		dataFile, ok := dataFiles[pos.Fid]
+		if !ok {
+			if dataFile, err = data.OpenDataFile(v.dirPath, pos.Fid, fio.StandardFIO); err != nil {
+				return err
+			}
+			dataFile.Cipher = v.cipher
+			dataFiles[pos.Fid] = dataFile
+		}
+		logRecord, _, err := dataFile.ReadLogRecord(pos.Offset)
+		if err == nil {
+			realKey, _ := parseLogRecordKey(logRecord.Key)
+			if !bytes.Equal(realKey, hintRecord.Key) {
+				err = ErrKeyNotFound
+			}
+		}
+		if err != nil {
+			v.addProblem(VerifyDanglingHint, data.HintFileName, offset, 0,
+				"no matching record at offset %d of data file %d", pos.Offset, pos.Fid)
+		}
+		offset += size
+	}
+}
+
+// verifyMetaFiles 校验事务序列号文件、下一个文件 id 文件和 merge 完成标识文件
+func (v *verifier) verifyMetaFiles() error {
+	metaFiles := []struct {
+		name  string
+		open  func(dirPath string) (*data.DataFile, error)
+		check func(record *data.LogRecord) bool
+	}{
+		{data.SeqNoFileName, data.OpenSeqNoFIle, func(record *data.LogRecord) bool {
+			_, err := strconv.ParseUint(string(record.Value), 10, 64)
+			return string(record.Key) == seqNoKey && err == nil
+		}},
+		{data.NextFileIdFileName, data.OpenNextFileIdFile, func(record *data.LogRecord) bool {
+			_, err := strconv.ParseUint(string(record.Value), 10, 64)
+			return string(record.Key) == nextFileIdKey && err == nil
+		}},
+		{data.MergeFinishedFileName, data.OpenMergeFinishedFile, func(record *data.LogRecord) bool {
+			if string(record.Key) == mergeCompactedKey {
+				for _, fid := range strings.Split(string(record.Value), ",") {
+					if _, err := strconv.Atoi(fid); err != nil {
+						return false
+					}
+				}
+				return true
+			}
+			_, err := strconv.Atoi(string(record.Value))
+			return string(record.Key) == mergeFinishedKye && err == nil
+		}},
+	}
+
+	for _, meta := range metaFiles {
+		metaFile, err := v.openFile(filepath.Join(v.dirPath, meta.name), func() (*data.DataFile, error) {
+			return meta.open(v.dirPath)
+		})
+		if err != nil {
+			return err
+		}
+		if metaFile == nil {
+			continue
+		}
+		size, err := metaFile.IoManager.Size()
+		if err != nil {
+			_ = metaFile.Close()
+			return err
+		}
+		file := &VerifyFile{Name: meta.name, Size: size}
+		v.report.Files = append(v.report.Files, file)
+
+		record, _, err := metaFile.ReadLogRecord(0)
+		_ = metaFile.Close()
+		switch {
+		case err != nil && err != io.EOF && err != data.ErrInvalidCRC:
+			return err
+		case err != nil:
+			v.addProblem(VerifyInvalidMetaFile, meta.name, 0, 0, "failed to read record: %v", err)
+		case !meta.check(record):
+			v.addProblem(VerifyInvalidMetaFile, meta.name, 0, 0, "invalid record %q: %q", record.Key, record.Value)
+		default:
+			file.Records++
+		}
+	}
+	return nil
+}
+
+// verifyMergeDir 检查是否有残留的 merge 目录
+func (v *verifier) verifyMergeDir() {
+	mergePath := getMergePath(v.dirPath)
+	if _, err := os.Stat(mergePath); err != nil {
+		return
+	}
+	if _, err := os.Stat(filepath.Join(mergePath, data.MergeFinishedFileName)); err == nil {
+		v.addProblem(VerifyLeftoverMergeDir, mergePath, 0, 0, "merge is finished and will be applied on next open")
+	} else {
+		v.addProblem(VerifyLeftoverMergeDir, mergePath, 0, 0, "merge is not finished and will be removed on next open")
+	}
+}
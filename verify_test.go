@@ -0,0 +1,195 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func verifyProblemKinds(report *VerifyReport) map[VerifyProblemKind]bool {
+	kinds := make(map[VerifyProblemKind]bool)
+	for _, problem := range report.Problems {
+		kinds[problem.Kind] = true
+	}
+	return kinds
+}
+
+func TestVerify(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-verify")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 500; i < 600; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), []byte("batch")))
+	}
+	assert.Nil(t, wb.Commit())
+
+	// 数据库正在使用
+	_, err = Verify(dir)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+
+	assert.Nil(t, db.Close())
+	report, err := Verify(dir)
+	assert.Nil(t, err)
+	assert.True(t, report.OK)
+	assert.Empty(t, report.Problems)
+	assert.NotEmpty(t, report.Files)
+
+	// merge 之后的数据也是完整的
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	report, err = Verify(dir)
+	assert.Nil(t, err)
+	assert.True(t, report.OK)
+
+	// 没有事务完成记录的批量写，以及末尾写了一半的记录
+	dataFile, err := data.OpenDataFile(dir, 10000, fio.StandardFIO)
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+			Key:   logRecordKeyWithSeq(utils.GetTestKey(i), 10000),
+			Value: []byte("uncommitted"),
+			Type:  data.LogRecordNormal,
+		})
+		assert.Nil(t, dataFile.Write(encRecord))
+	}
+	assert.Nil(t, dataFile.Write([]byte{1, 2, 3}))
+	assert.Nil(t, dataFile.Close())
+
+	// hint 文件没有写完
+	hintFileName := data.GetDataHintFileName(dir, 10001)
+	assert.Nil(t, os.WriteFile(data.GetDataFileName(dir, 10001), nil, 0644))
+	assert.Nil(t, os.WriteFile(hintFileName, []byte{1, 2, 3}, 0644))
+
+	// 数据文件不存在的 hint 文件
+	assert.Nil(t, os.WriteFile(data.GetDataHintFileName(dir, 10002), nil, 0644))
+
+	// 残留的 merge 目录
+	assert.Nil(t, os.MkdirAll(getMergePath(dir), os.ModePerm))
+	defer func() {
+		_ = os.RemoveAll(getMergePath(dir))
+	}()
+
+	// 事务序列号文件无效
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, data.SeqNoFileName), []byte("invalid"), 0644))
+
+	report, err = Verify(dir)
+	assert.Nil(t, err)
+	assert.False(t, report.OK)
+	kinds := verifyProblemKinds(report)
+	assert.True(t, kinds[VerifyIncompleteTxn])
+	assert.True(t, kinds[VerifyTornTail])
+	assert.True(t, kinds[VerifyInvalidHint])
+	assert.True(t, kinds[VerifyDanglingHint])
+	assert.True(t, kinds[VerifyLeftoverMergeDir])
+	assert.True(t, kinds[VerifyInvalidMetaFile])
+	assert.False(t, kinds[VerifyCorruptRecord])
+}
+
+func TestVerify_CorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	dataFile, err := data.OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	var offsets []int64
+	for i := 0; i < 5; i++ {
+		encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+			Key:   logRecordKeyWithSeq(utils.GetTestKey(i), nonTransactionSeqNo),
+			Value: utils.RandomValue(32),
+			Type:  data.LogRecordNormal,
+		})
+		offsets = append(offsets, dataFile.WriteOff)
+		assert.Nil(t, dataFile.Write(encRecord))
+	}
+	assert.Nil(t, dataFile.Close())
+
+	// 破坏中间一条记录的头部，记录的长度也不再可信
+	fileName := data.GetDataFileName(dir, 0)
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	content[offsets[2]+5] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+
+	// 跳过损坏的记录之后继续校验后面的记录
+	report, err := Verify(dir)
+	assert.Nil(t, err)
+	assert.False(t, report.OK)
+	assert.Equal(t, 1, len(report.Problems))
+	assert.Equal(t, VerifyCorruptRecord, report.Problems[0].Kind)
+	assert.Equal(t, offsets[2], report.Problems[0].Offset)
+	assert.Equal(t, 4, report.Files[0].Records)
+
+	// 不会创建锁文件
+	after, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(entries), len(after))
+	_, err = os.Stat(filepath.Join(dir, fileLockName))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestVerify_Blob(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-verify-blob")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.ValueThreshold = 128
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), bytes.Repeat(utils.GetTestKey(i), 100)))
+	}
+	// 覆盖、删除和范围删除之后旧的 blob 文件被回收，只有之前的记录指向回收掉的 value
+	for i := 0; i < 400; i++ {
+		if i%2 == 0 {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			continue
+		}
+		assert.Nil(t, db.Put(utils.GetTestKey(i), bytes.Repeat([]byte{byte(i)}, 200)))
+	}
+	assert.Nil(t, db.DeleteRange(utils.GetTestKey(450), utils.GetTestKey(460)))
+	assert.Nil(t, db.BlobGC())
+	assert.Nil(t, db.Close())
+
+	report, err := Verify(dir)
+	assert.Nil(t, err)
+	assert.True(t, report.OK)
+	assert.Empty(t, report.Problems)
+
+	// 删除仍然被引用的 blob 文件
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	blobFid := db.index.Get(utils.GetTestKey(499)).BlobFid
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.Remove(data.GetBlobFileName(dir, blobFid)))
+	report, err = Verify(dir)
+	assert.Nil(t, err)
+	assert.False(t, report.OK)
+	assert.True(t, verifyProblemKinds(report)[VerifyDanglingBlob])
+}
@@ -0,0 +1,404 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+)
+
+type WatchEntryType = byte
+
+const (
+	// WatchPut 写入数据
+	WatchPut WatchEntryType = iota
+
+	// WatchDelete 删除数据
+	WatchDelete
+
+	// WatchDeleteRange 范围删除，Key 为起始 key，Value 为结束 key(不包含，为空表示没有上界)
+	WatchDeleteRange
+)
+
+// WatchEntry 一个 key 的变更
+type WatchEntry struct {
+	Key   []byte
+	Value []byte
+	Type  WatchEntryType
+
+	// ValueReclaimed 重放历史变更时，value 所在的 blob 文件已经被回收了，Value 为空
+	ValueReclaimed bool
+}
+
+// matchPrefix 变更是否涉及前缀为 prefix 的 key
+func (entry *WatchEntry) matchPrefix(prefix []byte) bool {
+	if entry.Type != WatchDeleteRange {
+		return bytes.HasPrefix(entry.Key, prefix)
+	}
+	// 范围删除的区间和前缀的区间有交集
+	prefixEnd := prefixSuccessor(prefix)
+	return (prefixEnd == nil || bytes.Compare(entry.Key, prefixEnd) < 0) &&
+		(len(entry.Value) == 0 || bytes.Compare(entry.Value, prefix) > 0)
+}
+
+// WatchEvent 一次提交产生的变更，批量写和事务提交的所有变更在同一个事件中
+type WatchEvent struct {
+	SeqNo   uint64
+	Entries []*WatchEntry
+}
+
+// 订阅者
+type watcher struct {
+	prefix []byte
+	ch     chan *WatchEvent // 待发送的事件，消费过慢写满之后会被关闭
+}
+
+// Watch 订阅之后提交的、前缀为 prefix 的变更
+// 返回的 channel 会在 ctx 结束、数据库关闭、或者消费速度过慢时被关闭，
+// 消费者可以记录收到的最后一个 SeqNo，再通过 WatchFrom 继续订阅
+func (db *DB) Watch(ctx context.Context, prefix []byte) (<-chan *WatchEvent, error) {
+	return db.watch(ctx, prefix, 0, false)
+}
+
+// WatchFrom 先从数据文件中回放序列号大于 seqNo 的变更，再订阅之后提交的变更
+// 历史变更按照序列号的顺序边读取边发送，回放期间读取数据失败时关闭 channel
+// 注意 merge 之后的数据不再带有序列号，无法回放
+func (db *DB) WatchFrom(ctx context.Context, prefix []byte, seqNo uint64) (<-chan *WatchEvent, error) {
+	return db.watch(ctx, prefix, seqNo, true)
+}
+
+func (db *DB) watch(ctx context.Context, prefix []byte, since uint64, replay bool) (<-chan *WatchEvent, error) {
+	w := &watcher{
+		prefix: prefix,
+		ch:     make(chan *WatchEvent, db.options.WatchBufferSize),
+	}
+
+	// 锁住全部 slot，在没有写入的时刻注册订阅者，并记录需要回放的数据范围
+	for slot := range db.mus {
+		db.mus[slot].RLock()
+	}
+	var files []*data.DataFile
+	limits := make(map[uint32]int64)
+	if replay {
+		for _, file := range db.olderFiles {
+			size, err := file.IoManager.Size()
+			if err != nil {
+				for i := len(db.mus) - 1; i >= 0; i-- {
+					db.mus[i].RUnlock()
+				}
+				return nil, err
+			}
+			files = append(files, file)
+			limits[file.FileId] = size
+		}
+		for _, file := range db.activeFiles {
+			if file != nil {
+				files = append(files, file)
+				limits[file.FileId] = file.WriteOff
+			}
+		}
+	}
+	db.watchMu.Lock()
+	db.watchers[w] = struct{}{}
+	db.watchMu.Unlock()
+	for i := len(db.mus) - 1; i >= 0; i-- {
+		db.mus[i].RUnlock()
+	}
+
+	// 先定位到每个文件中第一条需要回放的记录，读取失败时直接返回错误，之后的记录在发送时再读取
+	var replayer *eventReplayer
+	if replay {
+		var err error
+		if replayer, err = db.newEventReplayer(files, limits, prefix, since); err != nil {
+			db.removeWatcher(w)
+			return nil, err
+		}
+	}
+
+	out := make(chan *WatchEvent)
+	db.bgWg.Add(1)
+	go func() {
+		defer db.bgWg.Done()
+		defer close(out)
+		defer db.removeWatcher(w)
+
+		send := func(event *WatchEvent) bool {
+			select {
+			case out <- event:
+				return true
+			case <-ctx.Done():
+			case <-db.closeCh:
+			}
+			return false
+		}
+
+		// 按照序列号的顺序依次读取和发送历史变更，期间提交的变更暂存在 w.ch 中
+		for replayer != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-db.closeCh:
+				return
+			default:
+			}
+			event, err := replayer.next()
+			if err != nil {
+				log.Printf("failed to replay watch events: %v\n", err)
+				return
+			}
+			if event == nil {
+				break
+			}
+			if !send(event) {
+				return
+			}
+		}
+		for {
+			select {
+			case event, ok := <-w.ch:
+				if !ok || !send(event) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-db.closeCh:
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// removeWatcher 取消订阅
+func (db *DB) removeWatcher(w *watcher) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	if _, ok := db.watchers[w]; ok {
+		delete(db.watchers, w)
+		close(w.ch)
+	}
+}
+
+// publish 通知订阅者一次已经提交的变更
+// 调用时需要持有变更的 key 所在 slot 的写锁，保证同一个 key 的事件是有序的
+func (db *DB) publish(seqNo uint64, entries []*WatchEntry) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	for w := range db.watchers {
+		event := filterWatchEvent(seqNo, entries, w.prefix)
+		if event == nil {
+			continue
+		}
+		select {
+		case w.ch <- event:
+		default:
+			// 消费过慢，关闭订阅，由消费者从最后收到的序列号重新订阅
+			delete(db.watchers, w)
+			close(w.ch)
+		}
+	}
+}
+
+// filterWatchEvent 过滤出前缀匹配的变更，没有匹配的变更时返回 nil
+func filterWatchEvent(seqNo uint64, entries []*WatchEntry, prefix []byte) *WatchEvent {
+	if len(prefix) == 0 {
+		return &WatchEvent{SeqNo: seqNo, Entries: entries}
+	}
+	var matched []*WatchEntry
+	for _, entry := range entries {
+		if entry.matchPrefix(prefix) {
+			matched = append(matched, entry)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+	return &WatchEvent{SeqNo: seqNo, Entries: matched}
+}
+
+// replayCursor 顺序读取一个数据文件中需要回放的记录
+// 同一个 slot 的写入是串行的，序列号在持有锁时分配，所以每个数据文件中记录的序列号是递增的
+type replayCursor struct {
+	file   *data.DataFile
+	offset int64
+	limit  int64 // 需要读取的范围，之后写入的数据通过订阅获取
+	record *data.LogRecord
+	key    []byte // 去掉序列号之后的 key
+	seqNo  uint64
+}
+
+// advance 读取下一条序列号大于 since 的记录，读完之后 record 为 nil
+func (c *replayCursor) advance(since uint64) error {
+	c.record = nil
+	for c.offset < c.limit {
+		logRecord, size, err := c.file.ReadLogRecord(c.offset)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		c.offset += size
+
+		realKey, seqNo := parseLogRecordKey(logRecord.Key)
+		// blob 回收移动 value 时写入的记录不是新的变更
+		if seqNo <= since || logRecord.Type == data.LogRecordRelocated {
+			continue
+		}
+		c.record, c.key, c.seqNo = logRecord, realKey, seqNo
+		return nil
+	}
+	return nil
+}
+
+// replayHeap 按照当前记录的序列号排序的 cursor 小顶堆
+type replayHeap []*replayCursor
+
+func (h replayHeap) Len() int           { return len(h) }
+func (h replayHeap) Less(i, j int) bool { return h[i].seqNo < h[j].seqNo }
+func (h replayHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *replayHeap) Push(x any)        { *h = append(*h, x.(*replayCursor)) }
+func (h *replayHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// eventReplayer 归并所有数据文件中序列号大于 since 的记录，按照序列号的顺序逐个生成事件，
+// 同一时刻只需要在内存中保存一次提交的数据
+type eventReplayer struct {
+	db      *DB
+	cursors replayHeap
+	prefix  []byte
+	since   uint64
+}
+
+func (db *DB) newEventReplayer(files []*data.DataFile, limits map[uint32]int64,
+	prefix []byte, since uint64) (*eventReplayer, error) {
+	r := &eventReplayer{db: db, prefix: prefix, since: since}
+	for _, dataFile := range files {
+		c := &replayCursor{file: dataFile, limit: limits[dataFile.FileId]}
+		if err := c.advance(since); err != nil {
+			return nil, err
+		}
+		if c.record != nil {
+			r.cursors = append(r.cursors, c)
+		}
+	}
+	heap.Init(&r.cursors)
+	return r, nil
+}
+
+// next 返回下一个需要回放的事件，全部回放完成之后返回 nil
+func (r *eventReplayer) next() (*WatchEvent, error) {
+	for len(r.cursors) > 0 {
+		// 一次提交的记录序列号相同，可能分布在多个文件中，全部取出之后再生成事件
+		seqNo := r.cursors[0].seqNo
+		var records []*data.LogRecord
+		var keys [][]byte
+		for len(r.cursors) > 0 && r.cursors[0].seqNo == seqNo {
+			c := r.cursors[0]
+			records = append(records, c.record)
+			keys = append(keys, c.key)
+			if err := c.advance(r.since); err != nil {
+				return nil, err
+			}
+			if c.record == nil {
+				heap.Pop(&r.cursors)
+			} else {
+				heap.Fix(&r.cursors, 0)
+			}
+		}
+
+		event, err := r.buildEvent(seqNo, records, keys)
+		if err != nil {
+			return nil, err
+		}
+		if event != nil {
+			return event, nil
+		}
+	}
+	return nil, nil
+}
+
+// buildEvent 根据一次提交的全部记录生成事件，提交不完整或者没有匹配前缀的变更时返回 nil
+func (r *eventReplayer) buildEvent(seqNo uint64, records []*data.LogRecord, keys [][]byte) (*WatchEvent, error) {
+	var finished bool
+	var count uint64
+	var batch []int
+	for i, logRecord := range records {
+		if !bytes.Equal(keys[i], txnFinKey) {
+			batch = append(batch, i)
+			continue
+		}
+		value, err := r.db.recordValue(logRecord)
+		if err != nil {
+			return nil, err
+		}
+		if len(value) == 8 {
+			finished, count = true, binary.BigEndian.Uint64(value)
+		}
+	}
+
+	var entries []*WatchEntry
+	// 写入数据的 value 在过滤之后再读取
+	putRecords := make(map[*WatchEntry]*data.LogRecord)
+	switch {
+	case finished:
+		// 批量写的数据，读到全部数据和事务完成记录才是完整的提交
+		if uint64(len(batch)) != count {
+			return nil, nil
+		}
+		for _, i := range batch {
+			if records[i].Type == data.LogRecordDeleted {
+				entries = append(entries, &WatchEntry{Key: keys[i], Type: WatchDelete})
+				continue
+			}
+			entry := &WatchEntry{Key: keys[i], Type: WatchPut}
+			putRecords[entry] = records[i]
+			entries = append(entries, entry)
+		}
+	case len(batch) == 1:
+		i := batch[0]
+		switch records[i].Type {
+		case data.LogRecordTxnFinished:
+			entry := &WatchEntry{Key: keys[i], Type: WatchPut}
+			putRecords[entry] = records[i]
+			entries = []*WatchEntry{entry}
+		case data.LogRecordRangeDeleted:
+			entries = []*WatchEntry{{Key: keys[i], Value: records[i].Value, Type: WatchDeleteRange}}
+		case data.LogRecordDeleted:
+			// 没有事务完成记录的单条删除记录，就是 Delete 写入的
+			entries = []*WatchEntry{{Key: keys[i], Type: WatchDelete}}
+		}
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	event := filterWatchEvent(seqNo, entries, r.prefix)
+	if event == nil {
+		return nil, nil
+	}
+	for _, entry := range event.Entries {
+		logRecord, ok := putRecords[entry]
+		if !ok {
+			continue
+		}
+		value, err := r.db.recordValue(logRecord)
+		// 之后被覆盖的 value 所在的 blob 文件可能已经被回收了，仍然通知这次变更，只是没有 value
+		if err == ErrDataFileNotFound && logRecord.Blob {
+			entry.ValueReclaimed = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry.Value = value
+	}
+	return event, nil
+}
@@ -0,0 +1,208 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 从 channel 中读取 n 个事件
+func receiveEvents(t *testing.T, ch <-chan *WatchEvent, n int) []*WatchEvent {
+	var events []*WatchEvent
+	for i := 0; i < n; i++ {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				t.Fatalf("watch channel closed after %d events", i)
+			}
+			events = append(events, event)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for event %d", i)
+		}
+	}
+	return events
+}
+
+func TestDB_Watch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := db.Watch(ctx, []byte("user:"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("user:1"), []byte("a")))
+	assert.Nil(t, db.Put([]byte("order:1"), []byte("b")))
+	assert.Nil(t, db.Delete([]byte("user:1")))
+
+	// 批量写的变更在同一个事件中
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("user:2"), []byte("c")))
+	assert.Nil(t, wb.Put([]byte("user:3"), []byte("d")))
+	assert.Nil(t, wb.Put([]byte("order:2"), []byte("e")))
+	assert.Nil(t, wb.Commit())
+
+	events := receiveEvents(t, ch, 3)
+	assert.Equal(t, 1, len(events[0].Entries))
+	assert.Equal(t, []byte("user:1"), events[0].Entries[0].Key)
+	assert.Equal(t, []byte("a"), events[0].Entries[0].Value)
+	assert.Equal(t, WatchPut, events[0].Entries[0].Type)
+	assert.Equal(t, WatchDelete, events[1].Entries[0].Type)
+	assert.Equal(t, 2, len(events[2].Entries))
+	assert.True(t, events[0].SeqNo < events[1].SeqNo)
+	assert.True(t, events[1].SeqNo < events[2].SeqNo)
+
+	// ctx 结束之后 channel 被关闭
+	cancel()
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("watch channel is not closed")
+	}
+}
+
+func TestDB_WatchFrom(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-from")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(20), []byte("batch")))
+	assert.Nil(t, wb.Delete(utils.GetTestKey(1)))
+	assert.Nil(t, wb.Commit())
+
+	// 重启之后从序列号 5 开始回放
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := db2.WatchFrom(ctx, nil, 5)
+	assert.Nil(t, err)
+	assert.Nil(t, db2.Put(utils.GetTestKey(30), []byte("live")))
+
+	events := receiveEvents(t, ch, 8)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, uint64(6+i), events[i].SeqNo)
+		assert.Equal(t, utils.GetTestKey(5+i), events[i].Entries[0].Key)
+	}
+	assert.Equal(t, WatchDelete, events[5].Entries[0].Type)
+	assert.Equal(t, 2, len(events[6].Entries))
+	assert.Equal(t, utils.GetTestKey(30), events[7].Entries[0].Key)
+	assert.Equal(t, []byte("live"), events[7].Entries[0].Value)
+}
+
+func TestDB_WatchFromManyFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-from-files")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	opts.WatchBufferSize = 1
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 数据分布在多个 slot 的多个文件中，批量写的数据跨越多个文件
+	var commits int
+	for i := 0; i < 1000; i++ {
+		if i%10 == 0 {
+			wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+			for j := 0; j < 5; j++ {
+				assert.Nil(t, wb.Put(utils.GetTestKey(i*10+j), utils.RandomValue(32)))
+			}
+			assert.Nil(t, wb.Commit())
+		} else {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(32)))
+		}
+		commits++
+	}
+	assert.Greater(t, len(db.olderFiles), 8)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := db.WatchFrom(ctx, nil, 0)
+	assert.Nil(t, err)
+	events := receiveEvents(t, ch, commits)
+	for i, event := range events {
+		assert.Equal(t, uint64(i+1), event.SeqNo)
+		if i%10 == 0 {
+			assert.Equal(t, 5, len(event.Entries))
+		} else {
+			assert.Equal(t, 1, len(event.Entries))
+		}
+	}
+}
+
+func TestDB_WatchBufferSize(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = t.TempDir()
+	opts.WatchBufferSize = 0
+	_, err := Open(opts)
+	assert.NotNil(t, err)
+}
+
+func TestDB_WatchFromReclaimedBlob(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-blob")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.ValueThreshold = 128
+	opts.DataFileMergeRatio = 0
+	opts.Slots = 1
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), bytes.Repeat([]byte{'a'}, 1024)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), bytes.Repeat([]byte{'b'}, 1024)))
+	}
+	assert.Nil(t, db.BlobGC())
+
+	// 第一次写入的 value 已经被回收，回放时依然通知这些变更，只是没有 value
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := db.WatchFrom(ctx, nil, 0)
+	assert.Nil(t, err)
+	events := receiveEvents(t, ch, 1000)
+	reclaimed := 0
+	for _, event := range events[:500] {
+		entry := event.Entries[0]
+		if entry.ValueReclaimed {
+			assert.Nil(t, entry.Value)
+			reclaimed++
+			continue
+		}
+		assert.Equal(t, bytes.Repeat([]byte{'a'}, 1024), entry.Value)
+	}
+	assert.Greater(t, reclaimed, 0)
+	for _, event := range events[500:] {
+		assert.False(t, event.Entries[0].ValueReclaimed)
+		assert.Equal(t, bytes.Repeat([]byte{'b'}, 1024), event.Entries[0].Value)
+	}
+}